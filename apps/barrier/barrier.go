@@ -0,0 +1,81 @@
+package barrier
+
+import (
+	"context"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// A barrier holds up everyone who waits on it for as long as its node exists.
+type Barrier struct {
+	session panapi.IPNSession
+	path    rpc.Ppath
+}
+
+func MakeBarrier(session panapi.IPNSession, path rpc.Ppath) *Barrier {
+	b := &Barrier{session: session, path: path}
+	return b
+}
+
+// Raise the barrier. Raising a barrier that is already up is not an error.
+func (b *Barrier) Set() rpc.Err {
+	_, err := b.session.Create(b.path, "", rpc.Flag{})
+	if err == rpc.ErrOnCreate {
+		return rpc.OK
+	}
+	return err
+}
+
+// Lower the barrier, letting every waiter through. Lowering a barrier that is already down is not an error.
+func (b *Barrier) Remove() rpc.Err {
+	for {
+		_, version, err := b.session.GetData(b.path, rpc.Watch{})
+		if err == rpc.ErrNoFile {
+			return rpc.OK
+		} else if err != rpc.OK {
+			return err
+		}
+		err = b.session.Delete(b.path, version)
+		if err == rpc.ErrNoFile {
+			return rpc.OK
+		} else if err != rpc.ErrVersion {
+			return err
+		}
+		// Changed since we read it; try again
+	}
+}
+
+// Block until the barrier is down.
+func (b *Barrier) Wait() {
+	b.TryWait(context.Background())
+}
+
+// Like Wait, but gives up once ctx is done. Returns whether the barrier is down.
+func (b *Barrier) TryWait(ctx context.Context) bool {
+	for {
+		// Buffered so the callback never blocks after we give up
+		ch_wait := make(chan struct{}, 1)
+		exists, err := b.session.ExistsCtx(
+			ctx,
+			b.path,
+			rpc.Watch{
+				ShouldWatch: true,
+				Callback: func(_ rpc.WatchArgs) {
+					ch_wait <- struct{}{}
+				},
+			},
+		)
+		if err != rpc.OK {
+			return false
+		}
+		if !exists {
+			return true
+		}
+		select {
+		case <-ch_wait:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
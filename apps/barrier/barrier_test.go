@@ -0,0 +1,121 @@
+package barrier
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi/rpc"
+)
+
+const (
+	NCLNT    = 10
+	NSERVERS = 5
+)
+
+// Waiters are held up until the barrier is removed
+func TestBarrier(t *testing.T) {
+	ts := pan.MakeTest(t, "TestBarrier", NCLNT+1, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	b := MakeBarrier(ts.MakeSession(), "/barrier")
+	if err := b.Set(); err != rpc.OK {
+		t.Fatalf("Set returned %v", err)
+	}
+
+	var removed atomic.Bool
+	ch_err := make(chan string)
+	ch_done := make(chan struct{})
+	for range NCLNT {
+		go func() {
+			MakeBarrier(ts.MakeSession(), "/barrier").Wait()
+			if !removed.Load() {
+				ch_err <- "A waiter passed the barrier before it was removed"
+				return
+			}
+			ch_done <- struct{}{}
+		}()
+	}
+
+	time.Sleep(1 * time.Second)
+	removed.Store(true)
+	if err := b.Remove(); err != rpc.OK {
+		t.Fatalf("Remove returned %v", err)
+	}
+	for range NCLNT {
+		select {
+		case err := <-ch_err:
+			t.Fatal(err)
+		case <-ch_done:
+		}
+	}
+}
+
+// Enter, do some work, then leave or crash. No process may get past Enter before every process has arrived, or past
+// Leave before every other process has left or crashed.
+func runDoubleBarrierClient(ch_err chan string, ch_done chan struct{}, clientCrash bool, entered *atomic.Int32, left *atomic.Int32, ts *pan.Test) {
+	session := ts.MakeSession()
+	b := MakeDoubleBarrier(session, "/barrier", NCLNT)
+
+	entered.Add(1)
+	b.Enter()
+	if entered.Load() != NCLNT {
+		ch_err <- "A process entered before every process arrived"
+		return
+	}
+	session.Create("/tester/seq-", "", rpc.Flag{Sequential: true})
+
+	time.Sleep(time.Duration(rand.Int63()%500) * time.Millisecond)
+	if clientCrash && (rand.Int()%100) < 30 {
+		left.Add(1)
+		ts.Crash(session)
+		ch_done <- struct{}{}
+		return
+	}
+
+	left.Add(1)
+	b.Leave()
+	if left.Load() != NCLNT {
+		ch_err <- "A process left before every other process finished"
+		return
+	}
+	ch_done <- struct{}{}
+}
+
+func runDoubleBarrierClients(t *testing.T, title string, clientCrash bool) {
+	ts := pan.MakeTest(t, title, NCLNT+1, NSERVERS, true, false, clientCrash, false, -1, false)
+	defer ts.Cleanup()
+
+	session := ts.MakeSession()
+	seqPath := rpc.Ppath("/tester/seq-")
+
+	var entered, left atomic.Int32
+	ch_err := make(chan string)
+	ch_done := make(chan struct{})
+	for range NCLNT {
+		go runDoubleBarrierClient(ch_err, ch_done, clientCrash, &entered, &left, ts)
+	}
+	for range NCLNT {
+		select {
+		case err := <-ch_err:
+			t.Fatal(err)
+		case <-ch_done:
+		}
+	}
+
+	// Every process did its work exactly once
+	name, _ := session.Create(seqPath, "", rpc.Flag{Sequential: true})
+	if name != seqPath+rpc.Ppath(rpc.SeqSuffix(NCLNT)) {
+		ts.Fatalf("Should have created %s; instead created %s", seqPath+rpc.Ppath(rpc.SeqSuffix(NCLNT)), name)
+	}
+}
+
+func TestDoubleBarrierNoErrors(t *testing.T) {
+	runDoubleBarrierClients(t, "TestDoubleBarrierNoErrors", false)
+}
+
+func TestDoubleBarrierClientCrashes(t *testing.T) {
+	runDoubleBarrierClients(t, "TestDoubleBarrierClientCrashes", true)
+}
@@ -0,0 +1,209 @@
+package barrier
+
+import (
+	"context"
+	"strings"
+
+	"pan/apps/recipe"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// A double barrier lets a group of size processes start a computation together and finish it together. Each process
+// entering creates an ephemeral sequential node in the barrier dir; the one that brings the count to size creates the
+// ready node, whose creation the others are watching for. To leave, a process deletes its node and waits until every
+// other node is gone: the process with the lowest node waits on the highest one, and every other process waits on the
+// lowest one, so each deletion wakes at most one or two waiters.
+//
+// A process that crashes after entering leaves with its session, so it does not hold up the others leaving. One that
+// crashes before the group is complete does hold up entering, until another process takes its place.
+const (
+	nodePrefix = "p-"
+	readyName  = "ready"
+)
+
+type DoubleBarrier struct {
+	session     panapi.IPNSession
+	dir         rpc.Ppath
+	size        int
+	currentFile rpc.Ppath
+}
+
+func MakeDoubleBarrier(session panapi.IPNSession, dir rpc.Ppath, size int) *DoubleBarrier {
+	b := &DoubleBarrier{session: session, dir: dir, size: size}
+	return b
+}
+
+// Returns the process nodes among children, leaving out the ready node.
+func (b *DoubleBarrier) processes(children []rpc.Ppath) []rpc.Ppath {
+	var nodes []rpc.Ppath
+	for _, child := range children {
+		if child != readyName && strings.HasSuffix(strings.TrimRight(string(child), "0123456789"), nodePrefix) {
+			nodes = append(nodes, b.dir+"/"+child)
+		}
+	}
+	return nodes
+}
+
+// Returns the process nodes with the lowest and highest sequence numbers.
+func lowestAndHighest(nodes []rpc.Ppath) (rpc.Ppath, rpc.Ppath) {
+	lowest, highest := nodes[0], nodes[0]
+	for _, node := range nodes {
+		if node.GetSeqNumber() < lowest.GetSeqNumber() {
+			lowest = node
+		}
+		if node.GetSeqNumber() > highest.GetSeqNumber() {
+			highest = node
+		}
+	}
+	return lowest, highest
+}
+
+// Block until node is deleted, or ctx is done. Returns false if ctx is done or the session fails.
+func (b *DoubleBarrier) waitDeleted(ctx context.Context, node rpc.Ppath) bool {
+	// Buffered so the callback never blocks after we give up
+	ch_wait := make(chan struct{}, 1)
+	exists, err := b.session.ExistsCtx(
+		ctx,
+		node,
+		rpc.Watch{
+			ShouldWatch: true,
+			Callback: func(_ rpc.WatchArgs) {
+				ch_wait <- struct{}{}
+			},
+		},
+	)
+	if err != rpc.OK {
+		return false
+	}
+	if exists {
+		select {
+		case <-ch_wait:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Join the group, and block until all size processes have joined.
+func (b *DoubleBarrier) Enter() {
+	b.TryEnter(context.Background())
+}
+
+// Like Enter, but gives up once ctx is done, leaving the group again. Returns whether all processes have joined.
+func (b *DoubleBarrier) TryEnter(ctx context.Context) bool {
+	ready := b.dir + "/" + readyName
+
+	// Watch for the ready node before joining, so that we can't miss its creation
+	ch_ready := make(chan struct{}, 1)
+	exists, err := b.session.ExistsCtx(
+		ctx,
+		ready,
+		rpc.Watch{
+			ShouldWatch: true,
+			Callback: func(_ rpc.WatchArgs) {
+				ch_ready <- struct{}{}
+			},
+		},
+	)
+	if err != rpc.OK {
+		return false
+	}
+
+	fname, err := recipe.CreateQueued(ctx, b.session, b.dir+"/"+nodePrefix, "")
+	if err != rpc.OK {
+		return false
+	}
+	b.currentFile = fname
+	if exists {
+		// The group is already complete, and leaving
+		return true
+	}
+
+	children, err := b.session.GetChildrenCtx(ctx, b.dir, rpc.Watch{})
+	if err != rpc.OK {
+		b.abandon()
+		return false
+	}
+	if len(b.processes(children)) >= b.size {
+		if _, err := b.session.CreateCtx(ctx, ready, "", rpc.Flag{}); err != rpc.OK && err != rpc.ErrOnCreate {
+			b.abandon()
+			return false
+		}
+		return true
+	}
+
+	select {
+	case <-ch_ready:
+		return true
+	case <-ctx.Done():
+		b.abandon()
+		return false
+	}
+}
+
+// Leave the group, and block until all other processes have left.
+func (b *DoubleBarrier) Leave() {
+	b.TryLeave(context.Background())
+}
+
+// Like Leave, but gives up once ctx is done. Returns whether all processes have left. A process that gave up has
+// still left, but may be ahead of others that have not.
+func (b *DoubleBarrier) TryLeave(ctx context.Context) bool {
+	defer func() { b.currentFile = "" }()
+
+	for {
+		children, err := b.session.GetChildrenCtx(ctx, b.dir, rpc.Watch{})
+		if err != rpc.OK {
+			b.abandon()
+			return false
+		}
+		nodes := b.processes(children)
+		if len(nodes) == 0 {
+			return true
+		}
+		if len(nodes) == 1 && nodes[0] == b.currentFile {
+			b.session.DeleteCtx(ctx, b.currentFile, 1)
+			// The last one out takes down the ready node, leaving the dir empty. A group must not reuse the dir until
+			// then, or its processes would find the old ready node and enter at once.
+			b.removeReady(ctx)
+			return true
+		}
+
+		lowest, highest := lowestAndHighest(nodes)
+		var node rpc.Ppath
+		if lowest == b.currentFile {
+			// Leave last, once everyone else has
+			node = highest
+		} else {
+			if b.currentFile != "" {
+				if err := b.session.DeleteCtx(ctx, b.currentFile, 1); err != rpc.OK && err != rpc.ErrNoFile {
+					return false
+				}
+				b.currentFile = ""
+			}
+			node = lowest
+		}
+		if !b.waitDeleted(ctx, node) {
+			b.abandon()
+			return false
+		}
+	}
+}
+
+// Delete the ready node, if it is still there.
+func (b *DoubleBarrier) removeReady(ctx context.Context) {
+	ready := b.dir + "/" + readyName
+	if _, version, err := b.session.GetDataCtx(ctx, ready, rpc.Watch{}); err == rpc.OK {
+		b.session.DeleteCtx(ctx, ready, version)
+	}
+}
+
+// Give up our place in the group.
+func (b *DoubleBarrier) abandon() {
+	if b.currentFile != "" {
+		go b.session.Delete(b.currentFile, 1)
+	}
+	b.currentFile = ""
+}
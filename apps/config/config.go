@@ -0,0 +1,169 @@
+package config
+
+import (
+	"encoding/json"
+	"sync"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// A Value holds a config znode's data decoded from JSON, and keeps it current with watches. The data watch fires on
+// changes but not on deletion, and an Exists watch fires on deletion or creation depending on whether the znode is
+// there, so a Value keeps one of each armed, and re-arms each only once it has fired.
+type Value[T any] struct {
+	session panapi.IPNSession
+	path    rpc.Ppath
+	done    chan struct{}
+
+	mu        sync.Mutex
+	value     T
+	data      string // the data value was decoded from
+	version   rpc.Pversion
+	exists    bool
+	callbacks []func(T)
+}
+
+// Makes a Value for the config at path, which need not exist yet. The Value is current when MakeValue returns.
+func MakeValue[T any](session panapi.IPNSession, path rpc.Ppath) *Value[T] {
+	v := &Value[T]{session: session, path: path, done: make(chan struct{})}
+	w := &watcher{}
+	ok := v.refresh(w)
+	go v.maintain(w, ok)
+	return v
+}
+
+// The watches a Value has armed; a nil channel means the watch has fired, or was never set
+type watcher struct {
+	ch_data   chan struct{}
+	ch_exists chan struct{}
+}
+
+// Returns a watch that signals a new channel, stored in *ch.
+func arm(ch *chan struct{}) rpc.Watch {
+	// Buffered so the callback never blocks after we stop
+	c := make(chan struct{}, 1)
+	*ch = c
+	return rpc.Watch{
+		ShouldWatch: true,
+		Callback: func(_ rpc.WatchArgs) {
+			c <- struct{}{}
+		},
+	}
+}
+
+// Re-arm the watches that fired, read the config, and tell the callbacks if it changed.
+// Returns false if the session failed.
+func (v *Value[T]) refresh(w *watcher) bool {
+	if w.ch_exists == nil {
+		if _, err := v.session.Exists(v.path, arm(&w.ch_exists)); err != rpc.OK {
+			return false
+		}
+	}
+	watch := rpc.Watch{}
+	if w.ch_data == nil {
+		watch = arm(&w.ch_data)
+	}
+	data, version, err := v.session.GetData(v.path, watch)
+	if err != rpc.OK && err != rpc.ErrNoFile {
+		return false
+	}
+
+	v.mu.Lock()
+	exists := err == rpc.OK
+	if exists == v.exists && data == v.data {
+		// A rewrite of the same data, or a change we read already
+		v.version = version
+		v.mu.Unlock()
+		return true
+	}
+	var value T
+	if exists && json.Unmarshal([]byte(data), &value) != nil {
+		// Keep the last value that decoded
+		v.mu.Unlock()
+		return true
+	}
+	v.value, v.data, v.version, v.exists = value, data, version, exists
+	callbacks := v.callbacks
+	v.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(value)
+	}
+	return true
+}
+
+// Refresh the value whenever a watch fires, until Close or the session fails.
+func (v *Value[T]) maintain(w *watcher, ok bool) {
+	for ok {
+		select {
+		case <-w.ch_data:
+			w.ch_data = nil
+		case <-w.ch_exists:
+			w.ch_exists = nil
+		case <-v.done:
+			return
+		}
+		ok = v.refresh(w)
+	}
+}
+
+// Stop keeping the value current.
+func (v *Value[T]) Close() {
+	close(v.done)
+}
+
+// Returns the current value and its version, and whether the config exists. A config whose data does not decode into
+// a T keeps the last value that did.
+func (v *Value[T]) Get() (T, rpc.Pversion, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.value, v.version, v.exists
+}
+
+// Call callback with each new value, or with the zero value if the config is deleted. Callbacks run in order on the
+// Value's own goroutine, so they should not block.
+func (v *Value[T]) OnChange(callback func(T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.callbacks = append(v.callbacks, callback)
+}
+
+// Replace the config with update applied to its current value, or to the zero value if it doesn't exist, retrying
+// while other clients change it first. Writes go through the session's asynchronous calls, which the servers apply
+// at most once even when a reply is lost, so Update always learns whether its write took effect and never applies
+// update twice.
+func (v *Value[T]) Update(update func(T) T) rpc.Err {
+	for {
+		var value T
+		data, version, err := v.session.GetData(v.path, rpc.Watch{})
+		if err == rpc.OK {
+			// Start over from the zero value if the data doesn't decode
+			json.Unmarshal([]byte(data), &value)
+		} else if err != rpc.ErrNoFile {
+			return err
+		}
+
+		newData, _ := json.Marshal(update(value))
+
+		if err == rpc.ErrNoFile {
+			_, err = v.session.Create(v.path, string(newData), rpc.Flag{})
+			if err == rpc.ErrOnCreate {
+				// Created since we looked; try again
+				continue
+			}
+			return err
+		}
+
+		_, err = v.session.SetDataAsync(v.path, string(newData), version).Wait()
+		if err != rpc.ErrVersion {
+			return err
+		}
+		// Changed since we read it; try again
+	}
+}
+
+// Replace the config with value.
+func (v *Value[T]) Set(value T) rpc.Err {
+	return v.Update(func(T) T { return value })
+}
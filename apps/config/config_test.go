@@ -0,0 +1,108 @@
+package config
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi/rpc"
+)
+
+const (
+	NCLNT    = 5
+	NUPDATES = 10 // per client
+	NSERVERS = 5
+)
+
+type appConfig struct {
+	Name    string
+	Workers int
+}
+
+// Returns the next value on ch, or fails the test if none comes.
+func expectChange(t *testing.T, ch chan appConfig, want appConfig) {
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("Observed %+v; expected %+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not observe %+v", want)
+	}
+}
+
+// A subscriber sees the config created, changed, deleted and created again
+func TestHotReload(t *testing.T) {
+	ts := pan.MakeTest(t, "TestHotReload", 2, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	reader := MakeValue[appConfig](ts.MakeSession(), "/config/app")
+	defer reader.Close()
+	if _, _, exists := reader.Get(); exists {
+		t.Fatal("A config that was never written exists")
+	}
+	ch := make(chan appConfig, 10)
+	reader.OnChange(func(c appConfig) { ch <- c })
+
+	session := ts.MakeSession()
+	writer := MakeValue[appConfig](session, "/config/app")
+	defer writer.Close()
+
+	if err := writer.Set(appConfig{Name: "app", Workers: 1}); err != rpc.OK {
+		t.Fatalf("Set returned %v", err)
+	}
+	expectChange(t, ch, appConfig{Name: "app", Workers: 1})
+
+	for i := 2; i <= 4; i++ {
+		if err := writer.Update(func(c appConfig) appConfig { c.Workers++; return c }); err != rpc.OK {
+			t.Fatalf("Update returned %v", err)
+		}
+		expectChange(t, ch, appConfig{Name: "app", Workers: i})
+	}
+	if value, version, exists := reader.Get(); !exists || value.Workers != 4 || version != 4 {
+		t.Fatalf("Get returned %+v, version %d, %v; expected 4 workers at version 4", value, version, exists)
+	}
+
+	if err := session.Delete("/config/app", 4); err != rpc.OK {
+		t.Fatalf("Delete returned %v", err)
+	}
+	expectChange(t, ch, appConfig{})
+	if _, _, exists := reader.Get(); exists {
+		t.Fatal("A deleted config exists")
+	}
+
+	if err := writer.Set(appConfig{Name: "again"}); err != rpc.OK {
+		t.Fatalf("Set returned %v", err)
+	}
+	expectChange(t, ch, appConfig{Name: "again"})
+}
+
+// Concurrent updates all take effect
+func TestConcurrentUpdates(t *testing.T) {
+	ts := pan.MakeTest(t, "TestConcurrentUpdates", NCLNT+1, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	var wg sync.WaitGroup
+	for range NCLNT {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v := MakeValue[appConfig](ts.MakeSession(), "/config/app")
+			defer v.Close()
+			for range NUPDATES {
+				if err := v.Update(func(c appConfig) appConfig { c.Workers++; return c }); err != rpc.OK {
+					t.Errorf("Update returned %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v := MakeValue[appConfig](ts.MakeSession(), "/config/app")
+	defer v.Close()
+	if value, _, _ := v.Get(); value.Workers != NCLNT*NUPDATES {
+		t.Fatalf("Config has %d workers; expected %d", value.Workers, NCLNT*NUPDATES)
+	}
+}
@@ -0,0 +1,148 @@
+package counter
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// The counter's value lives in the data of its znode, and every update is a GetData followed by a SetData of the
+// version read, retried with backoff while other clients get in first.
+//
+// A SetData whose reply was lost is retried by the Session, and if the retry fails the version check the Session
+// returns rpc.ErrMaybe: the first attempt may have applied, bumping the version, or another client may have. Retrying
+// the update then would count it twice if it had applied, and giving up would lose it if it had not. So each write
+// also records a random id, and the znode keeps the ids of the last idWindow writes. If our id is among them, our write
+// applied; if it is not, and fewer than idWindow writes happened since the version we wrote, it did not.
+const idWindow = 32
+
+const (
+	minBackoff = time.Millisecond
+	maxBackoff = 100 * time.Millisecond
+)
+
+type Counter struct {
+	session panapi.IPNSession
+	path    rpc.Ppath
+}
+
+// Makes a counter stored at path, starting at zero unless path already holds a counter.
+func MakeCounter(session panapi.IPNSession, path rpc.Ppath) *Counter {
+	c := &Counter{session: session, path: path}
+	session.Create(path, encode(0, nil), rpc.Flag{}) // ErrOnCreate if it exists
+	return c
+}
+
+// The znode holds the value, then the ids of recent writes, one per line.
+func encode(value int64, ids []string) string {
+	return strings.Join(append([]string{strconv.FormatInt(value, 10)}, ids...), "\n")
+}
+
+func decode(data string) (int64, []string) {
+	lines := strings.Split(data, "\n")
+	value, _ := strconv.ParseInt(lines[0], 10, 64)
+	return value, lines[1:]
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// Sleep before retry number attempt of an update that lost a race: up to twice as long as last time, jittered.
+func backoff(attempt int) {
+	delay := min(minBackoff<<min(attempt, 16), maxBackoff)
+	time.Sleep(delay/2 + mrand.N(delay/2+1))
+}
+
+// Returns the current value.
+func (c *Counter) Get() (int64, rpc.Err) {
+	data, _, err := c.session.GetData(c.path, rpc.Watch{})
+	if err != rpc.OK {
+		return 0, err
+	}
+	value, _ := decode(data)
+	return value, rpc.OK
+}
+
+// Apply update to the value until it sticks. update returns the new value, or false to leave the value alone.
+// Returns the value update was last given, and whether it was changed. Returns rpc.ErrMaybe only if a write whose
+// reply was lost can no longer be told apart from the writes since.
+func (c *Counter) update(update func(int64) (int64, bool)) (int64, bool, rpc.Err) {
+	for attempt := 0; ; attempt++ {
+		data, version, err := c.session.GetData(c.path, rpc.Watch{})
+		if err != rpc.OK {
+			return 0, false, err
+		}
+		value, ids := decode(data)
+		newValue, ok := update(value)
+		if !ok {
+			return value, false, rpc.OK
+		}
+
+		id := newId()
+		ids = append(ids, id)
+		if len(ids) > idWindow {
+			ids = ids[len(ids)-idWindow:]
+		}
+		err = c.session.SetData(c.path, encode(newValue, ids), version)
+		if err == rpc.ErrMaybe {
+			err = c.resolve(id, version)
+		}
+		switch err {
+		case rpc.OK:
+			return value, true, rpc.OK
+		case rpc.ErrVersion:
+			backoff(attempt)
+		default:
+			return 0, false, err
+		}
+	}
+}
+
+// Find out whether the write with id, made to version, applied. Returns rpc.OK if it did, rpc.ErrVersion if it did
+// not, or rpc.ErrMaybe if too many writes happened since to tell.
+func (c *Counter) resolve(id string, version rpc.Pversion) rpc.Err {
+	data, current, err := c.session.GetData(c.path, rpc.Watch{})
+	if err != rpc.OK {
+		return err
+	}
+	_, ids := decode(data)
+	if slices.Contains(ids, id) {
+		return rpc.OK
+	}
+	if current-version <= idWindow {
+		// Our id would still be listed had our write applied
+		return rpc.ErrVersion
+	}
+	return rpc.ErrMaybe
+}
+
+// Add delta to the value, and return the new value.
+func (c *Counter) Add(delta int64) (int64, rpc.Err) {
+	old, _, err := c.update(func(value int64) (int64, bool) {
+		return value + delta, true
+	})
+	return old + delta, err
+}
+
+// Add one to the value, and return the new value.
+func (c *Counter) Increment() (int64, rpc.Err) {
+	return c.Add(1)
+}
+
+// Set the value to new if it is expected. Returns whether it was.
+func (c *Counter) CompareAndSet(expected int64, new int64) (bool, rpc.Err) {
+	_, ok, err := c.update(func(value int64) (int64, bool) {
+		return new, value == expected
+	})
+	return ok, err
+}
@@ -0,0 +1,114 @@
+package counter
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"pan/pan"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+const (
+	NCLNT    = 5
+	NINCR    = 20 // per client
+	NSERVERS = 5
+)
+
+// Clients increment concurrently; the counter must end up at exactly the number of increments
+func runCounterClients(t *testing.T, title string, leaderCrash bool) {
+	ts := pan.MakeTest(t, title, NCLNT+1, NSERVERS, true, leaderCrash, false, false, -1, false)
+	defer ts.Cleanup()
+
+	var clients []func() string
+	for range NCLNT {
+		clients = append(clients, func() string {
+			c := MakeCounter(ts.MakeSession(), "/counter")
+			for range NINCR {
+				if _, err := c.Increment(); err != rpc.OK {
+					return "Increment returned " + string(err)
+				}
+			}
+			return ""
+		})
+	}
+	ts.RunClients(clients...)
+
+	value, err := MakeCounter(ts.MakeSession(), "/counter").Get()
+	if err != rpc.OK || value != NCLNT*NINCR {
+		t.Fatalf("Get returned %d, %v; expected %d", value, err, NCLNT*NINCR)
+	}
+}
+
+func TestCounterNoErrors(t *testing.T) {
+	runCounterClients(t, "TestCounterNoErrors", false)
+}
+
+func TestCounterLeaderCrashes(t *testing.T) {
+	runCounterClients(t, "TestCounterLeaderCrashes", true)
+}
+
+// A session that loses the reply to two of every three SetData calls, reporting rpc.ErrMaybe for both: the first of
+// them reaches the servers and applies, and the second never does.
+type lossySession struct {
+	panapi.IPNSession
+	calls atomic.Int32
+}
+
+func (s *lossySession) SetData(path rpc.Ppath, data string, version rpc.Pversion) rpc.Err {
+	switch s.calls.Add(1) % 3 {
+	case 1:
+		s.IPNSession.SetData(path, data, version)
+		return rpc.ErrMaybe
+	case 2:
+		return rpc.ErrMaybe
+	}
+	return s.IPNSession.SetData(path, data, version)
+}
+
+// Increments whose replies are lost are counted once each, whether or not they applied
+func TestCounterLostReplies(t *testing.T) {
+	ts := pan.MakeTest(t, "TestCounterLostReplies", NCLNT+1, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	var wg sync.WaitGroup
+	for range NCLNT {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := MakeCounter(&lossySession{IPNSession: ts.MakeSession()}, "/counter")
+			for range NINCR {
+				if _, err := c.Increment(); err != rpc.OK {
+					t.Errorf("Increment returned %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := MakeCounter(ts.MakeSession(), "/counter").Get()
+	if err != rpc.OK || value != NCLNT*NINCR {
+		t.Fatalf("Get returned %d, %v; expected %d", value, err, NCLNT*NINCR)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	ts := pan.MakeTest(t, "TestCompareAndSet", 1, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	c := MakeCounter(ts.MakeSession(), "/counter")
+	if value, err := c.Add(5); err != rpc.OK || value != 5 {
+		t.Fatalf("Add returned %d, %v; expected 5", value, err)
+	}
+	if ok, err := c.CompareAndSet(4, 10); err != rpc.OK || ok {
+		t.Fatalf("CompareAndSet of a wrong value returned %v, %v", ok, err)
+	}
+	if ok, err := c.CompareAndSet(5, 10); err != rpc.OK || !ok {
+		t.Fatalf("CompareAndSet of the right value returned %v, %v", ok, err)
+	}
+	if value, err := c.Add(-3); err != rpc.OK || value != 7 {
+		t.Fatalf("Add returned %d, %v; expected 7", value, err)
+	}
+}
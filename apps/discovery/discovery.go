@@ -0,0 +1,241 @@
+package discovery
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// Each live instance of a service has an ephemeral sequential node under ServicesDir/<name>, holding the instance's
+// metadata as JSON, so an instance disappears when its session ends or expires. Clients keep a ServiceCache, which
+// watches the service's children and reads each new instance once, since an instance's metadata never changes.
+const ServicesDir rpc.Ppath = "/services"
+
+const nodePrefix = "instance-"
+
+// Where an instance of a service can be reached, and anything else it wants its clients to know
+type Instance struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// Returns the dir holding the instances of service name.
+func serviceDir(name string) rpc.Ppath {
+	return ServicesDir + "/" + rpc.Ppath(name)
+}
+
+// An instance's registration, which lasts until Unregister or the end of its session
+type Registration struct {
+	session panapi.IPNSession
+	node    rpc.Ppath
+}
+
+// Register instance as a live instance of service name.
+func Register(session panapi.IPNSession, name string, instance Instance) (*Registration, rpc.Err) {
+	data, _ := json.Marshal(instance)
+	node, err := session.Create(serviceDir(name)+"/"+nodePrefix, string(data), rpc.Flag{Sequential: true, Ephemeral: true})
+	if err != rpc.OK {
+		return nil, err
+	}
+	return &Registration{session: session, node: node}, rpc.OK
+}
+
+// Remove the instance from the service.
+func (r *Registration) Unregister() rpc.Err {
+	return r.session.Delete(r.node, 1)
+}
+
+// A view of the live instances of a service, kept up to date by a watch on its dir
+type ServiceCache struct {
+	session  panapi.IPNSession
+	dir      rpc.Ppath
+	onAdd    func(Instance)
+	onRemove func(Instance)
+	done     chan struct{} // closed by Close
+	stopped  chan struct{} // closed once the cache is no longer kept up to date
+
+	mu        sync.Mutex
+	instances map[rpc.Ppath]Instance // by node name
+	err       rpc.Err                // why the cache stopped, if the session failed
+}
+
+// Makes a cache of the instances of service name. onAdd and onRemove, if not nil, are called for each instance that
+// joins or leaves. The onAdd for each instance already there runs on the caller's goroutine, before MakeServiceCache
+// returns with the cache up to date; later calls run on a goroutine of the cache's own, so they should not block.
+// If the session fails, the cache stops changing: Done is closed and Err says why.
+func MakeServiceCache(session panapi.IPNSession, name string, onAdd func(Instance), onRemove func(Instance)) *ServiceCache {
+	c := &ServiceCache{
+		session:   session,
+		dir:       serviceDir(name),
+		onAdd:     onAdd,
+		onRemove:  onRemove,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		instances: make(map[rpc.Ppath]Instance),
+		err:       rpc.OK,
+	}
+
+	// The children can only be watched once the dir exists
+	session.Create(c.dir, "", rpc.Flag{}) // ErrOnCreate if it exists
+
+	ch_wait, err := c.refresh()
+	go c.maintain(ch_wait, err)
+	return c
+}
+
+// List the service's instances, watching for the next change, and bring the cache up to date.
+// Returns the channel the watch signals, or the Err if the session failed.
+func (c *ServiceCache) refresh() (chan struct{}, rpc.Err) {
+	// Buffered so the callback never blocks after we stop
+	ch_wait := make(chan struct{}, 1)
+	children, err := c.session.GetChildren(
+		c.dir,
+		rpc.Watch{
+			ShouldWatch: true,
+			Callback: func(_ rpc.WatchArgs) {
+				ch_wait <- struct{}{}
+			},
+		},
+	)
+	if err != rpc.OK {
+		return nil, err
+	}
+
+	live := make(map[rpc.Ppath]bool)
+	var added, removed []Instance
+	for _, child := range children {
+		live[child] = true
+		c.mu.Lock()
+		_, known := c.instances[child]
+		c.mu.Unlock()
+		if known {
+			continue
+		}
+
+		data, _, err := c.session.GetData(c.dir+"/"+child, rpc.Watch{})
+		if err != rpc.OK {
+			// Gone already; the watch will tell us
+			continue
+		}
+		var instance Instance
+		if json.Unmarshal([]byte(data), &instance) != nil {
+			continue
+		}
+		c.mu.Lock()
+		c.instances[child] = instance
+		c.mu.Unlock()
+		added = append(added, instance)
+	}
+
+	c.mu.Lock()
+	for child, instance := range c.instances {
+		if !live[child] {
+			delete(c.instances, child)
+			removed = append(removed, instance)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, instance := range removed {
+		if c.onRemove != nil {
+			c.onRemove(instance)
+		}
+	}
+	for _, instance := range added {
+		if c.onAdd != nil {
+			c.onAdd(instance)
+		}
+	}
+	return ch_wait, rpc.OK
+}
+
+// Refresh the cache whenever the service's instances change, until Close or the session fails.
+func (c *ServiceCache) maintain(ch_wait chan struct{}, err rpc.Err) {
+	defer close(c.stopped)
+	for err == rpc.OK {
+		select {
+		case <-ch_wait:
+			ch_wait, err = c.refresh()
+		case <-c.done:
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// Stop keeping the cache up to date.
+func (c *ServiceCache) Close() {
+	close(c.done)
+}
+
+// Returns a channel that is closed once the cache stops being kept up to date, after Close or a session failure.
+func (c *ServiceCache) Done() <-chan struct{} {
+	return c.stopped
+}
+
+// Returns the Err from the session that stopped the cache, or rpc.OK if it is still up to date or was closed.
+// A cache that stopped keeps serving the instances it last knew of, which may be stale.
+func (c *ServiceCache) Err() rpc.Err {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Returns the live instances, in the order they registered.
+func (c *ServiceCache) Instances() []Instance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nodes := make([]rpc.Ppath, 0, len(c.instances))
+	for node := range c.instances {
+		nodes = append(nodes, node)
+	}
+	slices.SortFunc(nodes, func(a, b rpc.Ppath) int {
+		return a.GetSeqNumber() - b.GetSeqNumber()
+	})
+	instances := make([]Instance, len(nodes))
+	for i, node := range nodes {
+		instances[i] = c.instances[node]
+	}
+	return instances
+}
+
+// Returns an instance chosen by strategy, and false if there are none.
+func (c *ServiceCache) Pick(strategy Strategy) (Instance, bool) {
+	instances := c.Instances()
+	if len(instances) == 0 {
+		return Instance{}, false
+	}
+	return strategy.Pick(instances), true
+}
+
+// A way of spreading load over the instances of a service
+type Strategy interface {
+	// Returns one of instances, which is not empty
+	Pick(instances []Instance) Instance
+}
+
+// Picks an instance at random
+type Random struct{}
+
+func (Random) Pick(instances []Instance) Instance {
+	return instances[rand.N(len(instances))]
+}
+
+// Picks each instance in turn
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (r *RoundRobin) Pick(instances []Instance) Instance {
+	return instances[(r.next.Add(1)-1)%uint64(len(instances))]
+}
@@ -0,0 +1,193 @@
+package discovery
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+const (
+	NINSTANCES = 6
+	NSERVERS   = 5
+)
+
+// Collects the callbacks of a ServiceCache
+type events struct {
+	added   chan Instance
+	removed chan Instance
+}
+
+func makeEvents() *events {
+	return &events{added: make(chan Instance, NINSTANCES), removed: make(chan Instance, NINSTANCES)}
+}
+
+func (ev *events) onAdd(instance Instance)    { ev.added <- instance }
+func (ev *events) onRemove(instance Instance) { ev.removed <- instance }
+
+// Returns the ports of the next n instances on ch, or fails the test if they don't come.
+func expectPorts(t *testing.T, ch chan Instance, n int, what string) []int {
+	ports := make([]int, 0, n)
+	for range n {
+		select {
+		case instance := <-ch:
+			ports = append(ports, instance.Port)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Got %d %s instances; expected %d", len(ports), what, n)
+		}
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+func instancePorts(c *ServiceCache) []int {
+	var ports []int
+	for _, instance := range c.Instances() {
+		ports = append(ports, instance.Port)
+	}
+	return ports
+}
+
+// Instances that crash or unregister leave every client's view
+func TestDiscoveryClientCrashes(t *testing.T) {
+	ts := pan.MakeTest(t, "TestDiscoveryClientCrashes", NINSTANCES+1, NSERVERS, true, false, true, false, -1, false)
+	defer ts.Cleanup()
+
+	ev := makeEvents()
+	cache := MakeServiceCache(ts.MakeSession(), "echo", ev.onAdd, ev.onRemove)
+	defer cache.Close()
+
+	regs := make([]*Registration, NINSTANCES)
+	var all []int
+	for i := range NINSTANCES {
+		session := ts.MakeSession()
+		reg, err := Register(session, "echo", Instance{Host: "localhost", Port: 8000 + i, Payload: "v1"})
+		if err != rpc.OK {
+			t.Fatalf("Register returned %v", err)
+		}
+		regs[i] = reg
+		all = append(all, 8000+i)
+	}
+	if added := expectPorts(t, ev.added, NINSTANCES, "added"); !slices.Equal(added, all) {
+		t.Fatalf("Added instances %v; expected %v", added, all)
+	}
+	if ports := instancePorts(cache); !slices.Equal(ports, all) {
+		t.Fatalf("Cache holds %v; expected %v", ports, all)
+	}
+
+	// Crash the even instances, and unregister the first odd one
+	var gone []int
+	for i := 0; i < NINSTANCES; i += 2 {
+		ts.Crash(regs[i].session)
+		gone = append(gone, 8000+i)
+	}
+	if err := regs[1].Unregister(); err != rpc.OK {
+		t.Fatalf("Unregister returned %v", err)
+	}
+	gone = append(gone, 8001)
+	slices.Sort(gone)
+
+	if removed := expectPorts(t, ev.removed, len(gone), "removed"); !slices.Equal(removed, gone) {
+		t.Fatalf("Removed instances %v; expected %v", removed, gone)
+	}
+	var live []int
+	for _, port := range all {
+		if !slices.Contains(gone, port) {
+			live = append(live, port)
+		}
+	}
+	if ports := instancePorts(cache); !slices.Equal(ports, live) {
+		t.Fatalf("Cache holds %v; expected %v", ports, live)
+	}
+
+	// A new client sees only the live instances
+	fresh := MakeServiceCache(ts.MakeSession(), "echo", nil, nil)
+	defer fresh.Close()
+	if ports := instancePorts(fresh); !slices.Equal(ports, live) {
+		t.Fatalf("A new cache holds %v; expected %v", ports, live)
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	ts := pan.MakeTest(t, "TestStrategies", 2, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	ev := makeEvents()
+	cache := MakeServiceCache(ts.MakeSession(), "echo", ev.onAdd, nil)
+	defer cache.Close()
+	if _, ok := cache.Pick(Random{}); ok {
+		t.Fatal("Picked an instance of a service with none")
+	}
+
+	session := ts.MakeSession()
+	for i := range 3 {
+		if _, err := Register(session, "echo", Instance{Host: "localhost", Port: 8000 + i}); err != rpc.OK {
+			t.Fatalf("Register returned %v", err)
+		}
+	}
+	expectPorts(t, ev.added, 3, "added")
+
+	rr := &RoundRobin{}
+	for i := range 6 {
+		if instance, ok := cache.Pick(rr); !ok || instance.Port != 8000+i%3 {
+			t.Fatalf("Round robin picked %v, %v; expected port %d", instance, ok, 8000+i%3)
+		}
+	}
+	for range 10 {
+		if instance, ok := cache.Pick(Random{}); !ok || instance.Port < 8000 || instance.Port >= 8003 {
+			t.Fatalf("Random picked %v, %v", instance, ok)
+		}
+	}
+}
+
+// A session whose GetChildren fails once failed is set, as if the session had expired
+type failingSession struct {
+	panapi.IPNSession
+	failed atomic.Bool
+}
+
+func (s *failingSession) GetChildren(path rpc.Ppath, watch rpc.Watch) ([]rpc.Ppath, rpc.Err) {
+	if s.failed.Load() {
+		return nil, rpc.ErrSessionClosed
+	}
+	return s.IPNSession.GetChildren(path, watch)
+}
+
+// A cache whose session fails says so, and keeps the instances it last knew of
+func TestCacheSessionFailure(t *testing.T) {
+	ts := pan.MakeTest(t, "TestCacheSessionFailure", 2, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	session := &failingSession{IPNSession: ts.MakeSession()}
+	cache := MakeServiceCache(session, "echo", nil, nil)
+	defer cache.Close()
+	other := ts.MakeSession()
+	if _, err := Register(other, "echo", Instance{Host: "localhost", Port: 8000}); err != rpc.OK {
+		t.Fatalf("Register returned %v", err)
+	}
+	for start := time.Now(); len(cache.Instances()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Cache never saw the instance")
+		}
+	}
+
+	session.failed.Store(true)
+	if _, err := Register(other, "echo", Instance{Host: "localhost", Port: 8001}); err != rpc.OK {
+		t.Fatalf("Register returned %v", err)
+	}
+	select {
+	case <-cache.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Cache did not stop after its session failed")
+	}
+	if err := cache.Err(); err != rpc.ErrSessionClosed {
+		t.Fatalf("Err returned %v; expected %v", err, rpc.ErrSessionClosed)
+	}
+	if ports := instancePorts(cache); !slices.Equal(ports, []int{8000}) {
+		t.Fatalf("Stopped cache holds %v; expected [8000]", ports)
+	}
+}
@@ -0,0 +1,346 @@
+package election
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"pan/apps/recipe"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// Candidates queue for leadership by creating ephemeral sequential nodes in the election dir, holding their data. The
+// candidate with the smallest sequence number leads; every other candidate watches only the candidate just ahead of
+// it, so a leader leaving wakes its successor and no one else.
+//
+// A leader whose session expires loses its node, and with it its leadership. A leader that cannot reach the servers
+// never hears about that, so it steps down on its own once a lease of a third of the negotiated session timeout has
+// passed since it last started a check that confirmed its node still exists. The servers cannot expire the session
+// until a full session timeout after they last heard a keepalive, which was at most a third of the timeout before that
+// check, so the old leader has stopped leading before they can elect a successor.
+const nodePrefix = "n-"
+
+type Election struct {
+	session       panapi.IPNSession
+	dir           rpc.Ppath
+	leaseTimeout  time.Duration
+	checkInterval time.Duration
+
+	mu          sync.Mutex
+	currentFile rpc.Ppath     // our candidate node, or "" if not campaigning
+	done        chan struct{} // closed when our latest leadership ends; nil if we never led
+}
+
+func MakeElection(session panapi.IPNSession, dir rpc.Ppath) *Election {
+	leaseTimeout := session.SessionTimeout() / 3
+	e := &Election{session: session, dir: dir, leaseTimeout: leaseTimeout, checkInterval: leaseTimeout / 2}
+	return e
+}
+
+// Returns rpc.ErrTimeout if ctx's deadline passed, and rpc.ErrCanceled otherwise.
+func ctxErr(ctx context.Context) rpc.Err {
+	if ctx.Err() == context.DeadlineExceeded {
+		return rpc.ErrTimeout
+	}
+	return rpc.ErrCanceled
+}
+
+// Returns the candidate with the smallest sequence number, or "" if there is none.
+func (e *Election) first(children []rpc.Ppath) rpc.Ppath {
+	var node rpc.Ppath
+	for _, child := range children {
+		if node == "" || child.GetSeqNumber() < node.GetSeqNumber() {
+			node = child
+		}
+	}
+	if node == "" {
+		return ""
+	}
+	return e.dir + "/" + node
+}
+
+// Returns the candidate just ahead of node, or "" if node is first.
+func (e *Election) predecessor(children []rpc.Ppath, node rpc.Ppath) rpc.Ppath {
+	myNum := node.GetSeqNumber()
+	current := -1
+	var pred rpc.Ppath
+	for _, child := range children {
+		childNum := child.GetSeqNumber()
+		if childNum < myNum && childNum > current {
+			current = childNum
+			pred = child
+		}
+	}
+	if current == -1 {
+		return ""
+	}
+	return e.dir + "/" + pred
+}
+
+// Returns whether children holds node.
+func (e *Election) contains(children []rpc.Ppath, node rpc.Ppath) bool {
+	for _, child := range children {
+		if e.dir+"/"+child == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Stand for leader with data, which Leader and Observe report while we lead, and block until elected.
+// Gives up once ctx is done, withdrawing the candidacy, and returns rpc.ErrTimeout or rpc.ErrCanceled.
+func (e *Election) Campaign(ctx context.Context, data string) rpc.Err {
+	fname, err := recipe.CreateQueued(ctx, e.session, e.dir+"/"+nodePrefix, data)
+	if err != rpc.OK {
+		return err
+	}
+	e.mu.Lock()
+	e.currentFile = fname
+	e.mu.Unlock()
+
+	var watched rpc.Ppath // the predecessor our live watch is on, if any
+	ch_wait := make(chan struct{}, 1)
+	for {
+		children, err := e.session.GetChildrenCtx(ctx, e.dir, rpc.Watch{})
+		if err != rpc.OK {
+			e.withdraw()
+			return err
+		}
+		if !e.contains(children, fname) {
+			// Our session expired, or someone deleted our node
+			e.withdraw()
+			return rpc.ErrSessionClosed
+		}
+		pred := e.predecessor(children, fname)
+		if pred == "" {
+			e.lead(fname)
+			return rpc.OK
+		}
+
+		if pred != watched {
+			// Buffered so the callback never blocks after we give up
+			ch_wait = make(chan struct{}, 1)
+			c := ch_wait
+			exists, err := e.session.ExistsCtx(
+				ctx,
+				pred,
+				rpc.Watch{
+					ShouldWatch: true,
+					Callback: func(_ rpc.WatchArgs) {
+						c <- struct{}{}
+					},
+				},
+			)
+			if err != rpc.OK {
+				e.withdraw()
+				return err
+			}
+			if !exists {
+				continue
+			}
+			watched = pred
+		}
+
+		// Look again now and then, in case our own session expired while we waited
+		select {
+		case <-ch_wait:
+			watched = ""
+		case <-time.After(e.checkInterval):
+		case <-ctx.Done():
+			e.withdraw()
+			return ctxErr(ctx)
+		}
+	}
+}
+
+// Start leading as node, and watch for the leadership to end.
+func (e *Election) lead(node rpc.Ppath) {
+	e.mu.Lock()
+	done := make(chan struct{})
+	e.done = done
+	e.mu.Unlock()
+
+	go e.monitor(node, done)
+}
+
+// Step down once node is deleted, or once the lease has passed since the last check that confirmed it exists
+// started, unless the leadership ends first.
+func (e *Election) monitor(node rpc.Ppath, done chan struct{}) {
+	// Buffered so the callback never blocks after we stop
+	ch_deleted := make(chan struct{}, 1)
+	watch := rpc.Watch{
+		ShouldWatch: true,
+		Callback: func(_ rpc.WatchArgs) {
+			ch_deleted <- struct{}{}
+		},
+	}
+
+	confirmed := time.Now()
+	for {
+		start := time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), confirmed.Add(e.leaseTimeout))
+		exists, err := e.session.ExistsCtx(ctx, node, watch)
+		cancel()
+		if err != rpc.OK || !exists {
+			e.stepDown(done)
+			return
+		}
+		confirmed = start
+		// One watch is enough; later checks only confirm that we can still reach the servers
+		watch = rpc.Watch{}
+
+		select {
+		case <-done:
+			return
+		case <-ch_deleted:
+			e.stepDown(done)
+			return
+		case <-time.After(e.checkInterval):
+		}
+	}
+}
+
+// End the leadership that done belongs to, if it is still current. Our node may outlive a leadership we lost touch
+// with, so delete it in the background rather than hold up the other candidates until the session expires.
+func (e *Election) stepDown(done chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.done == done && !isClosed(done) {
+		close(done)
+		go e.session.Delete(e.currentFile, 1)
+		e.currentFile = ""
+	}
+}
+
+// Returns whether ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Give up our candidacy, deleting our node in the background.
+func (e *Election) withdraw() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	go e.session.Delete(e.currentFile, 1)
+	e.currentFile = ""
+}
+
+// Returns a channel that is closed once our latest leadership ends, whether by Resign, by our session expiring, or
+// by losing touch with the servers. Returns nil if we never led.
+func (e *Election) Done() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.done
+}
+
+// Give up the leadership, letting the next candidate take over.
+func (e *Election) Resign() {
+	e.mu.Lock()
+	node := e.currentFile
+	if e.done != nil && !isClosed(e.done) {
+		close(e.done)
+	}
+	e.currentFile = ""
+	e.mu.Unlock()
+
+	if node != "" {
+		e.session.Delete(node, 1)
+	}
+}
+
+// Returns the data of the current leader, and rpc.ErrNoFile if there is none.
+func (e *Election) Leader() (string, rpc.Err) {
+	children, err := e.session.GetChildren(e.dir, rpc.Watch{})
+	if err != rpc.OK {
+		return "", err
+	}
+	data, _, err := e.leader(context.Background(), children)
+	return data, err
+}
+
+// Returns the data and node of the leader among children, listing them again if the leader leaves meanwhile.
+// Gives up once ctx is done.
+func (e *Election) leader(ctx context.Context, children []rpc.Ppath) (string, rpc.Ppath, rpc.Err) {
+	for {
+		node := e.first(children)
+		if node == "" {
+			return "", "", rpc.ErrNoFile
+		}
+		data, _, err := e.session.GetDataCtx(ctx, node, rpc.Watch{})
+		if err != rpc.ErrNoFile {
+			return data, node, err
+		}
+		// The leader left since we listed the candidates
+		if children, err = e.session.GetChildrenCtx(ctx, e.dir, rpc.Watch{}); err != rpc.OK {
+			return "", "", err
+		}
+	}
+}
+
+// Returns a channel that receives the data of each new leader, starting with the current one, and "" whenever there
+// is no leader. The channel is closed once ctx is done or the session ends. Observers watch the candidate list, so
+// unlike candidates they all wake when anyone joins or leaves.
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+
+		// The candidate list can only be watched once the election dir exists
+		if _, err := e.session.CreateCtx(ctx, e.dir, "", rpc.Flag{}); err != rpc.OK && err != rpc.ErrOnCreate {
+			return
+		}
+
+		var last rpc.Ppath
+		first := true
+		for {
+			// Buffered so the callback never blocks after we stop
+			ch_change := make(chan struct{}, 1)
+			children, err := e.session.GetChildrenCtx(ctx, e.dir, rpc.Watch{
+				ShouldWatch: true,
+				Callback: func(_ rpc.WatchArgs) {
+					ch_change <- struct{}{}
+				},
+			})
+			if err != rpc.OK {
+				return
+			}
+			data, node, err := e.leader(ctx, children)
+			if err != rpc.OK && err != rpc.ErrNoFile {
+				return
+			}
+
+			if first || node != last {
+				select {
+				case ch <- data:
+				case <-ctx.Done():
+					return
+				}
+				first = false
+				last = node
+			}
+
+			for waiting := true; waiting; {
+				select {
+				case <-ch_change:
+					waiting = false
+				case <-time.After(e.checkInterval):
+					// Check that the session is still alive, without adding a watch
+					if _, err := e.session.ExistsCtx(ctx, e.dir, rpc.Watch{}); err != rpc.OK {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,233 @@
+package election
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi"
+	"pan/panapi/rpc"
+
+	tester "6.5840/tester1"
+)
+
+const (
+	NCLNT    = 10
+	NSERVERS = 5
+)
+
+// Campaign, lead for a while, then resign, end the session, or crash. leaders counts the clients that believe they
+// lead, which must never exceed one.
+func runElectionClient(i int, ch_err chan string, ch_done chan struct{}, clientCrash bool, leaders *atomic.Int32, ts *pan.Test) {
+	session := ts.MakeSession()
+	e := MakeElection(session, "/election")
+
+	if err := e.Campaign(context.Background(), strconv.Itoa(i)); err != rpc.OK {
+		ch_err <- "Campaign returned " + string(err)
+		return
+	}
+	if leaders.Add(1) != 1 {
+		ch_err <- "Two clients led at the same time"
+		return
+	}
+	session.Create("/tester/seq-", "", rpc.Flag{Sequential: true})
+
+	choice := rand.Int() % 5
+	if choice == 0 && clientCrash {
+		// The crashed client must step down by itself before anyone else is elected
+		ts.Crash(session)
+		<-e.Done()
+		leaders.Add(-1)
+	} else {
+		select {
+		case <-time.After(1 * time.Second):
+		case <-e.Done():
+		}
+		leaders.Add(-1)
+		if choice == 1 || choice == 2 {
+			session.EndSession()
+		} else {
+			e.Resign()
+		}
+	}
+
+	ch_done <- struct{}{}
+}
+
+func runClients(t *testing.T, title string, nclnts int, clientCrash bool, partitions bool) {
+	ts := pan.MakeTest(t, title, nclnts, NSERVERS, true, false, clientCrash, partitions, -1, false)
+	defer ts.Cleanup()
+
+	session := ts.MakeSession()
+	seqPath := rpc.Ppath("/tester/seq-")
+
+	var leaders atomic.Int32
+	ch_errs := make([]chan string, nclnts)
+	ch_dones := make([]chan struct{}, nclnts)
+	for i := range nclnts {
+		ch_dones[i] = make(chan struct{})
+		ch_errs[i] = make(chan string)
+		go runElectionClient(i, ch_errs[i], ch_dones[i], clientCrash, &leaders, ts)
+	}
+
+	ch_partitioner := make(chan bool)
+	if partitions {
+		go ts.Partitioner(tester.GRP0, ch_partitioner)
+	}
+
+	for i := range nclnts {
+		select {
+		case err := <-ch_errs[i]:
+			t.Fatal(err)
+		case <-ch_dones[i]:
+			continue
+		}
+	}
+
+	if partitions {
+		ch_partitioner <- true
+		<-ch_partitioner
+		ts.Group(tester.GRP0).ConnectAll()
+	}
+
+	// Every client led exactly once
+	name, _ := session.Create(seqPath, "", rpc.Flag{Sequential: true})
+	if name != seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)) {
+		ts.Fatalf("Should have created %s; instead created %s", seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)), name)
+	}
+}
+
+func TestOneClientNoErrors(t *testing.T) {
+	runClients(t, "TestOneClientNoErrors", 1, false, false)
+}
+
+func TestManyClientsNoErrors(t *testing.T) {
+	runClients(t, "TestManyClientsNoErrors", NCLNT, false, false)
+}
+
+func TestManyClientsClientCrashes(t *testing.T) {
+	runClients(t, "TestManyClientsClientCrashes", NCLNT, true, false)
+}
+
+func TestManyClientsPartitions(t *testing.T) {
+	runClients(t, "TestManyClientsPartitions", NCLNT, false, true)
+}
+
+func TestManyClientsClientCrashesAndPartitions(t *testing.T) {
+	runClients(t, "TestManyClientsClientCrashesAndPartitions", NCLNT, true, true)
+}
+
+// Observers see each new leader, and Leader reports it
+func TestObserve(t *testing.T) {
+	ts := pan.MakeTest(t, "TestObserve", 3, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := MakeElection(ts.MakeSession(), "/election").Observe(ctx)
+	expect := func(want string) {
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Fatalf("Observed leader %q; expected %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not observe leader %q", want)
+		}
+	}
+	expect("")
+
+	a := MakeElection(ts.MakeSession(), "/election")
+	b := MakeElection(ts.MakeSession(), "/election")
+	if err := a.Campaign(context.Background(), "a"); err != rpc.OK {
+		t.Fatalf("Campaign returned %v", err)
+	}
+	expect("a")
+
+	ch_b := make(chan rpc.Err)
+	go func() {
+		ch_b <- b.Campaign(context.Background(), "b")
+	}()
+	if leader, err := b.Leader(); err != rpc.OK || leader != "a" {
+		t.Fatalf("Leader returned %q, %v; expected %q", leader, err, "a")
+	}
+
+	a.Resign()
+	if err := <-ch_b; err != rpc.OK {
+		t.Fatalf("Campaign returned %v", err)
+	}
+	expect("b")
+
+	b.Resign()
+	expect("")
+	if _, err := a.Leader(); err != rpc.ErrNoFile {
+		t.Fatalf("Leader returned %v with no candidates; expected %v", err, rpc.ErrNoFile)
+	}
+}
+
+// A leader whose client crashes steps down before the next candidate is elected
+func TestCrashRevokesLeadership(t *testing.T) {
+	ts := pan.MakeTest(t, "TestCrashRevokesLeadership", 2, NSERVERS, true, false, true, false, -1, false)
+	defer ts.Cleanup()
+
+	session := ts.MakeSession()
+	a := MakeElection(session, "/election")
+	b := MakeElection(ts.MakeSession(), "/election")
+	if err := a.Campaign(context.Background(), "a"); err != rpc.OK {
+		t.Fatalf("Campaign returned %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := b.Campaign(ctx, "b"); err != rpc.ErrTimeout {
+		t.Fatalf("Campaign returned %v while another client led; expected %v", err, rpc.ErrTimeout)
+	}
+
+	ts.Crash(session)
+	if err := b.Campaign(context.Background(), "b"); err != rpc.OK {
+		t.Fatalf("Campaign returned %v", err)
+	}
+	select {
+	case <-a.Done():
+	default:
+		t.Fatal("A new leader was elected while the crashed leader still led")
+	}
+}
+
+// A session cut off from the servers: calls block until their ctx is done, and the dir already exists
+type partitionedSession struct {
+	panapi.IPNSession
+}
+
+func (s *partitionedSession) SessionTimeout() time.Duration {
+	return pan.DefaultSessionTimeout
+}
+
+func (s *partitionedSession) CreateCtx(ctx context.Context, path rpc.Ppath, data string, flags rpc.Flag) (rpc.Ppath, rpc.Err) {
+	return "", rpc.ErrOnCreate
+}
+
+func (s *partitionedSession) GetChildrenCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) ([]rpc.Ppath, rpc.Err) {
+	<-ctx.Done()
+	return nil, ctxErr(ctx)
+}
+
+// Observe's channel is closed once ctx is done, even while the servers can't be reached
+func TestObservePartitioned(t *testing.T) {
+	e := MakeElection(&partitionedSession{}, "/election")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ch := e.Observe(ctx)
+	select {
+	case data, ok := <-ch:
+		if ok {
+			t.Fatalf("Observe reported leader %q while partitioned", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Observe's channel was not closed once ctx was done")
+	}
+}
@@ -1,9 +1,11 @@
 package lock
 
 import (
+	"context"
+
+	"pan/apps/recipe"
 	"pan/panapi"
 	"pan/panapi/rpc"
-	"strconv"
 )
 
 type Clerk struct {
@@ -30,34 +32,50 @@ func isSmallestSequence(children []rpc.Ppath, candidate rpc.Ppath) bool {
 	return true
 }
 
-// Returns the name of the node that a client should be watching
+// Returns the name of the node that a client should be watching.
 func (ck *Clerk) watchNode(children []rpc.Ppath) rpc.Ppath {
 	myNum := ck.currentFile.GetSeqNumber()
 	current := -1
+	var node rpc.Ppath
 	for _, child := range children {
 		childNum := child.GetSeqNumber()
 		if childNum >= myNum {
 			continue
-		} else {
-			current = max(current, childNum)
+		} else if childNum > current {
+			current = childNum
+			node = child
 		}
 	}
-	return ck.lockDir + ck.lockSuffix + rpc.Ppath(strconv.Itoa(current))
+	return ck.lockDir + "/" + node
 }
 
 // Acquire the lock for the fs
 func (ck *Clerk) Acquire() {
-	lockPrefix := ck.lockDir + ck.lockSuffix
-	fname, _ := ck.session.Create(lockPrefix, "", rpc.Flag{Sequential: true, Ephemeral: true})
+	ck.TryAcquire(context.Background())
+}
+
+// Like Acquire, but gives up once ctx is done. Returns whether the Clerk holds the lock.
+// A Clerk that gives up deletes its lock node in the background, so it doesn't hold up the clients queued behind it.
+func (ck *Clerk) TryAcquire(ctx context.Context) bool {
+	fname, err := recipe.CreateQueued(ctx, ck.session, ck.lockDir+ck.lockSuffix, "")
+	if err != rpc.OK {
+		return false
+	}
 	ck.currentFile = fname
 	for {
-		children, _ := ck.session.GetChildren(ck.lockDir, rpc.Watch{})
+		children, err := ck.session.GetChildrenCtx(ctx, ck.lockDir, rpc.Watch{})
+		if err != rpc.OK {
+			ck.abandon()
+			return false
+		}
 		if isSmallestSequence(children, ck.currentFile) {
-			return
+			return true
 		}
 		nodeToWatch := ck.watchNode(children)
-		ch_wait := make(chan struct{})
-		exists, _ := ck.session.Exists(
+		// Buffered so the callback never blocks after we give up
+		ch_wait := make(chan struct{}, 1)
+		exists, err := ck.session.ExistsCtx(
+			ctx,
 			nodeToWatch,
 			rpc.Watch{
 				ShouldWatch: true,
@@ -66,13 +84,28 @@ func (ck *Clerk) Acquire() {
 				},
 			},
 		)
+		if err != rpc.OK {
+			ck.abandon()
+			return false
+		}
 		if exists {
-			<-ch_wait
+			select {
+			case <-ch_wait:
+			case <-ctx.Done():
+				ck.abandon()
+				return false
+			}
 		}
 
 	}
 }
 
+// Give up our place in the queue for the lock.
+func (ck *Clerk) abandon() {
+	go ck.session.Delete(ck.currentFile, 1)
+	ck.currentFile = ""
+}
+
 // Release the lock for the fs
 func (ck *Clerk) Release() {
 	ck.session.Delete(ck.currentFile, 1)
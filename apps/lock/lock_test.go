@@ -1,15 +1,13 @@
 package lock
 
 import (
-	"fmt"
+	"context"
 	"math/rand"
 	"testing"
 	"time"
 
 	"pan/pan"
 	"pan/panapi/rpc"
-
-	tester "6.5840/tester1"
 )
 
 const (
@@ -69,24 +67,7 @@ func runClients(t *testing.T, title string, nclnts int, clientCrash bool, leader
 	}
 
 	if leaderCrash {
-		go func() {
-			for {
-				select {
-				case <-ch_crash:
-					return
-				default:
-					for i := 0; i < NSERVERS; i++ {
-						ts.Group(tester.GRP0).ShutdownServer(i)
-					}
-					time.Sleep(time.Second)
-					for i := 0; i < NSERVERS; i++ {
-						ts.Group(tester.GRP0).StartServer(i)
-					}
-					ts.Group(tester.GRP0).ConnectAll()
-					time.Sleep(time.Second * 4)
-				}
-			}
-		}()
+		go ts.CrashAllLoop(ch_crash, 4*time.Second)
 	}
 
 	for i := range nclnts {
@@ -103,8 +84,8 @@ func runClients(t *testing.T, title string, nclnts int, clientCrash bool, leader
 	}
 
 	name, _ := session.Create(seqPath, "", rpc.Flag{Sequential: true})
-	if name != rpc.Ppath(fmt.Sprintf("%s%d", seqPath, nclnts)) {
-		ts.Fatalf("Should have created %s; instead created %s", fmt.Sprintf("%s%d", seqPath, nclnts), name)
+	if name != seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)) {
+		ts.Fatalf("Should have created %s; instead created %s", seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)), name)
 	}
 }
 
@@ -139,3 +120,26 @@ func TestOneClientBothClientAndLeaderCrash(t *testing.T) {
 func TestManyClientsBothClientAndLeaderCrash(t *testing.T) {
 	runClients(t, "TestManyClientsBothClientAndLeaderCrash", NCLNT, true, true)
 }
+
+// A Clerk waiting behind a held lock gives up at its deadline, and gets the lock once it is released
+func TestTryAcquire(t *testing.T) {
+	ts := pan.MakeTest(t, "TestTryAcquire", 2, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	holder := MakeClerk(ts.MakeSession(), "/lock", "/l-")
+	waiter := MakeClerk(ts.MakeSession(), "/lock", "/l-")
+	holder.Acquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if waiter.TryAcquire(ctx) {
+		t.Fatal("Acquired a lock that another client holds")
+	}
+
+	holder.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !waiter.TryAcquire(ctx) {
+		t.Fatal("Did not acquire a released lock")
+	}
+}
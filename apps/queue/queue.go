@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// Each item is a persistent sequential node in the queue dir, holding the item's data. A consumer claims an item by
+// deleting its node with the version it read, so exactly one consumer gets it.
+//
+// Neither half may be retried blindly. A producer whose create got no reply cannot tell whether the item was added, so
+// items are created in protected mode, which lets the Session find the node it already created instead of adding the
+// item twice. A consumer whose delete got no reply, and that then finds the node gone, cannot tell whether it or
+// another consumer took it, so items are claimed with DeleteAsync, whose batches the servers apply at most once and
+// answer retries of from the original replies.
+//
+// A FIFO item is named itemPrefix followed by its sequence number; an item with priority p is named itemPrefix + p +
+// "-" followed by its sequence number. The queue dir numbers every item in one sequence, so items of each priority are
+// taken in the order they were offered.
+const itemPrefix = "item-"
+
+// Returned by PriorityQueue.Offer for a negative priority
+const ErrBadPriority rpc.Err = "ErrBadPriority"
+
+type Queue struct {
+	session panapi.IPNSession
+	dir     rpc.Ppath
+}
+
+func MakeQueue(session panapi.IPNSession, dir rpc.Ppath) *Queue {
+	q := &Queue{session: session, dir: dir}
+	return q
+}
+
+// Add an item with data to the back of the queue.
+func (q *Queue) Offer(data string) rpc.Err {
+	return q.offer(data, itemPrefix)
+}
+
+func (q *Queue) offer(data string, name string) rpc.Err {
+	_, err := q.session.Create(q.dir+"/"+rpc.Ppath(name), data, rpc.Flag{Sequential: true, Protected: true})
+	return err
+}
+
+// An item in the queue, in the order items are taken
+type item struct {
+	node     rpc.Ppath
+	priority int
+	seq      int
+}
+
+// Returns the items among children, in the order they should be taken.
+// offer creates items protected, so their names carry a GUID ahead of itemPrefix.
+func (q *Queue) items(children []rpc.Ppath) []item {
+	var items []item
+	for _, child := range children {
+		name := string(child)
+		i := strings.LastIndex(name, itemPrefix)
+		if i == -1 {
+			continue
+		}
+		it := item{node: q.dir + "/" + child, seq: child.GetSeqNumber()}
+		if before, _, found := strings.Cut(name[i+len(itemPrefix):], "-"); found {
+			priority, err := strconv.Atoi(before)
+			if err != nil {
+				continue
+			}
+			it.priority = priority
+		}
+		items = append(items, it)
+	}
+	slices.SortFunc(items, func(a, b item) int {
+		if a.priority != b.priority {
+			return a.priority - b.priority
+		}
+		return a.seq - b.seq
+	})
+	return items
+}
+
+// Returns rpc.ErrTimeout if ctx's deadline passed, and rpc.ErrCanceled otherwise.
+func ctxErr(ctx context.Context) rpc.Err {
+	if ctx.Err() == context.DeadlineExceeded {
+		return rpc.ErrTimeout
+	}
+	return rpc.ErrCanceled
+}
+
+// Claim the first item among children that no other consumer claims first, giving up once ctx is done.
+// Returns its data, or rpc.ErrNoFile if every item was taken. A claim that gives up while its delete is in flight may
+// still take the item, which is then lost.
+func (q *Queue) claim(ctx context.Context, children []rpc.Ppath) (string, rpc.Err) {
+	for _, it := range q.items(children) {
+		data, version, err := q.session.GetDataCtx(ctx, it.node, rpc.Watch{})
+		if err == rpc.ErrNoFile {
+			// Taken since we listed the queue
+			continue
+		} else if err != rpc.OK {
+			return "", err
+		}
+		deleted := q.session.DeleteAsync(it.node, version)
+		select {
+		case <-deleted.Done():
+		case <-ctx.Done():
+			return "", ctxErr(ctx)
+		}
+		if _, err := deleted.Wait(); err == rpc.OK {
+			return data, rpc.OK
+		} else if err != rpc.ErrNoFile && err != rpc.ErrVersion {
+			return "", err
+		}
+	}
+	return "", rpc.ErrNoFile
+}
+
+// Remove the item at the front of the queue and return its data, or rpc.ErrNoFile if the queue is empty.
+func (q *Queue) Poll() (string, rpc.Err) {
+	children, err := q.session.GetChildren(q.dir, rpc.Watch{})
+	if err != rpc.OK {
+		return "", err
+	}
+	return q.claim(context.Background(), children)
+}
+
+// Like Poll, but blocks until there is an item to take.
+func (q *Queue) Take() (string, rpc.Err) {
+	return q.TryTake(context.Background())
+}
+
+// Like Take, but gives up once ctx is done, returning rpc.ErrTimeout or rpc.ErrCanceled. Like every call that gives up,
+// it may have taken an item nonetheless, which is then lost.
+func (q *Queue) TryTake(ctx context.Context) (string, rpc.Err) {
+	for {
+		// Buffered so the callback never blocks after we give up
+		ch_wait := make(chan struct{}, 1)
+		children, err := q.session.GetChildrenCtx(
+			ctx,
+			q.dir,
+			rpc.Watch{
+				ShouldWatch: true,
+				Callback: func(_ rpc.WatchArgs) {
+					ch_wait <- struct{}{}
+				},
+			},
+		)
+		if err == rpc.ErrNoFile {
+			// Make the dir, so we can watch for the first item
+			if _, err := q.session.CreateCtx(ctx, q.dir, "", rpc.Flag{}); err != rpc.OK && err != rpc.ErrOnCreate {
+				return "", err
+			}
+			continue
+		} else if err != rpc.OK {
+			return "", err
+		}
+
+		if data, err := q.claim(ctx, children); err != rpc.ErrNoFile {
+			return data, err
+		}
+
+		select {
+		case <-ch_wait:
+		case <-ctx.Done():
+			return "", ctxErr(ctx)
+		}
+	}
+}
+
+// A queue whose items are taken in order of priority, lowest first, and in the order they were offered within a
+// priority.
+type PriorityQueue struct {
+	Queue
+}
+
+func MakePriorityQueue(session panapi.IPNSession, dir rpc.Ppath) *PriorityQueue {
+	q := &PriorityQueue{Queue{session: session, dir: dir}}
+	return q
+}
+
+// Add an item with data and priority behind the items of the same priority. Returns ErrBadPriority if priority is
+// negative.
+func (q *PriorityQueue) Offer(data string, priority int) rpc.Err {
+	if priority < 0 {
+		return ErrBadPriority
+	}
+	return q.offer(data, fmt.Sprintf("%s%d-", itemPrefix, priority))
+}
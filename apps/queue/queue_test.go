@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+const (
+	NPRODUCERS = 3
+	NCONSUMERS = 3
+	NITEMS     = 30 // per producer
+	NSERVERS   = 5
+)
+
+// Producers offer distinct items while consumers take them; every item must be delivered exactly once
+func runQueueClients(t *testing.T, title string, leaderCrash bool) {
+	ts := pan.MakeTest(t, title, NPRODUCERS+NCONSUMERS+1, NSERVERS, true, leaderCrash, false, false, -1, false)
+	defer ts.Cleanup()
+
+	var clients []func() string
+	for p := range NPRODUCERS {
+		clients = append(clients, func() string {
+			q := MakeQueue(ts.MakeSession(), "/queue")
+			for i := range NITEMS {
+				if err := q.Offer(strconv.Itoa(p*NITEMS + i)); err != rpc.OK {
+					return "Offer returned " + string(err)
+				}
+			}
+			return ""
+		})
+	}
+
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for range NCONSUMERS {
+		clients = append(clients, func() string {
+			q := MakeQueue(ts.MakeSession(), "/queue")
+			for {
+				data, err := q.TryTake(ctx)
+				if err == rpc.ErrCanceled {
+					return ""
+				} else if err != rpc.OK {
+					return "Take returned " + string(err)
+				}
+				mu.Lock()
+				delivered[data]++
+				n := len(delivered)
+				mu.Unlock()
+				if n == NPRODUCERS*NITEMS {
+					cancel()
+				}
+			}
+		})
+	}
+	ts.RunClients(clients...)
+
+	for i := range NPRODUCERS * NITEMS {
+		if n := delivered[strconv.Itoa(i)]; n != 1 {
+			t.Fatalf("Item %d was delivered %d times", i, n)
+		}
+	}
+	if data, err := MakeQueue(ts.MakeSession(), "/queue").Poll(); err != rpc.ErrNoFile {
+		t.Fatalf("Poll returned %q, %v from a drained queue; expected %v", data, err, rpc.ErrNoFile)
+	}
+}
+
+func TestQueueNoErrors(t *testing.T) {
+	runQueueClients(t, "TestQueueNoErrors", false)
+}
+
+func TestQueueLeaderCrashes(t *testing.T) {
+	runQueueClients(t, "TestQueueLeaderCrashes", true)
+}
+
+// Items are taken lowest priority first, and in the order they were offered within a priority
+func TestPriorityQueue(t *testing.T) {
+	ts := pan.MakeTest(t, "TestPriorityQueue", 1, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	q := MakePriorityQueue(ts.MakeSession(), "/queue")
+	if _, err := q.Poll(); err != rpc.ErrNoFile {
+		t.Fatalf("Poll returned %v from an empty queue; expected %v", err, rpc.ErrNoFile)
+	}
+	for _, it := range []struct {
+		data     string
+		priority int
+	}{{"c1", 10}, {"a1", 0}, {"b1", 2}, {"c2", 10}, {"a2", 0}, {"b2", 2}} {
+		if err := q.Offer(it.data, it.priority); err != rpc.OK {
+			t.Fatalf("Offer returned %v", err)
+		}
+	}
+	for _, want := range []string{"a1", "a2", "b1", "b2", "c1", "c2"} {
+		if data, err := q.Take(); err != rpc.OK || data != want {
+			t.Fatalf("Take returned %q, %v; expected %q", data, err, want)
+		}
+	}
+	if err := q.Offer("x", -1); err != ErrBadPriority {
+		t.Fatalf("Offer returned %v for a negative priority; expected %v", err, ErrBadPriority)
+	}
+}
+
+// A session that lists one item, but whose reads block until their ctx is done, as if cut off from the servers
+type partitionedSession struct {
+	panapi.IPNSession
+}
+
+func (s *partitionedSession) GetChildrenCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) ([]rpc.Ppath, rpc.Err) {
+	return []rpc.Ppath{itemPrefix + rpc.Ppath(rpc.SeqSuffix(0))}, rpc.OK
+}
+
+func (s *partitionedSession) GetDataCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) (string, rpc.Pversion, rpc.Err) {
+	<-ctx.Done()
+	return "", 0, ctxErr(ctx)
+}
+
+// TryTake gives up at its deadline even while claiming an item
+func TestTryTakePartitioned(t *testing.T) {
+	q := MakeQueue(&partitionedSession{}, "/queue")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ch := make(chan rpc.Err)
+	go func() {
+		_, err := q.TryTake(ctx)
+		ch <- err
+	}()
+	select {
+	case err := <-ch:
+		if err != rpc.ErrTimeout {
+			t.Fatalf("TryTake returned %v; expected %v", err, rpc.ErrTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TryTake blocked past its deadline")
+	}
+}
@@ -0,0 +1,29 @@
+package recipe
+
+import (
+	"context"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// The recipes in apps queue their clients by creating ephemeral sequential nodes with CreateQueued. Those nodes are
+// protected, so their names carry a GUID ahead of the prefix asked for; recipes take node names from the children
+// lists they read, rather than rebuilding them from sequence numbers.
+
+// Create an ephemeral sequential node at prefix holding data, giving up once ctx is done. Returns the node's name.
+// A create that gives up may still have taken effect, leaving a node nobody knows about to hold up the clients queued
+// behind it until the session ends. So the node is created protected with a GUID chosen here, and when the create
+// fails it is finished in the background, which the servers answer with the existing node, and that node is deleted.
+func CreateQueued(ctx context.Context, session panapi.IPNSession, prefix rpc.Ppath, data string) (rpc.Ppath, rpc.Err) {
+	flags := rpc.Flag{Sequential: true, Ephemeral: true, Protected: true, Guid: rpc.NewGuid()}
+	fname, err := session.CreateCtx(ctx, prefix, data, flags)
+	if err != rpc.OK {
+		go func() {
+			if fname, err := session.Create(prefix, data, flags); err == rpc.OK {
+				session.Delete(fname, 1)
+			}
+		}()
+	}
+	return fname, err
+}
@@ -0,0 +1,44 @@
+package recipe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+const NSERVERS = 3
+
+// A session whose creates take effect, but whose replies are lost as if ctx ran out first
+type timeoutSession struct {
+	panapi.IPNSession
+}
+
+func (s *timeoutSession) CreateCtx(ctx context.Context, path rpc.Ppath, data string, flags rpc.Flag) (rpc.Ppath, rpc.Err) {
+	s.IPNSession.CreateCtx(ctx, path, data, flags)
+	return "", rpc.ErrTimeout
+}
+
+// A node whose create timed out after taking effect does not outlive the call for long
+func TestCreateQueuedTimeout(t *testing.T) {
+	ts := pan.MakeTest(t, "TestCreateQueuedTimeout", 1, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	session := ts.MakeSession()
+	session.Create("/queue", "", rpc.Flag{})
+	if _, err := CreateQueued(context.Background(), &timeoutSession{session}, "/queue/n-", ""); err != rpc.ErrTimeout {
+		t.Fatalf("CreateQueued returned %v; expected %v", err, rpc.ErrTimeout)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		children, err := session.GetChildren("/queue", rpc.Watch{})
+		if err == rpc.OK && len(children) == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Queue still holds %v after the create timed out", children)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package rwlock
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"pan/apps/recipe"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// Readers and writers queue for the lock by creating ephemeral sequential nodes in the lock dir, named readPrefix and
+// writePrefix. The lock dir hands out one sequence of numbers across both names, so they queue in a single order. A
+// reader only waits for the closest writer ahead of it, so readers share the lock; a writer waits for the closest node
+// of any kind ahead of it.
+const (
+	readPrefix  = "read-"
+	writePrefix = "write-"
+)
+
+type Clerk struct {
+	session     panapi.IPNSession
+	lockDir     rpc.Ppath
+	currentFile rpc.Ppath
+}
+
+func MakeClerk(session panapi.IPNSession, lockDir rpc.Ppath) *Clerk {
+	ck := &Clerk{session: session, lockDir: lockDir}
+	return ck
+}
+
+// Returns the children with a smaller sequence number than ours, closest first.
+func (ck *Clerk) ahead(children []rpc.Ppath) []rpc.Ppath {
+	myNum := ck.currentFile.GetSeqNumber()
+	var nodes []rpc.Ppath
+	for _, child := range children {
+		if child.GetSeqNumber() < myNum {
+			nodes = append(nodes, ck.lockDir+"/"+child)
+		}
+	}
+	slices.SortFunc(nodes, func(a, b rpc.Ppath) int {
+		return b.GetSeqNumber() - a.GetSeqNumber()
+	})
+	return nodes
+}
+
+// Returns whether node was queued by a writer.
+func isWriter(node rpc.Ppath) bool {
+	return strings.HasSuffix(strings.TrimRight(string(node), "0123456789"), writePrefix)
+}
+
+// Returns the node a reader should be watching: the closest writer ahead of it, or "" if there is none.
+func (ck *Clerk) readerWatchNode(children []rpc.Ppath) rpc.Ppath {
+	for _, node := range ck.ahead(children) {
+		if isWriter(node) {
+			return node
+		}
+	}
+	return ""
+}
+
+// Returns the node a writer should be watching: the closest node ahead of it, or "" if there is none.
+func (ck *Clerk) writerWatchNode(children []rpc.Ppath) rpc.Ppath {
+	nodes := ck.ahead(children)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+// Acquire the lock shared with other readers
+func (ck *Clerk) AcquireRead() {
+	ck.TryAcquireRead(context.Background())
+}
+
+// Like AcquireRead, but gives up once ctx is done. Returns whether the Clerk holds the lock.
+func (ck *Clerk) TryAcquireRead(ctx context.Context) bool {
+	return ck.acquire(ctx, readPrefix, ck.readerWatchNode)
+}
+
+// Acquire the lock exclusively
+func (ck *Clerk) AcquireWrite() {
+	ck.TryAcquireWrite(context.Background())
+}
+
+// Like AcquireWrite, but gives up once ctx is done. Returns whether the Clerk holds the lock.
+func (ck *Clerk) TryAcquireWrite(ctx context.Context) bool {
+	return ck.acquire(ctx, writePrefix, ck.writerWatchNode)
+}
+
+// Queue for the lock with a node named prefix, and wait until watchNode finds nothing ahead of us to wait for, like
+// lock.Clerk.TryAcquire. Each wait watches a single node, so a release wakes one waiter, not all of them.
+func (ck *Clerk) acquire(ctx context.Context, prefix string, watchNode func([]rpc.Ppath) rpc.Ppath) bool {
+	fname, err := recipe.CreateQueued(ctx, ck.session, ck.lockDir+"/"+rpc.Ppath(prefix), "")
+	if err != rpc.OK {
+		return false
+	}
+	ck.currentFile = fname
+	for {
+		children, err := ck.session.GetChildrenCtx(ctx, ck.lockDir, rpc.Watch{})
+		if err != rpc.OK {
+			ck.abandon()
+			return false
+		}
+		nodeToWatch := watchNode(children)
+		if nodeToWatch == "" {
+			return true
+		}
+		// Buffered so the callback never blocks after we give up
+		ch_wait := make(chan struct{}, 1)
+		exists, err := ck.session.ExistsCtx(
+			ctx,
+			nodeToWatch,
+			rpc.Watch{
+				ShouldWatch: true,
+				Callback: func(_ rpc.WatchArgs) {
+					ch_wait <- struct{}{}
+				},
+			},
+		)
+		if err != rpc.OK {
+			ck.abandon()
+			return false
+		}
+		if exists {
+			select {
+			case <-ch_wait:
+			case <-ctx.Done():
+				ck.abandon()
+				return false
+			}
+		}
+	}
+}
+
+// Give up our place in the queue for the lock.
+func (ck *Clerk) abandon() {
+	go ck.session.Delete(ck.currentFile, 1)
+	ck.currentFile = ""
+}
+
+// Release the lock, whether held for reading or writing
+func (ck *Clerk) Release() {
+	ck.session.Delete(ck.currentFile, 1)
+	ck.currentFile = ""
+}
@@ -0,0 +1,176 @@
+package rwlock
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi/rpc"
+)
+
+const (
+	NCLNT    = 10
+	NSEC     = 1
+	NSERVERS = 5
+)
+
+// While a client holds the lock, it keeps an ephemeral marker under /tester: "/tester/writer" for the writer, and a
+// sequential node under "/tester/readers" for each reader.
+func runRWLockClient(i int, ch_err chan string, ch_done chan struct{}, clientCrash bool, ts *pan.Test) {
+	path := rpc.Ppath("/tester")
+
+	session := ts.MakeSession()
+	ck := MakeClerk(session, "/lock")
+
+	writer := i%3 == 0
+	var marker rpc.Ppath
+	if writer {
+		ck.AcquireWrite()
+		readers, err := session.GetChildren(path+"/readers", rpc.Watch{})
+		if err == rpc.OK && len(readers) != 0 {
+			ch_err <- "A writer acquired the lock while readers held it"
+			return
+		}
+		marker = path + "/writer"
+		if _, err := session.Create(marker, "", rpc.Flag{Ephemeral: true}); err == rpc.ErrOnCreate {
+			ch_err <- "Two writers acquired the lock at the same time"
+			return
+		}
+	} else {
+		ck.AcquireRead()
+		if exists, _ := session.Exists(path+"/writer", rpc.Watch{}); exists {
+			ch_err <- "A reader acquired the lock while a writer held it"
+			return
+		}
+		marker, _ = session.Create(path+"/readers/r-", "", rpc.Flag{Ephemeral: true, Sequential: true})
+	}
+	session.Create(path+"/seq-", "", rpc.Flag{Sequential: true})
+
+	choice := rand.Int() % 5
+	if choice == 0 && clientCrash {
+		ts.Crash(session)
+	} else if choice == 1 || choice == 2 {
+		time.Sleep(1 * time.Second)
+		session.EndSession()
+	} else {
+		time.Sleep(1 * time.Second)
+		session.Delete(marker, 1)
+		ck.Release()
+	}
+
+	ch_done <- struct{}{}
+}
+
+func runClients(t *testing.T, title string, nclnts int, clientCrash bool, leaderCrash bool) {
+	ts := pan.MakeTest(t, title, nclnts, NSERVERS, true, leaderCrash, clientCrash, false, -1, false)
+	defer ts.Cleanup()
+
+	session := ts.MakeSession()
+	seqPath := rpc.Ppath("/tester/seq-")
+
+	ch_errs := make([]chan string, nclnts)
+	ch_dones := make([]chan struct{}, nclnts)
+	ch_crash := make(chan struct{})
+	for i := range nclnts {
+		ch_dones[i] = make(chan struct{})
+		ch_errs[i] = make(chan string)
+		go runRWLockClient(i, ch_errs[i], ch_dones[i], clientCrash, ts)
+	}
+
+	if leaderCrash {
+		go ts.CrashAllLoop(ch_crash, 4*time.Second)
+	}
+
+	for i := range nclnts {
+		select {
+		case err := <-ch_errs[i]:
+			t.Fatal(err)
+		case <-ch_dones[i]:
+			continue
+		}
+	}
+
+	if leaderCrash {
+		ch_crash <- struct{}{}
+	}
+
+	name, _ := session.Create(seqPath, "", rpc.Flag{Sequential: true})
+	if name != seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)) {
+		ts.Fatalf("Should have created %s; instead created %s", seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)), name)
+	}
+}
+
+func TestOneClientNoErrors(t *testing.T) {
+	runClients(t, "TestOneClientNoErrors", 1, false, false)
+}
+
+func TestManyClientsNoErrors(t *testing.T) {
+	runClients(t, "TestManyClientsNoErrors", NCLNT, false, false)
+}
+
+func TestManyClientsJustClientCrashes(t *testing.T) {
+	runClients(t, "TestManyClientsJustClientCrashes", NCLNT, true, false)
+}
+
+func TestManyClientsJustLeaderCrash(t *testing.T) {
+	runClients(t, "TestManyClientsJustLeaderCrash", NCLNT, false, true)
+}
+
+func TestManyClientsBothClientAndLeaderCrash(t *testing.T) {
+	runClients(t, "TestManyClientsBothClientAndLeaderCrash", NCLNT, true, true)
+}
+
+// Readers share the lock, a writer waits for them, and a reader that arrives after a waiting writer waits behind it
+func TestReadersShare(t *testing.T) {
+	ts := pan.MakeTest(t, "TestReadersShare", 4, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	r1 := MakeClerk(ts.MakeSession(), "/lock")
+	r2 := MakeClerk(ts.MakeSession(), "/lock")
+	w := MakeClerk(ts.MakeSession(), "/lock")
+	r3 := MakeClerk(ts.MakeSession(), "/lock")
+
+	r1.AcquireRead()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !r2.TryAcquireRead(ctx) {
+		t.Fatal("A reader did not share the lock with another reader")
+	}
+
+	ch_w := make(chan bool)
+	go func() {
+		ch_w <- w.TryAcquireWrite(context.Background())
+	}()
+	select {
+	case <-ch_w:
+		t.Fatal("A writer acquired the lock while readers held it")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// The writer is queued now, so a new reader must wait for it
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if r3.TryAcquireRead(ctx) {
+		t.Fatal("A reader overtook a waiting writer")
+	}
+
+	r1.Release()
+	r2.Release()
+	select {
+	case ok := <-ch_w:
+		if !ok {
+			t.Fatal("The writer did not acquire the lock")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The writer did not acquire the released lock")
+	}
+
+	w.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !r3.TryAcquireRead(ctx) {
+		t.Fatal("Did not acquire a released lock")
+	}
+}
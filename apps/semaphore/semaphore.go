@@ -0,0 +1,204 @@
+package semaphore
+
+import (
+	"context"
+	"slices"
+	"strconv"
+
+	"pan/apps/recipe"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// Holders queue for leases by creating an ephemeral sequential node in the leases dir, holding how many leases they
+// want. A node is admitted once its count and the counts of every node ahead of it add up to no more than the max,
+// which lives in its own znode so that it can be changed while the semaphore is in use. Admission is in order, so a
+// large request is not starved by small ones that arrive after it.
+//
+// Waiters watch the leases list and the max, since a release or a raise may each let them in. A holder that crashes
+// gives up its leases when its session expires.
+const (
+	leasesName = "leases"
+	maxName    = "max"
+	nodePrefix = "lease-"
+)
+
+// Returned when the max or a lease node holds something other than a count: a whole number, positive for a lease node
+const ErrBadCount rpc.Err = "ErrBadCount"
+
+type Semaphore struct {
+	session     panapi.IPNSession
+	dir         rpc.Ppath
+	currentFile rpc.Ppath
+	counts      map[rpc.Ppath]int // lease counts of the nodes ahead of ours, which never change
+}
+
+// Makes a semaphore with max leases in dir, unless dir already holds a semaphore, whose max is kept. max must not be
+// negative.
+func MakeSemaphore(session panapi.IPNSession, dir rpc.Ppath, max int) *Semaphore {
+	s := &Semaphore{session: session, dir: dir}
+	session.Create(dir+"/"+maxName, strconv.Itoa(max), rpc.Flag{})
+	return s
+}
+
+// Parses a count of at least least, returning ErrBadCount if data holds anything else.
+func parseCount(data string, least int) (int, rpc.Err) {
+	count, err := strconv.Atoi(data)
+	if err != nil || count < least {
+		return 0, ErrBadCount
+	}
+	return count, rpc.OK
+}
+
+// Returns the number of leases that may be held at once.
+func (s *Semaphore) Max() (int, rpc.Err) {
+	data, _, err := s.session.GetData(s.dir+"/"+maxName, rpc.Watch{})
+	if err != rpc.OK {
+		return 0, err
+	}
+	return parseCount(data, 0)
+}
+
+// Change the number of leases that may be held at once. Lowering it takes no leases away from their holders; new
+// holders are admitted once enough leases are released. Returns ErrBadCount if max is negative.
+func (s *Semaphore) SetMax(max int) rpc.Err {
+	if max < 0 {
+		return ErrBadCount
+	}
+	path := s.dir + "/" + maxName
+	for {
+		_, version, err := s.session.GetData(path, rpc.Watch{})
+		if err == rpc.ErrNoFile {
+			if _, err = s.session.Create(path, strconv.Itoa(max), rpc.Flag{}); err != rpc.ErrOnCreate {
+				return err
+			}
+			continue
+		} else if err != rpc.OK {
+			return err
+		}
+		if err = s.session.SetData(path, strconv.Itoa(max), version); err != rpc.ErrVersion {
+			return err
+		}
+		// Changed since we read it; try again
+	}
+}
+
+// Returns whether our node is admitted: whether the lease counts of the nodes up to and including ours fit in max.
+func (s *Semaphore) admitted(ctx context.Context, children []rpc.Ppath, max int) (bool, rpc.Err) {
+	myNum := s.currentFile.GetSeqNumber()
+	var ahead []rpc.Ppath
+	for _, child := range children {
+		if child.GetSeqNumber() <= myNum {
+			ahead = append(ahead, s.dir+"/"+leasesName+"/"+child)
+		}
+	}
+	slices.SortFunc(ahead, func(a, b rpc.Ppath) int {
+		return a.GetSeqNumber() - b.GetSeqNumber()
+	})
+
+	total := 0
+	for _, node := range ahead {
+		count, ok := s.counts[node]
+		if !ok {
+			data, _, err := s.session.GetDataCtx(ctx, node, rpc.Watch{})
+			if err == rpc.ErrNoFile {
+				// Released since we listed the leases
+				continue
+			} else if err != rpc.OK {
+				return false, err
+			}
+			if count, err = parseCount(data, 1); err != rpc.OK {
+				return false, err
+			}
+			s.counts[node] = count
+		}
+		total += count
+		if total > max {
+			return false, rpc.OK
+		}
+	}
+	return true, rpc.OK
+}
+
+// Returns a watch that signals a new *ch if *ch is nil, meaning no watch of ours on that node is pending, and otherwise
+// no watch. The channel is buffered so the callback never blocks after we give up.
+func arm(ch *chan struct{}) rpc.Watch {
+	if *ch != nil {
+		return rpc.Watch{}
+	}
+	c := make(chan struct{}, 1)
+	*ch = c
+	return rpc.Watch{
+		ShouldWatch: true,
+		Callback: func(_ rpc.WatchArgs) {
+			c <- struct{}{}
+		},
+	}
+}
+
+// Block until n leases are held, or ctx is done. Returns whether the leases are held, and false at once if n is not
+// positive. A request for more leases than the max waits until the max is raised. A Semaphore holds at most one
+// request at a time.
+func (s *Semaphore) Acquire(ctx context.Context, n int) bool {
+	if n <= 0 {
+		return false
+	}
+	leases := s.dir + "/" + leasesName
+	fname, err := recipe.CreateQueued(ctx, s.session, leases+"/"+nodePrefix, strconv.Itoa(n))
+	if err != rpc.OK {
+		return false
+	}
+	s.currentFile = fname
+	s.counts = map[rpc.Ppath]int{fname: n}
+
+	// Signalled when our watch on the max or on the leases list fires; nil while no such watch is pending, so that each
+	// is only set again once it has fired
+	var ch_max, ch_leases chan struct{}
+	for {
+		data, _, err := s.session.GetDataCtx(ctx, s.dir+"/"+maxName, arm(&ch_max))
+		if err != rpc.OK {
+			s.abandon()
+			return false
+		}
+		max, err := parseCount(data, 0)
+		if err != rpc.OK {
+			s.abandon()
+			return false
+		}
+		children, err := s.session.GetChildrenCtx(ctx, leases, arm(&ch_leases))
+		if err != rpc.OK {
+			s.abandon()
+			return false
+		}
+		ok, err := s.admitted(ctx, children, max)
+		if err != rpc.OK {
+			s.abandon()
+			return false
+		}
+		if ok {
+			return true
+		}
+
+		select {
+		case <-ch_max:
+			ch_max = nil
+		case <-ch_leases:
+			ch_leases = nil
+		case <-ctx.Done():
+			s.abandon()
+			return false
+		}
+	}
+}
+
+// Give up our place in the queue for leases.
+func (s *Semaphore) abandon() {
+	go s.session.Delete(s.currentFile, 1)
+	s.currentFile = ""
+}
+
+// Release the leases we hold
+func (s *Semaphore) Release() {
+	s.session.Delete(s.currentFile, 1)
+	s.currentFile = ""
+}
@@ -0,0 +1,196 @@
+package semaphore
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"pan/pan"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+const (
+	NCLNT    = 10
+	MAX      = 3
+	NSERVERS = 5
+)
+
+// Returns the leases counted by the nodes in the leases dir up to and including node. While node holds its leases, this
+// bounds the leases held: a node behind it is only admitted counting node's leases too. A crashed holder's node, and
+// so its leases, stays until its session expires.
+func leasesUpTo(session panapi.IPNSession, node rpc.Ppath) (int, rpc.Err) {
+	leases := rpc.Ppath("/semaphore/" + leasesName)
+	children, err := session.GetChildren(leases, rpc.Watch{})
+	if err != rpc.OK {
+		return 0, err
+	}
+	total := 0
+	for _, child := range children {
+		if child.GetSeqNumber() > node.GetSeqNumber() {
+			continue
+		}
+		data, _, err := session.GetData(leases+"/"+child, rpc.Watch{})
+		if err == rpc.ErrNoFile {
+			continue
+		} else if err != rpc.OK {
+			return 0, err
+		}
+		count, _ := strconv.Atoi(data)
+		total += count
+	}
+	return total, rpc.OK
+}
+
+// Take one or two leases, hold them for a while, then release them, end the session, or crash. The leases held, as
+// counted in the leases dir, must never exceed MAX.
+func runSemaphoreClient(i int, ch_err chan string, ch_done chan struct{}, clientCrash bool, ts *pan.Test) {
+	session := ts.MakeSession()
+	s := MakeSemaphore(session, "/semaphore", MAX)
+
+	n := 1 + i%2
+	if !s.Acquire(context.Background(), n) {
+		ch_err <- "Acquire failed"
+		return
+	}
+	if total, err := leasesUpTo(session, s.currentFile); err != rpc.OK {
+		ch_err <- "Could not count the leases: " + string(err)
+		return
+	} else if total > MAX {
+		ch_err <- "More than MAX leases were held at once"
+		return
+	}
+	session.Create("/tester/seq-", "", rpc.Flag{Sequential: true})
+
+	time.Sleep(time.Duration(rand.Int63()%500) * time.Millisecond)
+	choice := rand.Int() % 5
+	if choice == 0 && clientCrash {
+		ts.Crash(session)
+	} else if choice == 1 || choice == 2 {
+		session.EndSession()
+	} else {
+		s.Release()
+	}
+
+	ch_done <- struct{}{}
+}
+
+func runClients(t *testing.T, title string, nclnts int, clientCrash bool) {
+	ts := pan.MakeTest(t, title, nclnts+1, NSERVERS, true, false, clientCrash, false, -1, false)
+	defer ts.Cleanup()
+
+	session := ts.MakeSession()
+	seqPath := rpc.Ppath("/tester/seq-")
+
+	ch_err := make(chan string)
+	ch_done := make(chan struct{})
+	for i := range nclnts {
+		go runSemaphoreClient(i, ch_err, ch_done, clientCrash, ts)
+	}
+	for range nclnts {
+		select {
+		case err := <-ch_err:
+			t.Fatal(err)
+		case <-ch_done:
+		}
+	}
+
+	name, _ := session.Create(seqPath, "", rpc.Flag{Sequential: true})
+	if name != seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)) {
+		ts.Fatalf("Should have created %s; instead created %s", seqPath+rpc.Ppath(rpc.SeqSuffix(nclnts)), name)
+	}
+}
+
+func TestOneClientNoErrors(t *testing.T) {
+	runClients(t, "TestOneClientNoErrors", 1, false)
+}
+
+func TestManyClientsNoErrors(t *testing.T) {
+	runClients(t, "TestManyClientsNoErrors", NCLNT, false)
+}
+
+func TestManyClientsClientCrashes(t *testing.T) {
+	runClients(t, "TestManyClientsClientCrashes", NCLNT, true)
+}
+
+// Raising the max admits waiters at once, and lowering it holds up new holders
+func TestSetMax(t *testing.T) {
+	ts := pan.MakeTest(t, "TestSetMax", 3, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	a := MakeSemaphore(ts.MakeSession(), "/semaphore", 1)
+	b := MakeSemaphore(ts.MakeSession(), "/semaphore", 1)
+	c := MakeSemaphore(ts.MakeSession(), "/semaphore", 1)
+	if !a.Acquire(context.Background(), 1) {
+		t.Fatal("Did not acquire a free lease")
+	}
+
+	ch_b := make(chan bool)
+	go func() {
+		ch_b <- b.Acquire(context.Background(), 1)
+	}()
+	select {
+	case <-ch_b:
+		t.Fatal("Acquired more leases than the max")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := a.SetMax(2); err != rpc.OK {
+		t.Fatalf("SetMax returned %v", err)
+	}
+	select {
+	case ok := <-ch_b:
+		if !ok {
+			t.Fatal("Acquire failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Raising the max did not admit a waiter")
+	}
+
+	if err := a.SetMax(1); err != rpc.OK {
+		t.Fatalf("SetMax returned %v", err)
+	}
+	if max, err := c.Max(); err != rpc.OK || max != 1 {
+		t.Fatalf("Max returned %d, %v; expected 1", max, err)
+	}
+	a.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if c.Acquire(ctx, 1) {
+		t.Fatal("Acquired a lease while the holders still exceeded a lowered max")
+	}
+
+	b.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !c.Acquire(ctx, 1) {
+		t.Fatal("Did not acquire a released lease")
+	}
+}
+
+// Requests for no leases, and maxes that are not counts, are refused
+func TestBadCounts(t *testing.T) {
+	ts := pan.MakeTest(t, "TestBadCounts", 1, NSERVERS, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+
+	session := ts.MakeSession()
+	s := MakeSemaphore(session, "/semaphore", 1)
+	if s.Acquire(context.Background(), 0) {
+		t.Fatal("Acquired zero leases")
+	}
+	if err := s.SetMax(-1); err != ErrBadCount {
+		t.Fatalf("SetMax(-1) returned %v; expected %v", err, ErrBadCount)
+	}
+	_, version, _ := session.GetData("/semaphore/"+maxName, rpc.Watch{})
+	if err := session.SetData("/semaphore/"+maxName, "lots", version); err != rpc.OK {
+		t.Fatalf("SetData returned %v", err)
+	}
+	if _, err := s.Max(); err != ErrBadCount {
+		t.Fatalf("Max returned %v for a max that is not a count; expected %v", err, ErrBadCount)
+	}
+	if s.Acquire(context.Background(), 1) {
+		t.Fatal("Acquired a lease under a max that is not a count")
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+type cli struct {
+	session panapi.IPNSession
+	json    bool
+	out     io.Writer
+	editor  *editor // set in interactive mode, so watch events can be printed without garbling the input line
+
+	mu sync.Mutex // serializes output from commands and watch events
+}
+
+type command struct {
+	usage string
+	run   func(c *cli, args []string) (any, error)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ls":        {"ls [-R] path", (*cli).ls},
+		"get":       {"get path", (*cli).get},
+		"set":       {"set path data [version]", (*cli).set},
+		"create":    {"create [-e] [-s] path [data]", (*cli).create},
+		"delete":    {"delete path [version]", (*cli).delete},
+		"deleteall": {"deleteall path", (*cli).deleteAll},
+		"stat":      {"stat path", (*cli).stat},
+		"exists":    {"exists path", (*cli).exists},
+		"sync":      {"sync path", (*cli).sync},
+		"watch":     {"watch exists|data|children path", (*cli).watch},
+		"reconfig":  {"reconfig [-add role.N=address,...] [-remove observer.N,...] [-v version]", (*cli).reconfig},
+		"help":      {"help", (*cli).help},
+	}
+}
+
+// Returns the sorted command names, for help and completion.
+func commandNames() []string {
+	names := []string{"quit"}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type usageError string
+
+func (e usageError) Error() string {
+	return "usage: " + string(e)
+}
+
+type panError rpc.Err
+
+func (e panError) Error() string {
+	return string(e)
+}
+
+// Returns nil for rpc.OK, and the rpc Err as an error otherwise.
+func check(err rpc.Err) error {
+	if err == rpc.OK {
+		return nil
+	}
+	return panError(err)
+}
+
+// Split a command line into arguments at whitespace, like a shell: single quotes keep everything up to the closing
+// quote, and double quotes do the same except that a backslash escapes the next character.
+func splitLine(line string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Convert a path typed by the user into a Ppath. The root znode's path is the empty string, so "/" maps to "".
+func toPath(s string) rpc.Ppath {
+	return rpc.Ppath(strings.TrimSuffix(s, "/"))
+}
+
+// Run one command and print its result. Returns false if the command failed.
+func (c *cli) run(args []string) bool {
+	cmd, ok := commands[args[0]]
+	var result any
+	var err error
+	if !ok {
+		err = fmt.Errorf("unknown command %q; try help", args[0])
+	} else {
+		result, err = cmd.run(c, args[1:])
+	}
+
+	c.print(result, err)
+	return err == nil
+}
+
+// Print a command result or error, as JSON if requested.
+func (c *cli) print(result any, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.json {
+		out := map[string]any{"result": result}
+		if err != nil {
+			out = map[string]any{"error": err.Error()}
+		}
+		b, _ := json.Marshal(out)
+		fmt.Fprintln(c.out, string(b))
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(c.out, "Error: %v\n", err)
+		return
+	}
+	switch result := result.(type) {
+	case nil:
+	case []rpc.Ppath:
+		for _, path := range result {
+			fmt.Fprintln(c.out, path)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(result))
+		for key := range result {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(c.out, "%s = %v\n", key, result[key])
+		}
+	default:
+		fmt.Fprintln(c.out, result)
+	}
+}
+
+// Print a fired watch event, interrupting the input line if there is one.
+func (c *cli) printEvent(event rpc.WatchArgs) {
+	if c.editor != nil {
+		c.editor.interrupt(func() { c.print(map[string]any{"event": event.EventType, "path": event.Path}, nil) })
+	} else {
+		c.print(map[string]any{"event": event.EventType, "path": event.Path}, nil)
+	}
+}
+
+// Split leading single-letter flags such as -e from the rest of the arguments.
+func parseFlags(args []string, allowed string) (map[byte]bool, []string, bool) {
+	flags := make(map[byte]bool)
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, f := range []byte(args[0][1:]) {
+			if !strings.ContainsRune(allowed, rune(f)) {
+				return nil, nil, false
+			}
+			flags[f] = true
+		}
+		args = args[1:]
+	}
+	return flags, args, true
+}
+
+func (c *cli) ls(args []string) (any, error) {
+	flags, args, ok := parseFlags(args, "R")
+	if !ok || len(args) != 1 {
+		return nil, usageError(commands["ls"].usage)
+	}
+	path := toPath(args[0])
+
+	if !flags['R'] {
+		children, err := c.session.GetChildren(path, rpc.Watch{})
+		return children, check(err)
+	}
+
+	paths := []rpc.Ppath{}
+	var walk func(rpc.Ppath) error
+	walk = func(dir rpc.Ppath) error {
+		children, err := c.session.GetChildren(dir, rpc.Watch{})
+		if err != rpc.OK {
+			return check(err)
+		}
+		for _, child := range children {
+			childPath := dir + "/" + child
+			paths = append(paths, childPath)
+			if err := walk(childPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return paths, walk(path)
+}
+
+func (c *cli) get(args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, usageError(commands["get"].usage)
+	}
+	data, _, err := c.session.GetData(toPath(args[0]), rpc.Watch{})
+	return data, check(err)
+}
+
+// Returns the version argument at args[i] if present, and otherwise the znode's current version.
+func (c *cli) version(path rpc.Ppath, args []string, i int) (rpc.Pversion, error) {
+	if len(args) > i {
+		version, err := strconv.Atoi(args[i])
+		return rpc.Pversion(version), err
+	}
+	_, version, err := c.session.GetData(path, rpc.Watch{})
+	return version, check(err)
+}
+
+func (c *cli) set(args []string) (any, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, usageError(commands["set"].usage)
+	}
+	path := toPath(args[0])
+	version, err := c.version(path, args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return nil, check(c.session.SetData(path, args[1], version))
+}
+
+func (c *cli) create(args []string) (any, error) {
+	flags, args, ok := parseFlags(args, "es")
+	if !ok || len(args) < 1 || len(args) > 2 {
+		return nil, usageError(commands["create"].usage)
+	}
+	data := ""
+	if len(args) == 2 {
+		data = args[1]
+	}
+	name, err := c.session.Create(toPath(args[0]), data, rpc.Flag{Ephemeral: flags['e'], Sequential: flags['s']})
+	return name, check(err)
+}
+
+func (c *cli) delete(args []string) (any, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, usageError(commands["delete"].usage)
+	}
+	path := toPath(args[0])
+	version, err := c.version(path, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return nil, check(c.session.Delete(path, version))
+}
+
+// Delete a znode and everything below it, children first.
+func (c *cli) deleteAll(args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, usageError(commands["deleteall"].usage)
+	}
+
+	var remove func(rpc.Ppath) error
+	remove = func(path rpc.Ppath) error {
+		children, err := c.session.GetChildren(path, rpc.Watch{})
+		if err != rpc.OK {
+			return check(err)
+		}
+		for _, child := range children {
+			if err := remove(path + "/" + child); err != nil {
+				return err
+			}
+		}
+		_, version, err := c.session.GetData(path, rpc.Watch{})
+		if err != rpc.OK {
+			return check(err)
+		}
+		return check(c.session.Delete(path, version))
+	}
+	return nil, remove(toPath(args[0]))
+}
+
+func (c *cli) stat(args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, usageError(commands["stat"].usage)
+	}
+	path := toPath(args[0])
+	data, version, err := c.session.GetData(path, rpc.Watch{})
+	if err != rpc.OK {
+		return nil, check(err)
+	}
+	children, err := c.session.GetChildren(path, rpc.Watch{})
+	if err != rpc.OK {
+		return nil, check(err)
+	}
+	return map[string]any{"version": version, "dataLength": len(data), "numChildren": len(children)}, nil
+}
+
+func (c *cli) exists(args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, usageError(commands["exists"].usage)
+	}
+	exists, err := c.session.Exists(toPath(args[0]), rpc.Watch{})
+	return exists, check(err)
+}
+
+func (c *cli) sync(args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, usageError(commands["sync"].usage)
+	}
+	return nil, check(c.session.Sync(toPath(args[0])))
+}
+
+// Change the membership, like ZooKeeper's reconfig; prints the new version of the config znode.
+// Voters cannot be added or removed, since Raft's peers are fixed; a voter can only be given the new address of a
+// replica moved with its data.
+func (c *cli) reconfig(args []string) (any, error) {
+	var joining, leaving []string
+	fromVersion := rpc.Pversion(-1)
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, usageError(commands["reconfig"].usage)
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "-add":
+			joining = append(joining, strings.Split(args[i+1], ",")...)
+		case "-remove":
+			leaving = append(leaving, strings.Split(args[i+1], ",")...)
+		case "-v":
+			version, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			fromVersion = rpc.Pversion(version)
+		default:
+			return nil, usageError(commands["reconfig"].usage)
+		}
+	}
+	version, err := c.session.Reconfig(joining, leaving, fromVersion)
+	return version, check(err)
+}
+
+// Set a one-shot watch; the event is printed when it fires.
+func (c *cli) watch(args []string) (any, error) {
+	if len(args) != 2 {
+		return nil, usageError(commands["watch"].usage)
+	}
+	path := toPath(args[1])
+	watch := rpc.Watch{ShouldWatch: true, Callback: c.printEvent}
+
+	var err rpc.Err
+	switch args[0] {
+	case "exists":
+		_, err = c.session.Exists(path, watch)
+	case "data":
+		_, _, err = c.session.GetData(path, watch)
+	case "children":
+		_, err = c.session.GetChildren(path, watch)
+	default:
+		return nil, usageError(commands["watch"].usage)
+	}
+	return nil, check(err)
+}
+
+func (c *cli) help(args []string) (any, error) {
+	usages := []string{}
+	for _, name := range commandNames() {
+		if cmd, ok := commands[name]; ok {
+			usages = append(usages, cmd.usage)
+		} else {
+			usages = append(usages, name)
+		}
+	}
+	return strings.Join(usages, "\n"), nil
+}
+
+// Complete the last word of a partial line: a command name if it is the first word, and otherwise a znode path.
+// Returns the candidate completions of the word.
+func (c *cli) complete(line string) []string {
+	fields := strings.Fields(line)
+	word := ""
+	if len(fields) > 0 && !strings.HasSuffix(line, " ") {
+		word = fields[len(fields)-1]
+	}
+
+	if len(fields) == 0 || (len(fields) == 1 && word != "") {
+		matches := []string{}
+		for _, name := range commandNames() {
+			if strings.HasPrefix(name, word) {
+				matches = append(matches, name)
+			}
+		}
+		return matches
+	}
+
+	if !strings.HasPrefix(word, "/") {
+		return nil
+	}
+	slash := strings.LastIndex(word, "/")
+	dir, prefix := word[:slash], word[slash+1:]
+	children, err := c.session.GetChildren(rpc.Ppath(dir), rpc.Watch{})
+	if err != rpc.OK {
+		return nil
+	}
+
+	matches := []string{}
+	for _, child := range children {
+		if strings.HasPrefix(string(child), prefix) {
+			matches = append(matches, dir+"/"+string(child))
+		}
+	}
+	return matches
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A minimal line editor for a terminal in raw mode: typing, backspace, Ctrl-C to drop the line,
+// Ctrl-D to quit on an empty line, and tab completion.
+type editor struct {
+	mu       sync.Mutex
+	fd       int
+	state    *termState
+	in       *bufio.Reader
+	out      io.Writer
+	prompt   string
+	complete func(line string) []string
+	buf      []rune
+	reading  bool // true while readLine is waiting for input
+}
+
+func makeEditor(fd int, out io.Writer, prompt string, complete func(string) []string) (*editor, error) {
+	state, err := makeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &editor{fd: fd, state: state, in: bufio.NewReader(os.NewFile(uintptr(fd), "stdin")), out: out, prompt: prompt, complete: complete}, nil
+}
+
+// Put the terminal back the way it was.
+func (ed *editor) close() {
+	restoreTerminal(ed.fd, ed.state)
+}
+
+// Redraw the prompt and the current line. Must hold ed.mu.
+func (ed *editor) redraw() {
+	fmt.Fprintf(ed.out, "\r\033[K%s%s", ed.prompt, string(ed.buf))
+}
+
+// Run f, which prints something, without garbling a line being typed.
+func (ed *editor) interrupt(f func()) {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+
+	if !ed.reading {
+		f()
+		return
+	}
+	fmt.Fprint(ed.out, "\r\033[K")
+	f()
+	ed.redraw()
+}
+
+// Read one line. Returns false at end of input.
+func (ed *editor) readLine() (string, bool) {
+	ed.mu.Lock()
+	ed.buf = ed.buf[:0]
+	ed.reading = true
+	ed.redraw()
+	ed.mu.Unlock()
+
+	for {
+		r, _, err := ed.in.ReadRune()
+
+		ed.mu.Lock()
+		if err != nil {
+			ed.reading = false
+			ed.mu.Unlock()
+			return "", false
+		}
+
+		switch {
+		case r == '\r' || r == '\n':
+			fmt.Fprint(ed.out, "\r\n")
+			ed.reading = false
+			line := string(ed.buf)
+			ed.mu.Unlock()
+			return line, true
+		case r == 3: // Ctrl-C
+			fmt.Fprint(ed.out, "^C\r\n")
+			ed.buf = ed.buf[:0]
+			ed.redraw()
+		case r == 4: // Ctrl-D
+			if len(ed.buf) == 0 {
+				fmt.Fprint(ed.out, "\r\n")
+				ed.reading = false
+				ed.mu.Unlock()
+				return "", false
+			}
+		case r == 127 || r == '\b':
+			if len(ed.buf) > 0 {
+				ed.buf = ed.buf[:len(ed.buf)-1]
+				fmt.Fprint(ed.out, "\b \b")
+			}
+		case r == '\t':
+			ed.completeLine()
+		case r == 27: // escape sequences such as arrow keys are not supported; skip them
+			if next, _, _ := ed.in.ReadRune(); next == '[' {
+				for {
+					c, _, err := ed.in.ReadRune()
+					if err != nil || unicode.IsLetter(c) || c == '~' {
+						break
+					}
+				}
+			}
+		case unicode.IsPrint(r):
+			ed.buf = append(ed.buf, r)
+			fmt.Fprint(ed.out, string(r))
+		}
+		ed.mu.Unlock()
+	}
+}
+
+// Complete the word under the cursor, or list the candidates if there is more than one. Must hold ed.mu, which is
+// released while the candidates are found, since completing a path makes an RPC that may block.
+func (ed *editor) completeLine() {
+	line := string(ed.buf)
+	ed.mu.Unlock()
+	matches := ed.complete(line)
+	ed.mu.Lock()
+	if len(matches) == 0 {
+		fmt.Fprint(ed.out, "\a")
+		return
+	}
+
+	start := strings.LastIndex(line, " ") + 1
+	completion := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(matches) == 1 && start == 0 {
+		completion += " "
+	}
+	ed.buf = []rune(line[:start] + completion)
+
+	if len(matches) > 1 {
+		fmt.Fprintf(ed.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+	}
+	ed.redraw()
+}
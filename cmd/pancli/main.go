@@ -0,0 +1,86 @@
+// Command pancli is an interactive shell for a Pan ensemble, modeled on zkCli.
+//
+// Usage:
+//
+//	pancli -servers host1:port,host2:port,host3:port [-json] [command [args...]]
+//
+// With a command, pancli runs it and exits. Otherwise it reads commands from standard input, with line editing and tab
+// completion of znode paths when standard input is a terminal. Type "help" for the list of commands. Arguments read
+// from standard input are split on whitespace, except inside single or double quotes, so data may contain spaces:
+//
+//	set /app/motd "hello world"
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"pan/pan"
+)
+
+func main() {
+	servers := flag.String("servers", "127.0.0.1:2181", "comma-separated list of server addresses")
+	jsonOutput := flag.Bool("json", false, "print results as JSON")
+	flag.Parse()
+
+	transport := pan.MakeTCPTransport()
+	session := pan.MakeSession(transport, strings.Split(*servers, ","))
+	c := &cli{session: session, json: *jsonOutput, out: os.Stdout}
+
+	status := 0
+	if flag.NArg() > 0 {
+		if !c.run(flag.Args()) {
+			status = 1
+		}
+	} else if isTerminal(int(os.Stdin.Fd())) {
+		c.interactive()
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			args, err := splitLine(scanner.Text())
+			if err != nil {
+				c.print(nil, err)
+				status = 1
+			} else if len(args) > 0 && !c.run(args) {
+				status = 1
+			}
+		}
+	}
+
+	session.EndSession()
+	transport.Close()
+	os.Exit(status)
+}
+
+// Read and run commands from the terminal until quit or end of input.
+func (c *cli) interactive() {
+	ed, err := makeEditor(int(os.Stdin.Fd()), os.Stdout, "pan> ", c.complete)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pancli: %v\n", err)
+		return
+	}
+	defer ed.close()
+	c.editor = ed
+
+	for {
+		line, ok := ed.readLine()
+		if !ok {
+			return
+		}
+		args, err := splitLine(line)
+		if err != nil {
+			c.print(nil, err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return
+		}
+		c.run(args)
+	}
+}
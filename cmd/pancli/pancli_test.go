@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// A session holding one znode, /a, with no children. Methods the tests don't use panic.
+type fakeSession struct {
+	panapi.IPNSession
+	data    string
+	version rpc.Pversion
+}
+
+func (s *fakeSession) GetData(path rpc.Ppath, watch rpc.Watch) (string, rpc.Pversion, rpc.Err) {
+	if path != "/a" {
+		return "", 0, rpc.ErrNoFile
+	}
+	return s.data, s.version, rpc.OK
+}
+
+func (s *fakeSession) SetData(path rpc.Ppath, data string, version rpc.Pversion) rpc.Err {
+	if path != "/a" {
+		return rpc.ErrNoFile
+	}
+	if version != s.version {
+		return rpc.ErrVersion
+	}
+	s.data, s.version = data, version+1
+	return rpc.OK
+}
+
+func (s *fakeSession) GetChildren(path rpc.Ppath, watch rpc.Watch) ([]rpc.Ppath, rpc.Err) {
+	if path != "/a" {
+		return nil, rpc.ErrNoFile
+	}
+	return []rpc.Ppath{}, rpc.OK
+}
+
+func TestSplitLine(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"  ls   /a ", []string{"ls", "/a"}},
+		{`set /a "hello world"`, []string{"set", "/a", "hello world"}},
+		{`set /a 'say "hi"' 3`, []string{"set", "/a", `say "hi"`, "3"}},
+		{`set /a "a \"quoted\" \\ word"`, []string{"set", "/a", `a "quoted" \ word`}},
+		{`set /a ""`, []string{"set", "/a", ""}},
+		{`create /a x"y z"`, []string{"create", "/a", "xy z"}},
+	} {
+		args, err := splitLine(test.line)
+		if err != nil || !slices.Equal(args, test.expected) {
+			t.Fatalf("splitLine(%q) returned %q, %v; expected %q", test.line, args, err, test.expected)
+		}
+	}
+
+	for _, line := range []string{`set /a "hello`, `set /a 'hello`} {
+		if args, err := splitLine(line); err == nil {
+			t.Fatalf("splitLine(%q) returned %q; expected an unterminated quote error", line, args)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	for _, test := range []struct {
+		args  []string
+		flags []byte
+		rest  []string
+		ok    bool
+	}{
+		{[]string{"/a"}, nil, []string{"/a"}, true},
+		{[]string{"-e", "-s", "/a", "x"}, []byte("es"), []string{"/a", "x"}, true},
+		{[]string{"-es", "/a"}, []byte("es"), []string{"/a"}, true},
+		{[]string{"-x", "/a"}, nil, nil, false},
+		{[]string{"-", "/a"}, nil, []string{"-", "/a"}, true},
+	} {
+		flags, rest, ok := parseFlags(test.args, "es")
+		if ok != test.ok || !slices.Equal(rest, test.rest) || len(flags) != len(test.flags) {
+			t.Fatalf("parseFlags(%q) returned %v, %q, %v; expected flags %q and %q", test.args, flags, rest, ok, test.flags, test.rest)
+		}
+		for _, f := range test.flags {
+			if !flags[f] {
+				t.Fatalf("parseFlags(%q) did not set -%c", test.args, f)
+			}
+		}
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		json     bool
+		expected string
+		ok       bool
+	}{
+		{[]string{"get", "/a"}, false, "hello\n", true},
+		{[]string{"get", "/a"}, true, `{"result":"hello"}` + "\n", true},
+		{[]string{"get", "/b"}, false, "Error: ErrNoFile\n", false},
+		{[]string{"get", "/b"}, true, `{"error":"ErrNoFile"}` + "\n", false},
+		{[]string{"get"}, false, "Error: usage: get path\n", false},
+		{[]string{"stat", "/a"}, false, "dataLength = 5\nnumChildren = 0\nversion = 1\n", true},
+		{[]string{"ls", "/a"}, true, `{"result":[]}` + "\n", true},
+		{[]string{"set", "/a", "x", "7"}, false, "Error: ErrVersion\n", false},
+		{[]string{"nope"}, false, "Error: unknown command \"nope\"; try help\n", false},
+	} {
+		var out bytes.Buffer
+		c := &cli{session: &fakeSession{data: "hello", version: 1}, json: test.json, out: &out}
+		if ok := c.run(test.args); ok != test.ok || out.String() != test.expected {
+			t.Fatalf("%q printed %q and returned %v; expected %q and %v", test.args, out.String(), ok, test.expected, test.ok)
+		}
+	}
+}
+
+// Data with spaces reaches SetData whole when it is quoted
+func TestSetQuotedData(t *testing.T) {
+	session := &fakeSession{data: "hello", version: 1}
+	c := &cli{session: session, out: &bytes.Buffer{}}
+	args, _ := splitLine(`set /a "hello world"`)
+	if !c.run(args) || session.data != "hello world" || session.version != 2 {
+		t.Fatalf("set left /a with %q at version %d; expected %q at version 2", session.data, session.version, "hello world")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Line editing is only supported on Linux; elsewhere pancli reads commands line by line.
+
+type termState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*termState, error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
+
+func restoreTerminal(fd int, state *termState) error {
+	return nil
+}
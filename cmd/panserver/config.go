@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"pan/pan"
+)
+
+// Configuration for one panserver, read from a zoo.cfg-style file of key=value lines:
+//
+//	# this replica's index into the server list
+//	id=0
+//	# every replica in the ensemble, numbered from 0
+//	server.0=10.0.0.1:7000
+//	server.1=10.0.0.2:7000
+//	server.2=10.0.0.3:7000
+//	dataDir=/var/lib/pan
+//	# optional address to serve on as an observer of the servers above instead of as a replica; an observer
+//	# takes no id and keeps no state, so it needs no dataDir
+//	observer=10.0.0.4:7000
+//	minSessionTimeout=2s
+//	maxSessionTimeout=20s
+//	# Raft state size in bytes that triggers a snapshot; -1 disables snapshots
+//	maxraftstate=1000000
+//	# optional address for four-letter-word admin commands, e.g. echo mntr | nc 10.0.0.1 7001
+//	adminAddr=10.0.0.1:7001
+//	# optional address for Prometheus to scrape at /metrics
+//	metricsAddr=10.0.0.1:7002
+//	# optional log levels, overriding the PAN_LOG environment variable
+//	logLevels=warn,CMIT=debug
+//	# optional audit log of every change, rotated once it reaches auditLogMaxSize bytes,
+//	# keeping auditLogMaxFiles old files
+//	auditLog=/var/log/pan/audit.log
+//	auditLogMaxSize=104857600
+//	auditLogMaxFiles=10
+//	# optional time to hold requests so that concurrent ones share a Raft entry; 0 disables group commit
+//	batchWindow=2ms
+type Config struct {
+	Id                int
+	Servers           []string
+	DataDir           string
+	MinSessionTimeout time.Duration
+	MaxSessionTimeout time.Duration
+	MaxRaftState      int
+	AdminAddr         string
+	MetricsAddr       string
+	LogLevels         string
+	AuditLog          string
+	AuditLogMaxSize   int64
+	AuditLogMaxFiles  int
+	BatchWindow       time.Duration
+	Observer          string
+}
+
+func readConfig(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &Config{
+		Id:                -1,
+		MinSessionTimeout: pan.DefaultSessionTimeout,
+		MaxSessionTimeout: pan.DefaultSessionTimeout,
+		MaxRaftState:      -1,
+		AuditLogMaxSize:   100 << 20,
+		AuditLogMaxFiles:  10,
+	}
+	servers := make(map[int]string)
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected key=value", filename, lineno)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch {
+		case key == "id":
+			cfg.Id, err = strconv.Atoi(value)
+		case strings.HasPrefix(key, "server."):
+			var i int
+			i, err = strconv.Atoi(strings.TrimPrefix(key, "server."))
+			servers[i] = value
+		case key == "dataDir":
+			cfg.DataDir = value
+		case key == "minSessionTimeout":
+			cfg.MinSessionTimeout, err = time.ParseDuration(value)
+		case key == "maxSessionTimeout":
+			cfg.MaxSessionTimeout, err = time.ParseDuration(value)
+		case key == "maxraftstate":
+			cfg.MaxRaftState, err = strconv.Atoi(value)
+		case key == "adminAddr":
+			cfg.AdminAddr = value
+		case key == "metricsAddr":
+			cfg.MetricsAddr = value
+		case key == "logLevels":
+			cfg.LogLevels = value
+		case key == "auditLog":
+			cfg.AuditLog = value
+		case key == "auditLogMaxSize":
+			cfg.AuditLogMaxSize, err = strconv.ParseInt(value, 10, 64)
+		case key == "auditLogMaxFiles":
+			cfg.AuditLogMaxFiles, err = strconv.Atoi(value)
+		case key == "batchWindow":
+			cfg.BatchWindow, err = time.ParseDuration(value)
+		case key == "observer":
+			cfg.Observer = value
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	cfg.Servers = make([]string, len(servers))
+	for i := range cfg.Servers {
+		addr, ok := servers[i]
+		if !ok {
+			return nil, fmt.Errorf("%s: servers must be numbered 0 to %d; server.%d is missing", filename, len(servers)-1, i)
+		}
+		cfg.Servers[i] = addr
+	}
+
+	if cfg.Observer != "" {
+		if cfg.Id != -1 {
+			return nil, fmt.Errorf("%s: an observer takes no id", filename)
+		}
+	} else {
+		if cfg.Id < 0 || cfg.Id >= len(cfg.Servers) {
+			return nil, fmt.Errorf("%s: id %d does not name one of the %d servers", filename, cfg.Id, len(cfg.Servers))
+		}
+		if cfg.DataDir == "" {
+			return nil, fmt.Errorf("%s: dataDir is required", filename)
+		}
+	}
+	if cfg.MinSessionTimeout > cfg.MaxSessionTimeout {
+		return nil, fmt.Errorf("%s: minSessionTimeout %v is above maxSessionTimeout %v", filename, cfg.MinSessionTimeout, cfg.MaxSessionTimeout)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,81 @@
+// Command panserver runs one replica of a Pan ensemble over TCP, persisting its state to disk, or an observer of one.
+//
+// Usage:
+//
+//	panserver -config panserver.cfg
+//
+// See Config for the file format. The server shuts down cleanly on SIGTERM or SIGINT.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"pan/pan"
+)
+
+func main() {
+	configFile := flag.String("config", "panserver.cfg", "path to the config file")
+	flag.Parse()
+
+	cfg, err := readConfig(*configFile)
+	if err != nil {
+		log.Fatalf("panserver: %v", err)
+	}
+
+	if cfg.LogLevels != "" {
+		if err := pan.SetLogLevels(cfg.LogLevels); err != nil {
+			log.Fatalf("panserver: logLevels: %v", err)
+		}
+	}
+
+	opts := pan.DefaultServerOptions()
+	opts.MinSessionTimeout = cfg.MinSessionTimeout
+	opts.MaxSessionTimeout = cfg.MaxSessionTimeout
+	opts.AdminAddr = cfg.AdminAddr
+	opts.MetricsAddr = cfg.MetricsAddr
+	opts.BatchWindow = cfg.BatchWindow
+	if cfg.AuditLog != "" {
+		if opts.AuditLog, err = pan.MakeAuditLog(cfg.AuditLog, cfg.AuditLogMaxSize, cfg.AuditLogMaxFiles); err != nil {
+			log.Fatalf("panserver: opening audit log: %v", err)
+		}
+	}
+
+	var srv *pan.TCPPanServer
+	var persister *pan.DiskPersister
+	if cfg.Observer != "" {
+		if srv, err = pan.StartTCPPanObserver(cfg.Servers, cfg.Observer, opts); err != nil {
+			log.Fatalf("panserver: %v", err)
+		}
+		log.Printf("panserver: observer serving on %s", cfg.Observer)
+	} else {
+		if persister, err = pan.MakeDiskPersister(cfg.DataDir); err != nil {
+			log.Fatalf("panserver: loading %s: %v", cfg.DataDir, err)
+		}
+		opts.Flush = persister.Sync
+		if srv, err = pan.StartTCPPanServer(cfg.Servers, cfg.Id, persister.Persister(), cfg.MaxRaftState, opts); err != nil {
+			log.Fatalf("panserver: %v", err)
+		}
+		log.Printf("panserver: server %d serving on %s", cfg.Id, cfg.Servers[cfg.Id])
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+
+	log.Printf("panserver: received %v, shutting down", sig)
+	srv.Kill()
+	if opts.AuditLog != nil {
+		if err := opts.AuditLog.Close(); err != nil {
+			log.Printf("panserver: closing audit log: %v", err)
+		}
+	}
+	if persister != nil {
+		if err := persister.Close(); err != nil {
+			log.Fatalf("panserver: saving state to %s: %v", cfg.DataDir, err)
+		}
+	}
+}
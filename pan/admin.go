@@ -0,0 +1,234 @@
+package pan
+
+import (
+	"fmt"
+	"pan/panapi/rpc"
+	"sort"
+	"strings"
+)
+
+// Admin commands report this replica's local view of its state, in the formats of ZooKeeper's four-letter words,
+// so tools that parse ZooKeeper's output can parse Pan's. They are not submitted to Raft.
+
+const panVersion = "pan-1.0"
+
+var adminCommands = map[string]func(pn *PanServer) string{
+	"ruok": (*PanServer).adminRuok,
+	"stat": (*PanServer).adminStat,
+	"mntr": (*PanServer).adminMntr,
+	"cons": (*PanServer).adminCons,
+	"wchs": (*PanServer).adminWchs,
+	"wchp": (*PanServer).adminWchp,
+	"dump": (*PanServer).adminDump,
+}
+
+// Run an admin command.
+func (pn *PanServer) Admin(args *rpc.AdminArgs, reply *rpc.AdminReply) {
+	output, ok := pn.adminCommand(args.Command)
+	if !ok {
+		reply.Err = rpc.ErrUnknownCommand
+		return
+	}
+	reply.Output = output
+	reply.Err = rpc.OK
+}
+
+// Returns the output of an admin command, and false if there is no such command.
+func (pn *PanServer) adminCommand(command string) (string, bool) {
+	run, ok := adminCommands[command]
+	if !ok {
+		return "", false
+	}
+	return run(pn), true
+}
+
+// Returns "leader" or "follower", as reported by Raft, or "observer".
+func (pn *PanServer) serverState() string {
+	if pn.observer != nil {
+		return "observer"
+	}
+	if _, isLeader := pn.rsm.Raft().GetState(); isLeader {
+		return "leader"
+	}
+	return "follower"
+}
+
+// Count the znodes in the subtree rooted at zn, and their approximate size as path length plus data length.
+func (zn *ZNode) count(path string) (int, int) {
+	count, size := 1, len(path)+len(zn.data)
+	for _, child := range zn.children {
+		childCount, childSize := child.count(path + "/" + child.name)
+		count += childCount
+		size += childSize
+	}
+	return count, size
+}
+
+// Returns the sorted live session ids. Must hold pn.mu.
+func (pn *PanServer) sessionIds() []int {
+	ids := make([]int, 0, len(pn.sessions))
+	for id := range pn.sessions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Returns the number of watches in each watchlist, and the number of distinct watched paths and watching sessions
+// across all of them. Must hold pn.mu.
+func (pn *PanServer) watchCounts() (map[string]int, int, int) {
+	counts := make(map[string]int)
+	paths := make(map[rpc.Ppath]bool)
+	sessions := make(map[int]bool)
+	for _, watchlist := range pn.watchlists() {
+		for path, watches := range watchlist.watches {
+			counts[watchlist.watchType] += len(watches)
+			for _, watch := range watches {
+				paths[path] = true
+				sessions[watch.sessionId] = true
+			}
+		}
+	}
+	return counts, len(paths), len(sessions)
+}
+
+func (pn *PanServer) watchlists() []*Watchlist {
+	return []*Watchlist{&pn.dataWatches, &pn.createWatches, &pn.deleteWatches, &pn.childWatches}
+}
+
+func (pn *PanServer) adminRuok() string {
+	return "imok"
+}
+
+func (pn *PanServer) adminStat() string {
+	state := pn.serverState()
+
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Zookeeper version: %s\n", panVersion)
+	fmt.Fprintf(&b, "Clients:\n")
+	for _, id := range pn.sessionIds() {
+		fmt.Fprintf(&b, " /session[%d](sid=0x%x,to=%d)\n", id, id, pn.sessionTimeouts[id].Milliseconds())
+	}
+	count, _ := pn.rootZNode.count("")
+	fmt.Fprintf(&b, "\nConnections: %d\n", len(pn.sessions))
+	fmt.Fprintf(&b, "Mode: %s\n", state)
+	fmt.Fprintf(&b, "Node count: %d\n", count)
+	return b.String()
+}
+
+func (pn *PanServer) adminMntr() string {
+	state := pn.serverState()
+
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	count, size := pn.rootZNode.count("")
+	watchCounts, _, _ := pn.watchCounts()
+	totalWatches, ephemerals := 0, 0
+	for _, n := range watchCounts {
+		totalWatches += n
+	}
+	for _, paths := range pn.ephemeralNodes {
+		ephemerals += len(paths)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "zk_version\t%s\n", panVersion)
+	fmt.Fprintf(&b, "zk_server_state\t%s\n", state)
+	fmt.Fprintf(&b, "zk_znode_count\t%d\n", count)
+	fmt.Fprintf(&b, "zk_watch_count\t%d\n", totalWatches)
+	fmt.Fprintf(&b, "zk_ephemerals_count\t%d\n", ephemerals)
+	fmt.Fprintf(&b, "zk_approximate_data_size\t%d\n", size)
+	fmt.Fprintf(&b, "zk_num_alive_connections\t%d\n", len(pn.sessions))
+	for _, watchlist := range pn.watchlists() {
+		fmt.Fprintf(&b, "pan_watch_count_%s\t%d\n", watchlist.watchType, watchCounts[watchlist.watchType])
+	}
+	return b.String()
+}
+
+func (pn *PanServer) adminCons() string {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	var b strings.Builder
+	for _, id := range pn.sessionIds() {
+		fmt.Fprintf(&b, " /session[%d](sid=0x%x,to=%d,expires=%d)\n", id, id, pn.sessionTimeouts[id].Milliseconds(), pn.sessions[id].UnixMilli())
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func (pn *PanServer) adminWchs() string {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	watchCounts, paths, sessions := pn.watchCounts()
+	total := 0
+	for _, n := range watchCounts {
+		total += n
+	}
+	return fmt.Sprintf("%d connections watching %d paths\nTotal watches:%d\n", sessions, paths, total)
+}
+
+// Lists each watched path with the sessions watching it and the type of each watch.
+func (pn *PanServer) adminWchp() string {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	watchers := make(map[rpc.Ppath][]string)
+	for _, watchlist := range pn.watchlists() {
+		for path, watches := range watchlist.watches {
+			for _, watch := range watches {
+				watchers[path] = append(watchers[path], fmt.Sprintf("0x%x %s", watch.sessionId, watchlist.watchType))
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(watchers))
+	for path := range watchers {
+		paths = append(paths, string(path))
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&b, "%s\n", path)
+		sort.Strings(watchers[rpc.Ppath(path)])
+		for _, watcher := range watchers[rpc.Ppath(path)] {
+			fmt.Fprintf(&b, "\t%s\n", watcher)
+		}
+	}
+	return b.String()
+}
+
+func (pn *PanServer) adminDump() string {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	var b strings.Builder
+	ids := pn.sessionIds()
+	fmt.Fprintf(&b, "SessionTracker dump:\n")
+	fmt.Fprintf(&b, "Global Sessions(%d):\n", len(ids))
+	for _, id := range ids {
+		fmt.Fprintf(&b, "0x%x\t%dms\n", id, pn.sessionTimeouts[id].Milliseconds())
+	}
+
+	withEphemerals := []int{}
+	for _, id := range ids {
+		if len(pn.ephemeralNodes[id]) > 0 {
+			withEphemerals = append(withEphemerals, id)
+		}
+	}
+	fmt.Fprintf(&b, "ephemeral nodes dump:\n")
+	fmt.Fprintf(&b, "Sessions with Ephemerals (%d):\n", len(withEphemerals))
+	for _, id := range withEphemerals {
+		fmt.Fprintf(&b, "0x%x:\n", id)
+		for _, path := range pn.ephemeralNodes[id] {
+			fmt.Fprintf(&b, "\t%s\n", path)
+		}
+	}
+	return b.String()
+}
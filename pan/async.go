@@ -0,0 +1,176 @@
+package pan
+
+import (
+	"context"
+	"log/slog"
+	"pan/panapi"
+	"pan/panapi/rpc"
+)
+
+// Most calls a session queues while a batch is in flight that it sends in the next one
+const asyncBatchSize = 500
+
+// An asynchronous call waiting to be sent
+type asyncCall struct {
+	req      any
+	complete func(reply any, err rpc.Err) // reply is the reply by value, or nil if err is not OK
+}
+
+// Queue an asynchronous call, starting a dispatcher if none is running.
+func (ck *Session) enqueue(req any, complete func(any, rpc.Err)) {
+	ck.asyncMu.Lock()
+	defer ck.asyncMu.Unlock()
+
+	ck.asyncQueue = append(ck.asyncQueue, asyncCall{req: req, complete: complete})
+	if !ck.dispatching {
+		ck.dispatching = true
+		go ck.dispatch()
+	}
+}
+
+// Send queued calls in batches, one batch at a time, and complete them in order, until the queue is empty.
+func (ck *Session) dispatch() {
+	for {
+		ck.asyncMu.Lock()
+		if len(ck.asyncQueue) == 0 {
+			ck.dispatching = false
+			ck.asyncMu.Unlock()
+			return
+		}
+		n := min(len(ck.asyncQueue), asyncBatchSize)
+		calls := ck.asyncQueue[:n:n]
+		ck.asyncQueue = ck.asyncQueue[n:]
+		ck.asyncMu.Unlock()
+
+		ck.batchId++
+		args := rpc.BatchArgs{SessionId: ck.id, BatchId: ck.batchId, Requests: make([]any, len(calls))}
+		for i, call := range calls {
+			args.Requests[i] = call.req
+		}
+
+		replies, err := ck.sendBatch(&args)
+		for i, call := range calls {
+			if err != rpc.OK {
+				call.complete(nil, err)
+			} else {
+				call.complete(replies[i], rpc.OK)
+			}
+		}
+	}
+}
+
+// Send a batch until some server applies it. A retried batch keeps its id, so it is applied at most once.
+func (ck *Session) sendBatch(args *rpc.BatchArgs) ([]any, rpc.Err) {
+	ctx := context.Background()
+	for attempt := 0; ; attempt++ {
+		reply := rpc.BatchReply{}
+		ok, _ := ck.call(ctx, "PanServer.Batch", args, &reply)
+		if ok && reply.Err != rpc.ErrWrongLeader {
+			ck.log(dClient, slog.LevelDebug, "applied batch", "batch", args.BatchId, "requests", len(args.Requests), "err", reply.Err)
+			return reply.Replies, reply.Err
+		}
+		ck.retry(ctx, "Batch", ok, reply.Leader, attempt)
+	}
+}
+
+// Like Create, but returns at once. Several asynchronous calls from one session may be in flight at once; they take
+// effect, and their futures complete, in the order they were made.
+func (ck *Session) CreateAsync(path rpc.Ppath, data string, flags rpc.Flag) *panapi.Future[rpc.Ppath] {
+	args := rpc.CreateArgs{SessionId: ck.id, Path: path, Data: data, Flags: flags}
+	if flags.Ephemeral && flags.Sequential {
+		args.Flags.Protected = true
+	}
+	if args.Flags.Protected {
+		args.Guid = protectedGuid(flags)
+	}
+
+	f := panapi.MakeFuture[rpc.Ppath]()
+	ck.enqueue(args, func(reply any, err rpc.Err) {
+		if err != rpc.OK {
+			f.Complete("", err)
+			return
+		}
+		r := reply.(rpc.CreateReply)
+		// Like Create, creating a znode this session already created succeeds
+		if r.Err == rpc.ErrOnCreate && r.CreatedBy == ck.id {
+			r.Err = rpc.OK
+		}
+		f.Complete(r.ZNodeName, r.Err)
+	})
+	return f
+}
+
+// Like Delete, but returns at once, like CreateAsync.
+func (ck *Session) DeleteAsync(path rpc.Ppath, version rpc.Pversion) *panapi.Future[struct{}] {
+	f := panapi.MakeFuture[struct{}]()
+	ck.enqueue(rpc.DeleteArgs{SessionId: ck.id, Path: path, Version: version}, func(reply any, err rpc.Err) {
+		if err == rpc.OK {
+			err = reply.(rpc.DeleteReply).Err
+		}
+		f.Complete(struct{}{}, err)
+	})
+	return f
+}
+
+// Like Exists, but returns at once, like CreateAsync.
+func (ck *Session) ExistsAsync(path rpc.Ppath, watch rpc.Watch) *panapi.Future[bool] {
+	f := panapi.MakeFuture[bool]()
+	ck.enqueue(rpc.ExistsArgs{SessionId: ck.id, Path: path, Watch: watch}, func(reply any, err rpc.Err) {
+		if err != rpc.OK {
+			f.Complete(false, err)
+			return
+		}
+		r := reply.(rpc.ExistsReply)
+		if watch.ShouldWatch {
+			go ck.WatchWait(r.WatchId, watch.Callback)
+		}
+		f.Complete(r.Result, r.Err)
+	})
+	return f
+}
+
+// Like GetData, but returns at once, like CreateAsync.
+func (ck *Session) GetDataAsync(path rpc.Ppath, watch rpc.Watch) *panapi.Future[panapi.DataResult] {
+	f := panapi.MakeFuture[panapi.DataResult]()
+	ck.enqueue(rpc.GetDataArgs{SessionId: ck.id, Path: path, Watch: watch}, func(reply any, err rpc.Err) {
+		if err != rpc.OK {
+			f.Complete(panapi.DataResult{}, err)
+			return
+		}
+		r := reply.(rpc.GetDataReply)
+		if watch.ShouldWatch {
+			go ck.WatchWait(r.WatchId, watch.Callback)
+		}
+		f.Complete(panapi.DataResult{Data: r.Data, Version: r.Version}, r.Err)
+	})
+	return f
+}
+
+// Like SetData, but returns at once, like CreateAsync.
+func (ck *Session) SetDataAsync(path rpc.Ppath, data string, version rpc.Pversion) *panapi.Future[struct{}] {
+	f := panapi.MakeFuture[struct{}]()
+	ck.enqueue(rpc.SetDataArgs{SessionId: ck.id, Path: path, Data: data, Version: version}, func(reply any, err rpc.Err) {
+		if err == rpc.OK {
+			err = reply.(rpc.SetDataReply).Err
+		}
+		f.Complete(struct{}{}, err)
+	})
+	return f
+}
+
+// Like GetChildren, but returns at once, like CreateAsync.
+func (ck *Session) GetChildrenAsync(path rpc.Ppath, watch rpc.Watch) *panapi.Future[[]rpc.Ppath] {
+	f := panapi.MakeFuture[[]rpc.Ppath]()
+	ck.enqueue(rpc.GetChildrenArgs{SessionId: ck.id, Path: path, Watch: watch}, func(reply any, err rpc.Err) {
+		if err != rpc.OK {
+			f.Complete(nil, err)
+			return
+		}
+		r := reply.(rpc.GetChildrenReply)
+		if watch.ShouldWatch && r.Err == rpc.OK {
+			go ck.WatchWait(r.WatchId, watch.Callback)
+		}
+		f.Complete(r.Children, r.Err)
+	})
+	return f
+}
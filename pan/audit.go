@@ -0,0 +1,232 @@
+package pan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"pan/panapi/rpc"
+	"sync"
+	"time"
+)
+
+// Version recorded in an audit record for a znode that does not exist before or after an operation
+const NoVersion rpc.Pversion = -1
+
+// One mutation in the audit log, as applied by the replicated state machine.
+//
+// Every replica applies the same requests in the same order, so each applied request gets the same zxid on every
+// replica, and all of its records carry that zxid and the request's replicated timestamp. A replica writes the records
+// of each zxid at most once, so replaying the Raft log after a restart does not duplicate them, and logs collected
+// from several replicas can be merged by dropping repeated zxids.
+type AuditRecord struct {
+	Zxid       int64        `json:"zxid"`
+	Time       time.Time    `json:"time"`
+	Session    int          `json:"session"`
+	Identity   string       `json:"identity,omitempty"`
+	Op         string       `json:"op"`
+	Path       rpc.Ppath    `json:"path,omitempty"`
+	OldVersion rpc.Pversion `json:"oldVersion"`
+	NewVersion rpc.Pversion `json:"newVersion"`
+	Err        rpc.Err      `json:"err"`
+}
+
+// Audit record ops
+const (
+	auditCreate          = "create"
+	auditDelete          = "delete"
+	auditSetData         = "setData"
+	auditStartSession    = "startSession"
+	auditEndSession      = "endSession"
+	auditExpireSession   = "expireSession"
+	auditDeleteEphemeral = "deleteEphemeral"
+	auditDeleteSubtree   = "deleteSubtree" // a persistent znode removed along with an ephemeral ancestor
+)
+
+// An AuditLog appends AuditRecords as JSON lines to a file, rotating it once it reaches a maximum size.
+// Rotated files are named path.1 (the newest) through path.N.
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	lastZxid int64 // zxid of the last records written; older zxids are skipped
+	dirty    bool  // whether records were written since the last Sync
+}
+
+// Open the audit log at path, appending to it if it exists. Once the file reaches maxSize bytes it is rotated,
+// keeping at most maxFiles rotated files; a maxSize of zero disables rotation.
+func MakeAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	al := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+
+	// Pick up where the log left off, even if the current file was just rotated and is empty
+	for _, name := range []string{path, path + ".1"} {
+		zxid, err := lastZxid(name)
+		if err != nil {
+			return nil, err
+		}
+		if zxid > 0 {
+			al.lastZxid = zxid
+			break
+		}
+	}
+
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Returns the zxid of the last complete record in an audit log file, or 0 if it has none.
+func lastZxid(name string) (int64, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	// A crash may have left a partial last line; the last record is the last line that parses
+	var zxid int64
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var record AuditRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			zxid = record.Zxid
+		}
+	}
+	return zxid, nil
+}
+
+func (al *AuditLog) open() error {
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	al.file, al.size = file, info.Size()
+	return nil
+}
+
+// Shift path.1 through path.N-1 up by one, dropping path.N, move the current file to path.1, and start a new one.
+func (al *AuditLog) rotate() error {
+	if err := al.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", al.path, al.maxFiles))
+	for i := al.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.path, i), fmt.Sprintf("%s.%d", al.path, i+1))
+	}
+	if al.maxFiles > 0 {
+		if err := os.Rename(al.path, al.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(al.path); err != nil {
+		return err
+	}
+	return al.open()
+}
+
+// Append the records of one applied request, unless records for its zxid or a later one were already written.
+func (al *AuditLog) Write(zxid int64, records []AuditRecord) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if zxid <= al.lastZxid || len(records) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	for _, record := range records {
+		if err := e.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(b.Len()) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := al.file.Write(b.Bytes())
+	al.size += int64(n)
+	if err != nil {
+		return err
+	}
+	al.lastZxid = zxid
+	al.dirty = true
+	return nil
+}
+
+// Flush the records written so far to disk, if there are any not yet flushed.
+func (al *AuditLog) Sync() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if !al.dirty {
+		return nil
+	}
+	if err := al.file.Sync(); err != nil {
+		return err
+	}
+	al.dirty = false
+	return nil
+}
+
+// Flush the audit log to disk and close it.
+func (al *AuditLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if err := al.file.Sync(); err != nil {
+		al.file.Close()
+		return err
+	}
+	return al.file.Close()
+}
+
+// Queue an audit record for the request being applied, to be written once it has been applied. Must hold pn.mu.
+func (pn *PanServer) audit(op string, sessionId int, path rpc.Ppath, oldVersion rpc.Pversion, newVersion rpc.Pversion, err rpc.Err) {
+	if pn.opts.AuditLog == nil {
+		return
+	}
+	pn.auditRecords = append(pn.auditRecords, AuditRecord{
+		Zxid:       pn.zxid,
+		Time:       pn.applyTime,
+		Session:    sessionId,
+		Identity:   pn.sessionIdentities[sessionId],
+		Op:         op,
+		Path:       path,
+		OldVersion: oldVersion,
+		NewVersion: newVersion,
+		Err:        err,
+	})
+}
+
+// Write the audit records queued while applying the last request.
+func (pn *PanServer) flushAudit() {
+	if pn.opts.AuditLog == nil {
+		return
+	}
+
+	pn.mu.Lock()
+	zxid, records := pn.zxid, pn.auditRecords
+	pn.auditRecords = nil
+	pn.mu.Unlock()
+
+	if err := pn.opts.AuditLog.Write(zxid, records); err != nil {
+		pn.log(dError, slog.LevelError, "failed to write audit log", "zxid", zxid, "err", err)
+	}
+}
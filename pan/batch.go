@@ -0,0 +1,72 @@
+package pan
+
+import (
+	"pan/panapi/rpc"
+	"reflect"
+	"time"
+)
+
+// A Session pipelines its asynchronous calls by sending them in batches, one batch in flight at a time, while later
+// calls queue up for the next batch. Each batch is a single Raft entry whose requests are applied in order, so a
+// session's requests take effect and complete in the order they were made, however many are in flight.
+//
+// A batch that got no reply may or may not have been applied, so the PanServer remembers the replies to each session's
+// last batch, and answers a retry of it from them instead of applying it twice.
+
+// The replies to a session's last batch, kept in snapshots so that retries are answered the same after a restart
+type BatchState struct {
+	BatchId int64
+	Replies []any
+}
+
+// Apply a batch of requests from one session.
+func (pn *PanServer) Batch(args *rpc.BatchArgs, reply *rpc.BatchReply) {
+	res, ok := pn.submit(*args)
+
+	if !ok {
+		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
+	} else {
+		*reply = *(res.(*rpc.BatchReply))
+	}
+}
+
+func (pn *PanServer) applyBatch(args *rpc.BatchArgs, reply *rpc.BatchReply, timestamp time.Time) {
+	pn.mu.Lock()
+	live := pn.checkSession(args.SessionId, timestamp)
+	last, seen := pn.batches[args.SessionId]
+	pn.mu.Unlock()
+
+	if !live {
+		reply.Err = rpc.ErrSessionClosed
+		return
+	}
+	if seen && args.BatchId <= last.BatchId {
+		// Only the last batch is kept; the session never retries an older one once it sends a newer one
+		reply.Replies = last.Replies
+		reply.Err = rpc.OK
+		return
+	}
+
+	reply.Replies = make([]any, len(args.Requests))
+	for i, req := range args.Requests {
+		if !batchable(req) {
+			continue
+		}
+		reply.Replies[i] = reflect.ValueOf(pn.apply(req, timestamp)).Elem().Interface()
+	}
+	reply.Err = rpc.OK
+
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	pn.batches[args.SessionId] = BatchState{BatchId: args.BatchId, Replies: reply.Replies}
+}
+
+// Returns whether a request may be part of a batch.
+func batchable(req any) bool {
+	switch req.(type) {
+	case rpc.CreateArgs, rpc.DeleteArgs, rpc.ExistsArgs, rpc.GetDataArgs, rpc.SetDataArgs, rpc.GetChildrenArgs:
+		return true
+	}
+	return false
+}
@@ -1,25 +1,43 @@
 package pan
 
 import (
-	// "fmt"
-
+	"context"
+	"log/slog"
+	mrand "math/rand/v2"
 	"pan/panapi"
 	"pan/panapi/rpc"
-	"strconv"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"time"
-
-	tester "6.5840/tester1"
 )
 
+// A Transport delivers a Session's RPCs to PanServers by name.
+// tester.Clnt implements it on top of the labrpc simulator, and TCPTransport over real sockets.
+type Transport interface {
+	Call(server string, method string, args any, reply any) bool
+}
+
 type Session struct {
-	clnt              *tester.Clnt
-	servers           []string
+	clnt              Transport
+	servers           []string // guarded by mu; replaced when the membership changes if opts.FollowConfig is set
 	id                int
+	started           bool          // whether the servers have assigned id
+	timeout           time.Duration // session timeout negotiated by the servers
 	keepAliveInterval time.Duration
 	leader            int
+	metrics           *Metrics
+	minBackoff        time.Duration
+	maxBackoff        time.Duration
 
 	mu sync.Mutex
+
+	// Asynchronous calls
+	asyncMu     sync.Mutex
+	asyncQueue  []asyncCall
+	dispatching bool  // whether a dispatcher is sending asyncQueue
+	batchId     int64 // id of the last batch sent; only used by the dispatcher
 }
 
 type Pan struct{}
@@ -40,87 +58,258 @@ func (ck *Session) incrementLeader() int {
 	return ck.leader
 }
 
-// Create a new znode with flags; return the name of the new znode
+// Returns the address of server i, wrapping around in case the server list shrank.
+func (ck *Session) serverAt(i int) string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.servers[i%len(ck.servers)]
+}
+
+// Log msg on a topic with this session's id attached, once the session has one.
+func (ck *Session) log(topic logTopic, level slog.Level, msg string, attrs ...any) {
+	if ck.started {
+		attrs = append([]any{"session", ck.id}, attrs...)
+	}
+	panLog(topic, level, msg, attrs...)
+}
+
+// Point the session at the server at addr, the leader according to a server that turned a call away.
+// Returns false if addr is not in the server list.
+func (ck *Session) setLeader(addr string) bool {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	i := slices.Index(ck.servers, addr)
+	if i == -1 {
+		return false
+	}
+	ck.leader = i
+	return true
+}
+
+// Returns how long to wait before retry number attempt of a call: exponential in attempt, from minBackoff up to
+// maxBackoff, randomized over its upper half so that sessions turned away together don't retry together.
+func (ck *Session) backoff(attempt int) time.Duration {
+	delay := ck.maxBackoff
+	if attempt < 32 && ck.minBackoff<<attempt < ck.maxBackoff {
+		delay = ck.minBackoff << attempt
+	}
+	return delay/2 + mrand.N(delay/2+1)
+}
+
+// Returns the Err for a context that is done: ErrTimeout if its deadline passed and ErrCanceled if it was canceled.
+// Returns OK if ctx is not done.
+func ctxErr(ctx context.Context) rpc.Err {
+	switch ctx.Err() {
+	case nil:
+		return rpc.OK
+	case context.DeadlineExceeded:
+		return rpc.ErrTimeout
+	}
+	return rpc.ErrCanceled
+}
+
+// Call method on the current leader, giving up if ctx is done first. Returns whether the server replied, or the
+// Err for ctx if the call was abandoned. An abandoned call may still reach the server and take effect.
+func (ck *Session) call(ctx context.Context, method string, args any, reply any) (bool, rpc.Err) {
+	server := ck.serverAt(ck.getLeader())
+	if ctx.Done() == nil {
+		return ck.clnt.Call(server, method, args, reply), rpc.OK
+	}
+	if err := ctxErr(ctx); err != rpc.OK {
+		return false, err
+	}
+
+	// Call into a reply of our own, so that an abandoned call can't write to the caller's
+	res := reflect.New(reflect.TypeOf(reply).Elem())
+	done := make(chan bool, 1)
+	go func() {
+		done <- ck.clnt.Call(server, method, args, res.Interface())
+	}()
+	select {
+	case ok := <-done:
+		reflect.ValueOf(reply).Elem().Set(res.Elem())
+		return ok, rpc.OK
+	case <-ctx.Done():
+		return false, ctxErr(ctx)
+	}
+}
+
+// Move on to another server after attempt number attempt of a call to method got no reply (ok is false) or
+// ErrWrongLeader, and wait before retrying. If the server that turned the call away hinted at the leader, move to it,
+// without waiting if this is the call's first retry. Returns the Err for ctx if it is done before the wait is over.
+func (ck *Session) retry(ctx context.Context, method string, ok bool, hint string, attempt int) rpc.Err {
+	if ok {
+		ck.metrics.Inc("pan_client_wrong_leader_retries_total", method)
+	} else {
+		ck.metrics.Inc("pan_client_rpc_failures_total", method)
+	}
+	ck.log(dClient, slog.LevelDebug, "retrying", "op", method, "server", ck.serverAt(ck.getLeader()), "replied", ok, "hint", hint)
+	if ok && hint != rpc.NoLeader && ck.setLeader(hint) {
+		if attempt == 0 {
+			return ctxErr(ctx)
+		}
+	} else {
+		ck.incrementLeader()
+	}
+
+	timer := time.NewTimer(ck.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return rpc.OK
+	case <-ctx.Done():
+		return ctxErr(ctx)
+	}
+}
+
+// Create a new znode with flags; return the name of the new znode.
+// Ephemeral sequential znodes are always created in protected mode.
 func (ck *Session) Create(path rpc.Ppath, data string, flags rpc.Flag) (rpc.Ppath, rpc.Err) {
+	return ck.CreateCtx(context.Background(), path, data, flags)
+}
+
+// Like Create, but gives up once ctx is done.
+func (ck *Session) CreateCtx(ctx context.Context, path rpc.Ppath, data string, flags rpc.Flag) (rpc.Ppath, rpc.Err) {
 	args := rpc.CreateArgs{SessionId: ck.id, Path: path, Data: data, Flags: flags}
 
+	if flags.Ephemeral && flags.Sequential {
+		args.Flags.Protected = true
+	}
+	if args.Flags.Protected {
+		args.Guid = protectedGuid(flags)
+	}
+
 	var oldSeqNum int
-	if flags.Sequential {
-		oldSeqNum, _ = ck.getHighestSequence(path)
+	if flags.Sequential && !args.Flags.Protected {
+		var err rpc.Err
+		if oldSeqNum, err = ck.getHighestSequence(ctx, path); err == rpc.ErrTimeout || err == rpc.ErrCanceled {
+			return "", err
+		}
 	}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.CreateReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.Create", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.Create", &args, &reply)
+		if err != rpc.OK {
+			return "", err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
 			// If the znode already exists, but we created it, return OK. This may come up in crash cases.
 			if reply.Err == rpc.ErrOnCreate && reply.CreatedBy == ck.id {
 				return reply.ZNodeName, rpc.OK
 			}
 
-			// fmt.Printf("client with session id %d created %v, with error %v\n", ck.id, reply.ZNodeName, reply.Err)
+			ck.log(dClient, slog.LevelDebug, "created", "path", reply.ZNodeName, "err", reply.Err)
 			return reply.ZNodeName, reply.Err
 		}
 
 		// If we did not get a response, figure out if our znode was actually created.
 		// If it was, return. Otherwise, retry.
 		if !ok {
-			if flags.Sequential {
-				newSeqNum, _ := ck.getHighestSequence(path)
+			if args.Flags.Protected {
+				if name, found := ck.findProtected(ctx, path, args.Guid); found {
+					return name, rpc.OK
+				}
+			} else if flags.Sequential {
+				newSeqNum, _ := ck.getHighestSequence(ctx, path)
 				if newSeqNum > oldSeqNum {
-					updatedPath := path + rpc.Ppath(strconv.Itoa(newSeqNum))
+					updatedPath := path + rpc.Ppath(rpc.SeqSuffix(newSeqNum))
 					return updatedPath, reply.Err
 				}
 			}
 		}
 
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "Create", ok, reply.Leader, attempt); err != rpc.OK {
+			return "", err
+		}
 	}
 }
 
+// Returns the GUID for a protected create with flags: the caller's, or a fresh one.
+func protectedGuid(flags rpc.Flag) string {
+	if flags.Guid != "" {
+		return flags.Guid
+	}
+	return rpc.NewGuid()
+}
+
+// Helper function for finding a protected znode created with the given GUID, by listing the parent of path.
+// Returns the full path of the znode and true if it exists.
+func (ck *Session) findProtected(ctx context.Context, path rpc.Ppath, guid string) (rpc.Ppath, bool) {
+	parent := path.Parent()
+	children, err := ck.GetChildrenCtx(ctx, parent, rpc.Watch{})
+	if err != rpc.OK {
+		return "", false
+	}
+
+	prefix := rpc.ProtectedName(guid, "")
+	for _, child := range children {
+		if strings.HasPrefix(string(child), prefix) {
+			return parent + "/" + child, true
+		}
+	}
+	return "", false
+}
+
 // Helper function for getting the highest sequence number of one of our sequential znodes with a given path.
-func (ck *Session) getHighestSequence(path rpc.Ppath) (int, rpc.Err) {
+func (ck *Session) getHighestSequence(ctx context.Context, path rpc.Ppath) (int, rpc.Err) {
 	args := rpc.GetHighestSeqArgs{SessionId: ck.id, Path: path}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.GetHighestSeqReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.GetHighestSequence", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.GetHighestSequence", &args, &reply)
+		if err != rpc.OK {
+			return 0, err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
 			return reply.SeqNum, reply.Err
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "GetHighestSequence", ok, reply.Leader, attempt); err != rpc.OK {
+			return 0, err
+		}
 	}
 }
 
 // Deletes the given znode if it is at the expected version
 func (ck *Session) Delete(path rpc.Ppath, version rpc.Pversion) rpc.Err {
+	return ck.DeleteCtx(context.Background(), path, version)
+}
+
+// Like Delete, but gives up once ctx is done.
+func (ck *Session) DeleteCtx(ctx context.Context, path rpc.Ppath, version rpc.Pversion) rpc.Err {
 	args := rpc.DeleteArgs{SessionId: ck.id, Path: path, Version: version}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.DeleteReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.Delete", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.Delete", &args, &reply)
+		if err != rpc.OK {
+			return err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
 			return reply.Err
 		}
 
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "Delete", ok, reply.Leader, attempt); err != rpc.OK {
+			return err
+		}
 	}
 }
 
 // Returns true iff the znode at path exists
 func (ck *Session) Exists(path rpc.Ppath, watch rpc.Watch) (bool, rpc.Err) {
+	return ck.ExistsCtx(context.Background(), path, watch)
+}
+
+// Like Exists, but gives up once ctx is done. The watch, if set, outlives ctx.
+func (ck *Session) ExistsCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) (bool, rpc.Err) {
 	args := rpc.ExistsArgs{SessionId: ck.id, Path: path, Watch: watch}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.ExistsReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.Exists", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.Exists", &args, &reply)
+		if err != rpc.OK {
+			return false, err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
 			if watch.ShouldWatch {
 				go ck.WatchWait(reply.WatchId, watch.Callback)
@@ -128,38 +317,59 @@ func (ck *Session) Exists(path rpc.Ppath, watch rpc.Watch) (bool, rpc.Err) {
 
 			return reply.Result, reply.Err
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "Exists", ok, reply.Leader, attempt); err != rpc.OK {
+			return false, err
+		}
 	}
 }
 
 // Wait on a watchId. Called by Exists, GetData, and GetChildren
 func (ck *Session) WatchWait(watchId int, watchCallback func(rpc.WatchArgs)) {
+	ck.WatchWaitCtx(context.Background(), watchId, watchCallback)
+}
+
+// Like WatchWait, but gives up once ctx is done, without calling watchCallback. The watch stays registered on the
+// servers, but its event is dropped when it fires.
+func (ck *Session) WatchWaitCtx(ctx context.Context, watchId int, watchCallback func(rpc.WatchArgs)) rpc.Err {
 	args := rpc.WatchWaitArgs{SessionId: ck.id, WatchId: watchId}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.WatchWaitReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.WatchWait", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.WatchWait", &args, &reply)
+		if err != rpc.OK {
+			return err
+		}
+		if ok && reply.Err == rpc.ErrWatchPending {
+			// The server's long poll ended before the watch fired; wait again without backing off
+			attempt = -1
+			continue
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
 			// Call the watch callback
 			watchCallback(reply.WatchEvent)
-			return
+			return rpc.OK
+		}
+		if err := ck.retry(ctx, "WatchWait", ok, rpc.NoLeader, attempt); err != rpc.OK {
+			return err
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
 	}
-
 }
 
 // Returns the data and version information about znode
 func (ck *Session) GetData(path rpc.Ppath, watch rpc.Watch) (string, rpc.Pversion, rpc.Err) {
+	return ck.GetDataCtx(context.Background(), path, watch)
+}
+
+// Like GetData, but gives up once ctx is done. The watch, if set, outlives ctx.
+func (ck *Session) GetDataCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) (string, rpc.Pversion, rpc.Err) {
 	args := rpc.GetDataArgs{SessionId: ck.id, Path: path, Watch: watch}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.GetDataReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.GetData", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.GetData", &args, &reply)
+		if err != rpc.OK {
+			return "", 0, err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
 			if watch.ShouldWatch {
 				go ck.WatchWait(reply.WatchId, watch.Callback)
@@ -167,75 +377,179 @@ func (ck *Session) GetData(path rpc.Ppath, watch rpc.Watch) (string, rpc.Pversio
 
 			return reply.Data, reply.Version, reply.Err
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "GetData", ok, reply.Leader, attempt); err != rpc.OK {
+			return "", 0, err
+		}
 	}
 }
 
 // Writes data to path iff version number is correct
 func (ck *Session) SetData(path rpc.Ppath, data string, version rpc.Pversion) rpc.Err {
+	return ck.SetDataCtx(context.Background(), path, data, version)
+}
+
+// Like SetData, but gives up once ctx is done.
+func (ck *Session) SetDataCtx(ctx context.Context, path rpc.Ppath, data string, version rpc.Pversion) rpc.Err {
 	args := rpc.SetDataArgs{SessionId: ck.id, Path: path, Data: data, Version: version}
 	reply := rpc.SetDataReply{}
 
-	leader := ck.getLeader()
-	ok := ck.clnt.Call(ck.servers[leader], "PanServer.SetData", &args, &reply)
+	ok, err := ck.call(ctx, "PanServer.SetData", &args, &reply)
+	if err != rpc.OK {
+		return err
+	}
 	if ok && reply.Err != rpc.ErrWrongLeader {
 		return reply.Err
 	}
+	if err := ck.retry(ctx, "SetData", ok, reply.Leader, 0); err != rpc.OK {
+		return err
+	}
 
-	for {
+	for attempt := 1; ; attempt++ {
 		reply := rpc.SetDataReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.SetData", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.SetData", &args, &reply)
+		if err != rpc.OK {
+			return err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
 			if reply.Err == rpc.ErrVersion {
 				return rpc.ErrMaybe
 			}
 			return reply.Err
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "SetData", ok, reply.Leader, attempt); err != rpc.OK {
+			return err
+		}
 	}
 }
 
 // Returns an alphabetically sorted list of child znodes
 func (ck *Session) GetChildren(path rpc.Ppath, watch rpc.Watch) ([]rpc.Ppath, rpc.Err) {
+	return ck.GetChildrenCtx(context.Background(), path, watch)
+}
+
+// Like GetChildren, but gives up once ctx is done. The watch, if set, outlives ctx.
+func (ck *Session) GetChildrenCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) ([]rpc.Ppath, rpc.Err) {
 	args := rpc.GetChildrenArgs{SessionId: ck.id, Path: path, Watch: watch}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.GetChildrenReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.GetChildren", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.GetChildren", &args, &reply)
+		if err != rpc.OK {
+			return nil, err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
-			if watch.ShouldWatch {
+			// No watch is set on a znode that doesn't exist
+			if watch.ShouldWatch && reply.Err == rpc.OK {
 				go ck.WatchWait(reply.WatchId, watch.Callback)
 			}
 
 			return reply.Children, reply.Err
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "GetChildren", ok, reply.Leader, attempt); err != rpc.OK {
+			return nil, err
+		}
+	}
+}
+
+// Change the ensemble's membership, as a "role.N=address" line per server joining or moving and a "role.N" id per server
+// leaving. fromVersion is the version of rpc.ConfigPath the change is based on, or -1 to change any version.
+// Returns the version of rpc.ConfigPath after the change.
+func (ck *Session) Reconfig(joining []string, leaving []string, fromVersion rpc.Pversion) (rpc.Pversion, rpc.Err) {
+	return ck.ReconfigCtx(context.Background(), joining, leaving, fromVersion)
+}
+
+// Like Reconfig, but gives up once ctx is done.
+func (ck *Session) ReconfigCtx(ctx context.Context, joining []string, leaving []string, fromVersion rpc.Pversion) (rpc.Pversion, rpc.Err) {
+	args := rpc.ReconfigArgs{SessionId: ck.id, Joining: joining, Leaving: leaving, FromVersion: fromVersion}
+
+	reply := rpc.ReconfigReply{}
+	ok, err := ck.call(ctx, "PanServer.Reconfig", &args, &reply)
+	if err != rpc.OK {
+		return 0, err
+	}
+	if ok && reply.Err != rpc.ErrWrongLeader {
+		return reply.Version, reply.Err
+	}
+	if err := ck.retry(ctx, "Reconfig", ok, reply.Leader, 0); err != rpc.OK {
+		return 0, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		reply := rpc.ReconfigReply{}
+		ok, err := ck.call(ctx, "PanServer.Reconfig", &args, &reply)
+		if err != rpc.OK {
+			return 0, err
+		}
+		if ok && reply.Err != rpc.ErrWrongLeader {
+			// Like SetData, a retry can fail the version check because the first attempt succeeded
+			if reply.Err == rpc.ErrVersion && fromVersion != -1 {
+				return reply.Version, rpc.ErrMaybe
+			}
+			return reply.Version, reply.Err
+		}
+		if err := ck.retry(ctx, "Reconfig", ok, reply.Leader, attempt); err != rpc.OK {
+			return 0, err
+		}
+	}
+}
+
+// Read the membership, replace the server list with it, and watch it for the next change.
+func (ck *Session) watchConfig() {
+	data, _, err := ck.GetData(rpc.ConfigPath, rpc.Watch{ShouldWatch: true, Callback: func(rpc.WatchArgs) { go ck.watchConfig() }})
+	if err != rpc.OK {
+		// The watch fires once the config is first written
+		return
+	}
+
+	membership, perr := rpc.ParseMembership(data)
+	if perr != nil || len(membership.Servers()) == 0 {
+		ck.log(dClient, slog.LevelWarn, "ignoring bad membership", "data", data)
+		return
 	}
+
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.servers = membership.Servers()
+	ck.leader %= len(ck.servers)
+	ck.log(dClient, slog.LevelInfo, "servers changed", "servers", ck.servers)
 }
 
 // Waits for all updates pending at the start of the operation to propogate to the server that client is connected to
 func (ck *Session) Sync(path rpc.Ppath) rpc.Err {
-	return rpc.OK
+	return ck.SyncCtx(context.Background(), path)
+}
+
+// Like Sync, but gives up once ctx is done.
+func (ck *Session) SyncCtx(ctx context.Context, path rpc.Ppath) rpc.Err {
+	return ctxErr(ctx)
+}
+
+// Returns the session timeout negotiated when the session started.
+func (ck *Session) SessionTimeout() time.Duration {
+	return ck.timeout
 }
 
 // End the current session
 func (ck *Session) EndSession() {
+	ck.EndSessionCtx(context.Background())
+}
+
+// Like EndSession, but gives up once ctx is done. The session may then stay open until it times out.
+func (ck *Session) EndSessionCtx(ctx context.Context) rpc.Err {
 	args := rpc.EndSessionArgs{SessionId: ck.id}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		reply := rpc.EndSessionReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.EndSession", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.EndSession", &args, &reply)
+		if err != rpc.OK {
+			return err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
-			return
+			return rpc.OK
+		}
+		if err := ck.retry(ctx, "EndSession", ok, reply.Leader, attempt); err != rpc.OK {
+			return err
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -247,35 +561,95 @@ func (ck *Session) maintainSession() {
 		reply := rpc.KeepAliveReply{}
 		time.Sleep(ck.keepAliveInterval)
 		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.KeepAlive", &args, &reply)
+		ok := ck.clnt.Call(ck.serverAt(leader), "PanServer.KeepAlive", &args, &reply)
 		if reply.Err == rpc.ErrSessionClosed {
+			ck.log(dClient, slog.LevelInfo, "session closed; stopping keepalives")
 			break
 		}
 
 		if !ok || reply.Err == rpc.ErrWrongLeader {
-			ck.incrementLeader()
+			if ok {
+				ck.metrics.Inc("pan_client_wrong_leader_retries_total", "KeepAlive")
+			} else {
+				ck.metrics.Inc("pan_client_rpc_failures_total", "KeepAlive")
+			}
+			if !ok || reply.Leader == rpc.NoLeader || !ck.setLeader(reply.Leader) {
+				ck.incrementLeader()
+			}
 		}
 	}
 }
 
-func MakeSession(clnt *tester.Clnt, servers []string) panapi.IPNSession {
-	ck := &Session{clnt: clnt, servers: servers, keepAliveInterval: 100 * time.Millisecond}
+// Options for a Session that are not part of MakeSession's interface
+type SessionOptions struct {
+	// Where the Session records its metrics. Nil to record none.
+	Metrics *Metrics
+
+	// Who the client is, recorded in the servers' audit logs with every change the session makes
+	Identity string
+
+	// Watch rpc.ConfigPath and replace the server list with the membership whenever it changes
+	FollowConfig bool
+
+	// Bounds on the delay between retries of a call that no server accepted; zero for DefaultMinBackoff and
+	// DefaultMaxBackoff. The delay doubles with each retry, and is jittered.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+const (
+	DefaultMinBackoff = 10 * time.Millisecond
+	DefaultMaxBackoff = time.Second
+)
+
+func MakeSession(clnt Transport, servers []string) panapi.IPNSession {
+	return MakeSessionWithOptions(clnt, servers, SessionOptions{})
+}
+
+// Like MakeSession, but with options.
+func MakeSessionWithOptions(clnt Transport, servers []string, opts SessionOptions) panapi.IPNSession {
+	ck, _ := MakeSessionCtx(context.Background(), clnt, servers, opts)
+	return ck
+}
+
+// Like MakeSessionWithOptions, but gives up once ctx is done, returning a nil session. The servers may then have
+// started a session that nobody will use, which expires after the session timeout.
+func MakeSessionCtx(ctx context.Context, clnt Transport, servers []string, opts SessionOptions) (panapi.IPNSession, rpc.Err) {
+	ck := &Session{clnt: clnt, servers: servers, keepAliveInterval: 100 * time.Millisecond, metrics: opts.Metrics, minBackoff: opts.MinBackoff, maxBackoff: opts.MaxBackoff}
+	if ck.minBackoff == 0 {
+		ck.minBackoff = DefaultMinBackoff
+	}
+	if ck.maxBackoff == 0 {
+		ck.maxBackoff = DefaultMaxBackoff
+	}
 
 	// Notify the server of a new session
-	args := rpc.StartSessionArgs{}
-	for {
+	args := rpc.StartSessionArgs{Identity: opts.Identity}
+	for attempt := 0; ; attempt++ {
 		reply := rpc.StartSessionReply{}
-		leader := ck.getLeader()
-		ok := ck.clnt.Call(ck.servers[leader], "PanServer.StartSession", &args, &reply)
+		ok, err := ck.call(ctx, "PanServer.StartSession", &args, &reply)
+		if err != rpc.OK {
+			return nil, err
+		}
 		if ok && reply.Err != rpc.ErrWrongLeader {
-			ck.id = reply.SessionId
+			ck.id, ck.started = reply.SessionId, true
+			ck.timeout = reply.Timeout
+			// Leave time for a couple of keepalives to fail over to another server before the session expires
+			if ck.timeout > 0 {
+				ck.keepAliveInterval = min(ck.keepAliveInterval, ck.timeout/3)
+			}
+			ck.log(dClient, slog.LevelDebug, "started session", "server", ck.serverAt(ck.getLeader()))
 			break
 		}
-		ck.incrementLeader()
-		time.Sleep(100 * time.Millisecond)
+		if err := ck.retry(ctx, "StartSession", ok, reply.Leader, attempt); err != rpc.OK {
+			return nil, err
+		}
 	}
 
 	go ck.maintainSession()
+	if opts.FollowConfig {
+		ck.watchConfig()
+	}
 
-	return ck
+	return ck, rpc.OK
 }
@@ -0,0 +1,61 @@
+package pan
+
+import (
+	"log/slog"
+	"pan/panapi/rpc"
+	"time"
+)
+
+// Group commit: with opts.BatchWindow set, submit holds each request for up to BatchWindow, so that requests from
+// concurrent sessions that arrive together share a single Raft entry, a TimestampedBatch. DoOp applies a batch's
+// requests in order, each with its own zxid, exactly as if they had been submitted one at a time, so observers and the
+// audit log never see the batch. A lone request waits out the window too, so the window trades latency for throughput.
+
+type TimestampedBatch struct {
+	Requests []TimestampedRequest
+}
+
+// A request waiting for its group to be committed
+type pendingRequest struct {
+	tsReq TimestampedRequest
+	reply chan any // receives the reply from DoOp, or nil if this server is not the leader
+}
+
+// Add a request to the group being collected, starting a new group if there is none, and wait for it to be applied.
+// Returns the reply from DoOp, or false if this server is not the leader.
+func (pn *PanServer) submitGrouped(tsReq TimestampedRequest) (any, bool) {
+	pending := pendingRequest{tsReq: tsReq, reply: make(chan any, 1)}
+
+	pn.groupMu.Lock()
+	pn.group = append(pn.group, pending)
+	if len(pn.group) == 1 {
+		time.AfterFunc(pn.opts.BatchWindow, pn.commitGroup)
+	}
+	pn.groupMu.Unlock()
+
+	reply := <-pending.reply
+	return reply, reply != nil
+}
+
+// Submit the group collected during the last window as one Raft entry, and hand each request its reply.
+func (pn *PanServer) commitGroup() {
+	pn.groupMu.Lock()
+	group := pn.group
+	pn.group = nil
+	pn.groupMu.Unlock()
+
+	batch := TimestampedBatch{Requests: make([]TimestampedRequest, len(group))}
+	for i, pending := range group {
+		batch.Requests[i] = pending.tsReq
+	}
+
+	err, res := pn.rsm.Submit(batch)
+	replies, ok := res.([]any)
+	if err == rpc.ErrWrongLeader || !ok {
+		replies = make([]any, len(group))
+	}
+	pn.log(dCommit, slog.LevelDebug, "committed group", "requests", len(group), "err", err)
+	for i, pending := range group {
+		pending.reply <- replies[i]
+	}
+}
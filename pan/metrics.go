@@ -0,0 +1,229 @@
+package pan
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics collects counters, gauges, and latency histograms for a PanServer or Session,
+// and writes them in the Prometheus text exposition format.
+// A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	mu         sync.Mutex
+	values     map[string]map[string]float64 // counters and gauges, by metric name and label value
+	histograms map[string]map[string]*histogram
+	gaugeFuncs map[string]func() float64
+}
+
+type metricDesc struct {
+	name  string
+	typ   string // counter, gauge, or histogram
+	label string // name of the metric's single label, or empty for none
+	help  string
+}
+
+// Every metric Pan exports, in the order they are written. A server's apply histogram and session and watch
+// counters only cover requests it submitted since it started, so summing them across the ensemble counts each once.
+var metricDescs = []metricDesc{
+	{"pan_rpc_submit_seconds", "histogram", "op", "Time an RPC handler waited in rsm.Submit for its request to commit and apply."},
+	{"pan_rpc_apply_seconds", "histogram", "op", "Time spent applying a committed request this server submitted in DoOp."},
+	{"pan_rpc_wrong_leader_total", "counter", "op", "RPCs rejected with ErrWrongLeader by this server."},
+	{"pan_sessions_created_total", "counter", "", "Sessions started."},
+	{"pan_sessions_closed_total", "counter", "", "Sessions ended by their client."},
+	{"pan_sessions_expired_total", "counter", "", "Sessions ended by timing out."},
+	{"pan_watches_registered_total", "counter", "type", "Watches registered, by event type."},
+	{"pan_watches_fired_total", "counter", "type", "Watches fired, by event type."},
+	{"pan_znode_count", "gauge", "", "Number of znodes, including the root."},
+	{"pan_snapshot_size_bytes", "gauge", "", "Size of the most recent snapshot."},
+	{"pan_client_wrong_leader_retries_total", "counter", "op", "Session RPCs retried after an ErrWrongLeader reply."},
+	{"pan_client_rpc_failures_total", "counter", "op", "Session RPCs retried after getting no reply."},
+}
+
+// Upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // counts[i] is the number of observations <= latencyBuckets[i]
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func MakeMetrics() *Metrics {
+	return &Metrics{
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+		gaugeFuncs: make(map[string]func() float64),
+	}
+}
+
+// Add one to a counter.
+func (m *Metrics) Inc(name string, label string) {
+	m.Add(name, label, 1)
+}
+
+// Add delta to a counter.
+func (m *Metrics) Add(name string, label string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][label] += delta
+}
+
+// Set a gauge.
+func (m *Metrics) Set(name string, label string, v float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][label] = v
+}
+
+// Compute an unlabeled gauge with f whenever the metrics are written.
+// f is called without holding the Metrics lock, so it may take locks that are held while recording metrics.
+func (m *Metrics) SetGaugeFunc(name string, f func() float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gaugeFuncs[name] = f
+}
+
+// Record a latency in a histogram.
+func (m *Metrics) Observe(name string, label string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	h, ok := m.histograms[name][label]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.histograms[name][label] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// Render the label set for a sample, with an optional extra le label for histogram buckets.
+func labels(desc metricDesc, value string, le string) string {
+	pairs := []string{}
+	if desc.label != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", desc.label, value))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	s := "{" + pairs[0]
+	for _, pair := range pairs[1:] {
+		s += "," + pair
+	}
+	return s + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write every metric with at least one sample in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	funcs := make(map[string]func() float64)
+	for name, f := range m.gaugeFuncs {
+		funcs[name] = f
+	}
+	m.mu.Unlock()
+
+	gauges := make(map[string]float64)
+	for name, f := range funcs {
+		gauges[name] = f()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, desc := range metricDescs {
+		values, isValue := m.values[desc.name]
+		histograms, isHistogram := m.histograms[desc.name]
+		gauge, isGauge := gauges[desc.name]
+		if !isValue && !isHistogram && !isGauge {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", desc.name, desc.help, desc.name, desc.typ); err != nil {
+			return err
+		}
+		if isGauge {
+			fmt.Fprintf(w, "%s %s\n", desc.name, formatFloat(gauge))
+		}
+		for _, label := range sortedKeys(values) {
+			fmt.Fprintf(w, "%s%s %s\n", desc.name, labels(desc, label, ""), formatFloat(values[label]))
+		}
+		for _, label := range sortedKeys(histograms) {
+			h := histograms[label]
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", desc.name, labels(desc, label, formatFloat(bound)), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", desc.name, labels(desc, label, "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", desc.name, labels(desc, label, ""), formatFloat(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", desc.name, labels(desc, label, ""), h.count)
+		}
+	}
+	return nil
+}
+
+// Serve the metrics to a Prometheus scrape.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(w)
+}
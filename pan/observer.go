@@ -0,0 +1,263 @@
+package pan
+
+import (
+	"log/slog"
+	"pan/panapi/rpc"
+	"reflect"
+	"sync"
+	"time"
+
+	"6.5840/labrpc"
+	tester "6.5840/tester1"
+)
+
+// An observer is a PanServer that is not part of the Raft group: it never votes and never counts toward a commit
+// quorum, so adding observers, even in a remote datacenter, does not slow down commits.
+//
+// Instead of reading a Raft log, an observer pulls the requests the voters have applied, in zxid order, with the Follow
+// RPC, and applies them with DoOp just like a voter does. A voter keeps the last observerLogSize requests it applied;
+// an observer that falls further behind gets a snapshot instead. The observer serves Exists, GetData and GetChildren
+// from its own copy of the tree and forwards everything else to the voters, waiting until it has applied each
+// forwarded request before it replies, so a client always reads its own writes.
+//
+// Reads on an observer are local: they do not refresh the session timeout (keepalives are forwarded and do), and their
+// watches get negative ids from a local counter, so they never collide with watches registered through Raft.
+
+const (
+	observerLogSize      = 1000
+	observerBatchSize    = 100
+	observerPollInterval = 10 * time.Millisecond
+	forwardTimeout       = 2 * time.Second
+)
+
+// How an observer reaches a voter: through a labrpc ClientEnd in the tester, or a tcpVoter over TCP.
+type voterEnd interface {
+	Call(method string, args any, reply any) bool
+}
+
+type observer struct {
+	voters   []voterEnd
+	followed int // voter the observer is pulling requests from; only used by follow
+
+	mu     sync.Mutex
+	leader int // voter that last accepted a forwarded request
+
+	nextLocalWatchId int // guarded by pn.mu
+}
+
+type FollowArgs struct {
+	AfterZxid int64
+}
+
+type FollowReply struct {
+	FirstZxid int64                // zxid of Entries[0]
+	Entries   []TimestampedRequest // applied requests after AfterZxid, in order
+	Snapshot  []byte               // set instead of Entries when the requests after AfterZxid are no longer kept
+	Err       rpc.Err
+}
+
+type ForwardArgs struct {
+	Request any
+}
+
+type ForwardReply struct {
+	Reply  any   // the reply DoOp produced, by value
+	Zxid   int64 // a zxid at which the request had been applied
+	Leader int   // with ErrWrongLeader, the index among the voters of the leader, or -1 if unknown
+	Err    rpc.Err
+}
+
+// Remember an applied request for observers to pull. Must hold pn.applyMu.
+func (pn *PanServer) recordApplied(tsReq TimestampedRequest) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	pn.appliedLog = append(pn.appliedLog, tsReq)
+	if len(pn.appliedLog) > 2*observerLogSize {
+		// Trim in batches, copying so the dropped requests can be collected
+		dropped := len(pn.appliedLog) - observerLogSize
+		pn.appliedLog = append([]TimestampedRequest{}, pn.appliedLog[dropped:]...)
+		pn.appliedBase += int64(dropped)
+	}
+	pn.appliedCond.Broadcast()
+}
+
+// Return the requests this server applied after args.AfterZxid, or a snapshot if it no longer has all of them.
+func (pn *PanServer) Follow(args *FollowArgs, reply *FollowReply) {
+	pn.applyMu.Lock()
+	defer pn.applyMu.Unlock()
+
+	pn.mu.Lock()
+	base, applied := pn.appliedBase, pn.appliedLog
+	pn.mu.Unlock()
+
+	reply.Err = rpc.OK
+	if args.AfterZxid < base {
+		reply.Snapshot = pn.Snapshot()
+		return
+	}
+
+	// An observer that last followed a more up-to-date voter may be ahead of this one
+	first := args.AfterZxid - base
+	if first < int64(len(applied)) {
+		end := min(first+observerBatchSize, int64(len(applied)))
+		reply.FirstZxid = args.AfterZxid + 1
+		reply.Entries = append([]TimestampedRequest{}, applied[first:end]...)
+	}
+}
+
+// Submit a request forwarded by an observer, and return its reply with a zxid the observer must reach before replying.
+func (pn *PanServer) Forward(args *ForwardArgs, reply *ForwardReply) {
+	res, ok := pn.submit(args.Request)
+	if !ok {
+		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = -1
+		if leader, _, ok := pn.knownLeader(); ok {
+			reply.Leader = leader
+		}
+		return
+	}
+
+	pn.mu.Lock()
+	reply.Zxid = pn.zxid
+	pn.mu.Unlock()
+	reply.Reply = reflect.ValueOf(res).Elem().Interface()
+	reply.Err = rpc.OK
+}
+
+// Handle a request on an observer: serve reads locally and forward everything else.
+func (pn *PanServer) observe(req any) (any, bool) {
+	switch req := req.(type) {
+	case rpc.ExistsArgs:
+		reply := rpc.ExistsReply{}
+		pn.readLocal(req.SessionId, &reply.Err, func() { pn.exists(&req, &reply, pn.getLocalWatchId) })
+		return &reply, true
+	case rpc.GetDataArgs:
+		reply := rpc.GetDataReply{}
+		pn.readLocal(req.SessionId, &reply.Err, func() { pn.getData(&req, &reply, pn.getLocalWatchId) })
+		return &reply, true
+	case rpc.GetChildrenArgs:
+		reply := rpc.GetChildrenReply{}
+		pn.readLocal(req.SessionId, &reply.Err, func() { pn.getChildren(&req, &reply, pn.getLocalWatchId) })
+		return &reply, true
+	}
+	return pn.forward(req)
+}
+
+// Run a local read for a session, if the session is live as of the last applied request.
+func (pn *PanServer) readLocal(sessionId int, err *rpc.Err, read func()) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	if _, ok := pn.sessions[sessionId]; !ok {
+		*err = rpc.ErrSessionClosed
+		return
+	}
+	read()
+}
+
+// Return the next id for a watch registered by a local read. Must hold pn.mu.
+func (pn *PanServer) getLocalWatchId() int {
+	pn.observer.nextLocalWatchId--
+	return pn.observer.nextLocalWatchId
+}
+
+// Forward a request to the voters, trying each once starting with the last leader.
+// Returns the reply once this observer has applied the request, or false if no voter would take it.
+func (pn *PanServer) forward(req any) (any, bool) {
+	obs := pn.observer
+	for range obs.voters {
+		obs.mu.Lock()
+		leader := obs.leader
+		obs.mu.Unlock()
+
+		args := ForwardArgs{Request: req}
+		reply := ForwardReply{}
+		if obs.voters[leader].Call("PanServer.Forward", &args, &reply) && reply.Err == rpc.OK {
+			if !pn.waitApplied(reply.Zxid) {
+				return nil, false
+			}
+			res := reflect.New(reflect.TypeOf(reply.Reply))
+			res.Elem().Set(reflect.ValueOf(reply.Reply))
+			return res.Interface(), true
+		}
+
+		obs.mu.Lock()
+		if reply.Err == rpc.ErrWrongLeader && reply.Leader >= 0 && reply.Leader < len(obs.voters) {
+			obs.leader = reply.Leader
+		} else {
+			obs.leader = (leader + 1) % len(obs.voters)
+		}
+		obs.mu.Unlock()
+	}
+	pn.log(dLeader, slog.LevelDebug, "no voter accepted a forwarded request", "op", opName(req))
+	return nil, false
+}
+
+// Wait until this server has applied the request at zxid. Returns false if that takes longer than forwardTimeout.
+func (pn *PanServer) waitApplied(zxid int64) bool {
+	timer := time.AfterFunc(forwardTimeout, func() {
+		pn.mu.Lock()
+		defer pn.mu.Unlock()
+		pn.appliedCond.Broadcast()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(forwardTimeout)
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	for pn.zxid < zxid && !pn.killed() && time.Now().Before(deadline) {
+		pn.appliedCond.Wait()
+	}
+	return pn.zxid >= zxid
+}
+
+// Pull applied requests from the voters and apply them, until killed.
+func (pn *PanServer) follow() {
+	obs := pn.observer
+	for !pn.killed() {
+		pn.mu.Lock()
+		args := FollowArgs{AfterZxid: pn.zxid}
+		pn.mu.Unlock()
+
+		reply := FollowReply{}
+		if !obs.voters[obs.followed].Call("PanServer.Follow", &args, &reply) || reply.Err != rpc.OK {
+			obs.followed = (obs.followed + 1) % len(obs.voters)
+			time.Sleep(observerPollInterval)
+			continue
+		}
+
+		if reply.Snapshot != nil {
+			pn.log(dSnap, slog.LevelInfo, "observer catching up from snapshot", "after", args.AfterZxid)
+			pn.Restore(reply.Snapshot)
+			continue
+		}
+
+		if len(reply.Entries) > 0 && reply.FirstZxid == args.AfterZxid+1 {
+			for _, entry := range reply.Entries {
+				pn.DoOp(entry)
+			}
+		} else {
+			time.Sleep(observerPollInterval)
+		}
+	}
+}
+
+// Start an observer of the ensemble whose voters are reached through voters. The observer keeps no state of its own
+// across restarts: it catches up from the voters when it starts. Must return quickly.
+func StartPanObserver(voters []*labrpc.ClientEnd, gid tester.Tgid, me int, persister *tester.Persister, opts ServerOptions) []tester.IService {
+	ends := make([]voterEnd, len(voters))
+	for i, voter := range voters {
+		ends[i] = voter
+	}
+	return []tester.IService{startObserver(voters, ends, me, opts)}
+}
+
+// Make an observer that reaches the voters through ends, and start following them.
+// Of peers, an observer only uses the number of voters, to check Reconfig the way the voters do.
+func startObserver(peers []*labrpc.ClientEnd, ends []voterEnd, me int, opts ServerOptions) *PanServer {
+	pn := makePanServer(peers, me, opts)
+	pn.observer = &observer{voters: ends}
+	go pn.follow()
+	return pn
+}
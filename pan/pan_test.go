@@ -1,9 +1,20 @@
 package pan
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -84,6 +95,41 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+// Deleting a znode with children fails; deleting an ephemeral znode by hand
+// means its session ending no longer touches that path
+func TestDeleteNotEmpty(t *testing.T) {
+	ts := MakeTest(t, "Delete Not Empty", 1, 3, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+	ck := ts.MakeSession()
+	ck.Create("/a/b", "", rpc.Flag{})
+
+	if err := ck.Delete("/a", 1); err != rpc.ErrNotEmpty {
+		ts.t.Fatalf("Deleting /a with a child returned %v; expected %v\n", err, rpc.ErrNotEmpty)
+	}
+	exists, _ := ck.Exists("/a/b", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if !exists {
+		ts.t.Fatal("/a/b should still exist after failed delete of /a\n")
+	}
+	if err := ck.Delete("/a/b", 1); err != rpc.OK {
+		ts.t.Fatalf("Deleting /a/b returned %v\n", err)
+	}
+	if err := ck.Delete("/a", 1); err != rpc.OK {
+		ts.t.Fatalf("Deleting empty /a returned %v\n", err)
+	}
+
+	ck1 := ts.MakeSession()
+	ck1.Create("/c/e", "", rpc.Flag{Ephemeral: true})
+	if err := ck.Delete("/c/e", 1); err != rpc.OK {
+		ts.t.Fatalf("Deleting ephemeral /c/e returned %v\n", err)
+	}
+	ck.Create("/c/e", "", rpc.Flag{})
+	ck1.EndSession()
+	exists, _ = ck.Exists("/c/e", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if !exists {
+		ts.t.Fatal("/c/e was removed when the session that created an earlier ephemeral /c/e ended\n")
+	}
+}
+
 // Have concurrent clients create sequential nodes
 func TestManyClientSequential(t *testing.T) {
 	const (
@@ -94,8 +140,8 @@ func TestManyClientSequential(t *testing.T) {
 	defer ts.Cleanup()
 	ck := ts.MakeSession()
 	zname, err := ck.Create("/a/seq-", "data", rpc.Flag{Sequential: true})
-	if err != rpc.OK || zname != rpc.Ppath("/a/seq-0") {
-		ts.t.Fatalf("Initial sequential znode name was %s; expected /a/seq-0\n", zname)
+	if err != rpc.OK || zname != rpc.Ppath("/a/seq-"+rpc.SeqSuffix(0)) {
+		ts.t.Fatalf("Initial sequential znode name was %s; expected /a/seq-%s\n", zname, rpc.SeqSuffix(0))
 	}
 	cks := make([]panapi.IPNSession, nclients)
 	chs := make([]chan int, nclients)
@@ -117,7 +163,7 @@ func TestManyClientSequential(t *testing.T) {
 	c2 := <-chs[2]
 	total := c0 + c1 + c2 + 1
 	zname, err = ck.Create("/a/seq-", "data", rpc.Flag{Sequential: true})
-	if err != rpc.OK || zname != rpc.Ppath(fmt.Sprintf("/a/seq-%d", total)) {
+	if err != rpc.OK || zname != rpc.Ppath("/a/seq-"+rpc.SeqSuffix(total)) {
 		ts.t.Fatalf("Created %s after %d previous sequential znode creations\n", zname, total)
 	}
 }
@@ -178,11 +224,1039 @@ func TestSequentialMonotonicallyIncreases(t *testing.T) {
 		ts.t.Fatal("/b should have no children after nodes crashed\n")
 	}
 	fname, err := ck.Create(path, "data", rpc.Flag{Sequential: true, Ephemeral: true})
-	if err != rpc.OK || fname != rpc.Ppath(fmt.Sprintf("/b/seq-%d", c0+c1+c2)) {
+	if err != rpc.OK || fname.GetSeqNumber() != c0+c1+c2 {
 		ts.t.Fatalf("Created %s when %d previous ephermeral znodes were created", fname, c0+c1+c2)
 	}
 }
 
+// Sequential children with different names share their parent's counter, so they can be ordered against each other
+func TestSequentialPerDirectory(t *testing.T) {
+	ts := MakeTest(t, "Sequential Counter Per Directory", 1, 3, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+	ck := ts.MakeSession()
+	for _, test := range []struct {
+		name rpc.Ppath
+		seq  int
+	}{
+		{"/a/read-", 0},
+		{"/a/write-", 1},
+		{"/a/read-", 2},
+		{"/b/read-", 0},
+	} {
+		zname, err := ck.Create(test.name, "", rpc.Flag{Sequential: true})
+		expected := test.name + rpc.Ppath(rpc.SeqSuffix(test.seq))
+		if err != rpc.OK || zname != expected {
+			ts.t.Fatalf("Created %s, %v; expected %s", zname, err, expected)
+		}
+	}
+}
+
+// Sequential names are zero-padded, so they sort the same lexically and numerically,
+// and their counter survives snapshots and a restart of every server
+func TestSequentialSnapshot(t *testing.T) {
+	const (
+		NITERS = 30
+	)
+	ts := MakeTest(t, "Sequential Counter Survives Snapshots", 1, 3, true, true, false, false, 1000, false)
+	defer ts.Cleanup()
+	ck := ts.MakeSession()
+	for range NITERS {
+		ck.Create("/a/seq-", "data", rpc.Flag{Sequential: true})
+	}
+	children, _ := ck.GetChildren("/a", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if len(children) != NITERS {
+		ts.t.Fatalf("Expected /a to have %d children; got %d instead", NITERS, len(children))
+	}
+	for i, child := range children {
+		if child.GetSeqNumber() != i {
+			ts.t.Fatalf("Child %d of /a is %s; children are not in sequence order", i, child)
+		}
+	}
+
+	for i := 0; i < ts.nservers; i++ {
+		ts.Group(Gid).ShutdownServer(i)
+	}
+	for i := 0; i < ts.nservers; i++ {
+		ts.Group(Gid).StartServer(i)
+	}
+	ts.Group(Gid).ConnectAll()
+
+	zname, err := ck.Create("/a/seq-", "data", rpc.Flag{Sequential: true})
+	if err != rpc.OK || zname != rpc.Ppath("/a/seq-"+rpc.SeqSuffix(NITERS)) {
+		ts.t.Fatalf("Created %s after restart; expected /a/seq-%s", zname, rpc.SeqSuffix(NITERS))
+	}
+}
+
+// An observer forwards writes, reads its own writes, and fires watches on changes made through the voters
+func TestObserverReadsAndWrites(t *testing.T) {
+	ts := MakeTestObservers(t, "Observer Reads And Writes", 2, 3, 1, true, -1)
+	defer ts.Cleanup()
+	obsCk := ts.MakeObserverSession()
+	voterCk := ts.MakeSessionTo([]int{0, 1, 2})
+
+	if _, err := obsCk.Create("/a", "x", rpc.Flag{}); err != rpc.OK {
+		ts.t.Fatalf("Create through the observer returned %v", err)
+	}
+	data, version, _ := obsCk.GetData("/a", rpc.Watch{})
+	if ok, err := compareGetData("/a", "x", 1, data, version); !ok {
+		ts.t.Fatal(err)
+	}
+
+	fired := make(chan rpc.WatchArgs, 1)
+	obsCk.GetData("/a", rpc.Watch{ShouldWatch: true, Callback: func(event rpc.WatchArgs) { fired <- event }})
+	voterCk.SetData("/a", "y", 1)
+	select {
+	case event := <-fired:
+		if event.EventType != rpc.NodeDataChanged || event.Path != "/a" {
+			ts.t.Fatalf("Observer fired %v on %s; expected %v on /a", event.EventType, event.Path, rpc.NodeDataChanged)
+		}
+	case <-time.After(2 * time.Second):
+		ts.t.Fatalf("Observer never fired the data watch on /a")
+	}
+
+	data, version, _ = obsCk.GetData("/a", rpc.Watch{})
+	if ok, err := compareGetData("/a", "y", 2, data, version); !ok {
+		ts.t.Fatal(err)
+	}
+}
+
+// A restarted observer has no state of its own, and catches up from a voter's snapshot
+func TestObserverSnapshot(t *testing.T) {
+	const (
+		NITERS = 30
+	)
+	ts := MakeTestObservers(t, "Observer Catches Up From Snapshot", 1, 3, 1, true, 1000)
+	defer ts.Cleanup()
+	ck := ts.MakeSessionTo([]int{0, 1, 2})
+	for i := range NITERS {
+		ck.Create(rpc.Ppath(fmt.Sprintf("/s/%d", i)), "data", rpc.Flag{})
+	}
+
+	for i := 0; i < ts.nservers; i++ {
+		ts.Group(Gid).ShutdownServer(i)
+	}
+	for i := 0; i < ts.nservers; i++ {
+		ts.Group(Gid).StartServer(i)
+	}
+	ts.Group(Gid).ConnectAll()
+
+	obsCk := ts.MakeObserverSession()
+	children, err := obsCk.GetChildren("/s", rpc.Watch{})
+	if err != rpc.OK || len(children) != NITERS {
+		ts.t.Fatalf("Observer listed %d children of /s with %v; expected %d", len(children), err, NITERS)
+	}
+}
+
+// Ephemeral sequential creates are protected, so an unreliable network
+// never leaves behind a second znode for the same Create call
+func TestProtectedCreateUnreliable(t *testing.T) {
+	const (
+		NITERS = 30
+	)
+	ts := MakeTest(t, "Protected Create Unreliable", 1, 3, false, false, false, false, -1, false)
+	defer ts.Cleanup()
+	ck := ts.MakeSession()
+	created := make(map[rpc.Ppath]bool)
+	for range NITERS {
+		zname, err := ck.Create("/p/seq-", "data", rpc.Flag{Sequential: true, Ephemeral: true})
+		if err != rpc.OK {
+			ts.t.Fatalf("Protected create returned %v", err)
+		}
+		if !strings.HasPrefix(zname.Suffix(), rpc.ProtectedPrefix) {
+			ts.t.Fatalf("Created %s; expected a protected name", zname)
+		}
+		created[zname] = true
+	}
+	children, _ := ck.GetChildren("/p", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if len(children) != NITERS || len(created) != NITERS {
+		ts.t.Fatalf("Made %d creates; got %d distinct names and %d children of /p", NITERS, len(created), len(children))
+	}
+	for _, child := range children {
+		if !created["/p/"+child] {
+			ts.t.Fatalf("/p/%s was created but never returned by Create", child)
+		}
+	}
+}
+
+// Answers the first Create it forwards with ErrWrongLeader, as a leader that
+// committed the create and then lost leadership before replying would
+type wrongLeaderTransport struct {
+	Transport
+	failed atomic.Bool
+}
+
+func (tr *wrongLeaderTransport) Call(server string, method string, args any, reply any) bool {
+	ok := tr.Transport.Call(server, method, args, reply)
+	if r, isCreate := reply.(*rpc.CreateReply); ok && isCreate && r.Err == rpc.OK && tr.failed.CompareAndSwap(false, true) {
+		*r = rpc.CreateReply{Err: rpc.ErrWrongLeader, Leader: rpc.NoLeader}
+	}
+	return ok
+}
+
+// A protected create that was committed but answered with ErrWrongLeader is not applied twice on retry
+func TestProtectedCreateWrongLeader(t *testing.T) {
+	addrs := freeAddrs(t, 1)
+	srv, err := StartTCPPanServer(addrs, 0, tester.MakePersister(), -1, DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Kill()
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	ck := MakeSession(&wrongLeaderTransport{Transport: transport}, addrs).(*Session)
+
+	zname, cerr := ck.Create("/p/n-", "data", rpc.Flag{Sequential: true, Protected: true})
+	if cerr != rpc.OK {
+		t.Fatalf("Protected create returned %v", cerr)
+	}
+	children, _ := ck.GetChildren("/p", rpc.Watch{})
+	if len(children) != 1 || "/p/"+children[0] != zname {
+		t.Fatalf("/p has children %v after the retried create of %s; expected just that znode", children, zname)
+	}
+	if !strings.HasSuffix(string(zname), "n-"+rpc.SeqSuffix(0)) {
+		t.Fatalf("Create returned %s; expected the first sequence number", zname)
+	}
+}
+
+// Concurrent sessions' creates all apply when group commit has them share Raft entries
+func TestGroupCommit(t *testing.T) {
+	const (
+		NCLIENTS = 10
+		NCREATES = 20 // per client
+	)
+	opts := DefaultServerOptions()
+	opts.BatchWindow = 2 * time.Millisecond
+	ts := MakeTestOptions(t, "Group Commit", NCLIENTS+1, 3, -1, opts)
+	defer ts.Cleanup()
+
+	var wg sync.WaitGroup
+	for i := range NCLIENTS {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ck := ts.MakeSession()
+			for j := range NCREATES {
+				if _, err := ck.Create(rpc.Ppath(fmt.Sprintf("/t/%d/%d", i, j)), "", rpc.Flag{}); err != rpc.OK {
+					ts.t.Errorf("Create returned %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	ck := ts.MakeSession()
+	for i := range NCLIENTS {
+		if children, err := ck.GetChildren(rpc.Ppath(fmt.Sprintf("/t/%d", i)), rpc.Watch{}); err != rpc.OK || len(children) != NCREATES {
+			ts.t.Fatalf("/t/%d has %d children, %v; expected %d", i, len(children), err, NCREATES)
+		}
+	}
+}
+
+// Creates by concurrent sessions on a TCP ensemble, with and without group commit. Compare the two with
+// go test -run '^$' -bench BenchmarkCreates ./pan
+func BenchmarkCreates(b *testing.B) {
+	const (
+		NCLIENTS = 20
+		NSERVERS = 3
+	)
+	for _, window := range []time.Duration{0, 2 * time.Millisecond} {
+		b.Run(fmt.Sprintf("BatchWindow=%v", window), func(b *testing.B) {
+			opts := DefaultServerOptions()
+			opts.BatchWindow = window
+			addrs := freeAddrs(b, NSERVERS)
+			for i := range addrs {
+				srv, err := StartTCPPanServer(addrs, i, tester.MakePersister(), -1, opts)
+				if err != nil {
+					b.Fatalf("Could not start server %d: %v", i, err)
+				}
+				defer srv.Kill()
+			}
+			transport := MakeTCPTransport()
+			defer transport.Close()
+			cks := make([]panapi.IPNSession, NCLIENTS)
+			for i := range cks {
+				cks[i] = MakeSession(transport, addrs)
+			}
+
+			// The clients take turns at the b.N creates
+			var next atomic.Int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for i, ck := range cks {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := next.Add(1); j <= int64(b.N); j = next.Add(1) {
+						if _, err := ck.Create(rpc.Ppath(fmt.Sprintf("/t/%d/%d", i, j)), "", rpc.Flag{}); err != rpc.OK {
+							b.Errorf("Create returned %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// Find n free localhost addresses for a TCP ensemble
+func freeAddrs(t testing.TB, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Could not find a free port: %v", err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	return addrs
+}
+
+// Run a three-replica ensemble over real sockets on localhost,
+// and keep serving after one replica is killed
+func TestTCPCluster(t *testing.T) {
+	const (
+		NSERVERS = 3
+	)
+	addrs := freeAddrs(t, NSERVERS)
+
+	servers := make([]*TCPPanServer, NSERVERS)
+	for i := range servers {
+		srv, err := StartTCPPanServer(addrs, i, tester.MakePersister(), -1, DefaultServerOptions())
+		if err != nil {
+			t.Fatalf("Could not start server %d: %v", i, err)
+		}
+		servers[i] = srv
+	}
+	defer func() {
+		for _, srv := range servers[1:] {
+			srv.Kill()
+		}
+	}()
+
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	ck := MakeSession(transport, addrs)
+
+	ck.Create("/a/b", "hello", rpc.Flag{})
+	data, version, _ := ck.GetData("/a/b", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if ok, err := compareGetData("/a/b", "hello", 1, data, version); !ok {
+		t.Fatal(err)
+	}
+
+	servers[0].Kill()
+	ck.SetData("/a/b", "bye", 1)
+	data, version, _ = ck.GetData("/a/b", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if ok, err := compareGetData("/a/b", "bye", 2, data, version); !ok {
+		t.Fatal(err)
+	}
+}
+
+// An observer started over TCP follows the voters and forwards writes to them
+func TestTCPObserver(t *testing.T) {
+	addrs := freeAddrs(t, 2) // voter, observer
+	srv, err := StartTCPPanServer(addrs[:1], 0, tester.MakePersister(), -1, DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Kill()
+	obs, err := StartTCPPanObserver(addrs[:1], addrs[1], DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("Could not start observer: %v", err)
+	}
+	defer obs.Kill()
+
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	obsCk := MakeSession(transport, addrs[1:])
+	voterCk := MakeSession(transport, addrs[:1])
+
+	if _, err := obsCk.Create("/a", "x", rpc.Flag{}); err != rpc.OK {
+		t.Fatalf("Create through the observer returned %v", err)
+	}
+	data, version, _ := voterCk.GetData("/a", rpc.Watch{})
+	if ok, err := compareGetData("/a", "x", 1, data, version); !ok {
+		t.Fatal(err)
+	}
+
+	fired := make(chan rpc.WatchArgs, 1)
+	obsCk.GetData("/a", rpc.Watch{ShouldWatch: true, Callback: func(event rpc.WatchArgs) { fired <- event }})
+	voterCk.SetData("/a", "y", 1)
+	select {
+	case event := <-fired:
+		if event.EventType != rpc.NodeDataChanged || event.Path != "/a" {
+			t.Fatalf("Observer fired %v on %s; expected %v on /a", event.EventType, event.Path, rpc.NodeDataChanged)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Observer never fired the data watch on /a")
+	}
+}
+
+// Restart every process of a TCP ensemble with disk persistence,
+// and check that both the log and the snapshotted znode tree come back
+func TestTCPClusterRestart(t *testing.T) {
+	const (
+		NSERVERS = 3
+		NITERS   = 30
+	)
+	addrs := freeAddrs(t, NSERVERS)
+	dirs := make([]string, NSERVERS)
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+	}
+
+	servers := make([]*TCPPanServer, NSERVERS)
+	persisters := make([]*DiskPersister, NSERVERS)
+	start := func() {
+		for i := range servers {
+			dp, err := MakeDiskPersister(dirs[i])
+			if err != nil {
+				t.Fatalf("Could not load %s: %v", dirs[i], err)
+			}
+			opts := DefaultServerOptions()
+			opts.Flush = dp.Sync
+			srv, err := StartTCPPanServer(addrs, i, dp.Persister(), 1000, opts)
+			if err != nil {
+				t.Fatalf("Could not start server %d: %v", i, err)
+			}
+			servers[i], persisters[i] = srv, dp
+		}
+	}
+	stop := func() {
+		for i := range servers {
+			servers[i].Kill()
+			if err := persisters[i].Close(); err != nil {
+				t.Fatalf("Could not save %s: %v", dirs[i], err)
+			}
+		}
+	}
+
+	start()
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	ck := MakeSession(transport, addrs)
+	ck.Create("/a/b", "hello", rpc.Flag{})
+	for range NITERS {
+		ck.Create("/a/seq-", "data", rpc.Flag{Sequential: true})
+	}
+	stop()
+
+	start()
+	defer stop()
+	ck = MakeSession(transport, addrs)
+	data, version, _ := ck.GetData("/a/b", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if ok, err := compareGetData("/a/b", "hello", 1, data, version); !ok {
+		t.Fatal(err)
+	}
+	children, _ := ck.GetChildren("/a", rpc.Watch{ShouldWatch: false, Callback: rpc.EmptyWatch})
+	if len(children) != NITERS+1 {
+		t.Fatalf("Expected /a to have %d children after restart; got %d instead", NITERS+1, len(children))
+	}
+}
+
+// A corrupted state file is refused on load instead of being handed to Raft
+func TestDiskPersisterChecksum(t *testing.T) {
+	dir := t.TempDir()
+	dp, err := MakeDiskPersister(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Persister().Save([]byte("raft"), []byte("snap"))
+	dp.Close()
+
+	dp, err = MakeDiskPersister(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dp.Persister().ReadRaftState()) != "raft" || string(dp.Persister().ReadSnapshot()) != "snap" {
+		t.Fatalf("Loaded raft state %q and snapshot %q; expected \"raft\" and \"snap\"", dp.Persister().ReadRaftState(), dp.Persister().ReadSnapshot())
+	}
+	dp.Close()
+
+	path := filepath.Join(dir, snapshotFile)
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+	if _, err := MakeDiskPersister(dir); err == nil {
+		t.Fatal("Loaded a corrupted snapshot file without an error")
+	}
+}
+
+// Admin commands report liveness, leadership, znodes, sessions, and watches
+func TestAdminCommands(t *testing.T) {
+	ts := MakeTest(t, "Admin Commands", 1, 3, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+	ck := ts.MakeSession()
+	ck.Create("/a/b", "data", rpc.Flag{Ephemeral: true})
+	ck.GetData("/a/b", rpc.Watch{ShouldWatch: true, Callback: rpc.EmptyWatch})
+
+	clnt := ts.Config.MakeClient()
+	admin := func(server string, command string) string {
+		args := rpc.AdminArgs{Command: command}
+		reply := rpc.AdminReply{}
+		if !clnt.Call(server, "PanServer.Admin", &args, &reply) || reply.Err != rpc.OK {
+			ts.t.Fatalf("Admin command %s failed on %s: %v", command, server, reply.Err)
+		}
+		return reply.Output
+	}
+
+	leaders := 0
+	for _, server := range ts.Group(Gid).SrvNames() {
+		if out := admin(server, "ruok"); out != "imok" {
+			ts.t.Fatalf("ruok returned %q; expected imok", out)
+		}
+		mntr := admin(server, "mntr")
+		if strings.Contains(mntr, "zk_server_state\tleader\n") {
+			leaders++
+			// root, /a and /a/b
+			for _, line := range []string{"zk_znode_count\t3\n", "zk_ephemerals_count\t1\n", "zk_watch_count\t1\n"} {
+				if !strings.Contains(mntr, line) {
+					ts.t.Fatalf("mntr on the leader is missing %q:\n%s", line, mntr)
+				}
+			}
+			if wchs := admin(server, "wchs"); !strings.Contains(wchs, "Total watches:1") {
+				ts.t.Fatalf("wchs on the leader reported:\n%s", wchs)
+			}
+			if dump := admin(server, "dump"); !strings.Contains(dump, "\t/a/b\n") {
+				ts.t.Fatalf("dump on the leader is missing ephemeral /a/b:\n%s", dump)
+			}
+		}
+	}
+	if leaders != 1 {
+		ts.t.Fatalf("%d servers reported being leader", leaders)
+	}
+
+	args := rpc.AdminArgs{Command: "nope"}
+	reply := rpc.AdminReply{}
+	clnt.Call(ts.Group(Gid).SrvNames()[0], "PanServer.Admin", &args, &reply)
+	if reply.Err != rpc.ErrUnknownCommand {
+		ts.t.Fatalf("Unknown admin command returned %v", reply.Err)
+	}
+}
+
+// Scrape a server's metrics endpoint and check the counters and histograms a few operations produce
+func TestMetrics(t *testing.T) {
+	addrs := freeAddrs(t, 3) // server, metrics, and an address nothing listens on
+	opts := DefaultServerOptions()
+	opts.MetricsAddr = addrs[1]
+	srv, err := StartTCPPanServer(addrs[:1], 0, tester.MakePersister(), -1, opts)
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Kill()
+
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	clientMetrics := MakeMetrics()
+	// The session tries the dead address first, so its failed call is counted on the client
+	ck := MakeSessionWithOptions(transport, []string{addrs[2], addrs[0]}, SessionOptions{Metrics: clientMetrics})
+	ck.Create("/a/b", "data", rpc.Flag{})
+	ck.GetData("/a/b", rpc.Watch{ShouldWatch: true, Callback: rpc.EmptyWatch})
+	ck.SetData("/a/b", "new data", 1)
+
+	resp, err := http.Get("http://" + addrs[1] + "/metrics")
+	if err != nil {
+		t.Fatalf("Could not scrape metrics: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Could not read metrics: %v", err)
+	}
+
+	for _, line := range []string{
+		"# TYPE pan_rpc_submit_seconds histogram\n",
+		"pan_rpc_submit_seconds_count{op=\"Create\"} 1\n",
+		"pan_rpc_apply_seconds_count{op=\"SetData\"} 1\n",
+		"pan_rpc_apply_seconds_bucket{op=\"GetData\",le=\"+Inf\"} 1\n",
+		"pan_sessions_created_total 1\n",
+		"pan_watches_registered_total{type=\"" + rpc.NodeDataChanged + "\"} 1\n",
+		"pan_watches_fired_total{type=\"" + rpc.NodeDataChanged + "\"} 1\n",
+		// root, /a and /a/b
+		"pan_znode_count 3\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("Metrics are missing %q:\n%s", line, body)
+		}
+	}
+
+	var b strings.Builder
+	clientMetrics.Write(&b)
+	if !strings.Contains(b.String(), "pan_client_rpc_failures_total{op=\"StartSession\"} 1\n") {
+		t.Fatalf("Client metrics did not count failed RPCs:\n%s", b.String())
+	}
+}
+
+// Counters are recorded by the server that submitted a request, and not again when the log is replayed.
+func TestMetricsReplay(t *testing.T) {
+	pn := makePanServer(nil, 0, DefaultServerOptions())
+	old := pn.startMicros - 1
+	for _, tsReq := range []TimestampedRequest{
+		{Timestamp: old, Request: rpc.StartSessionArgs{Timeout: time.Minute}, Server: 0},            // replayed after a restart
+		{Timestamp: pn.startMicros, Request: rpc.StartSessionArgs{Timeout: time.Minute}, Server: 1}, // another server's
+		{Timestamp: pn.startMicros, Request: rpc.StartSessionArgs{Timeout: time.Minute}, Server: 0}, // this server's
+	} {
+		pn.DoOp(tsReq)
+	}
+
+	var b strings.Builder
+	pn.metrics.Write(&b)
+	if !strings.Contains(b.String(), "pan_sessions_created_total 1\n") {
+		t.Fatalf("Expected one session counted:\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), "pan_rpc_apply_seconds_count{op=\"StartSession\"} 1\n") {
+		t.Fatalf("Expected one apply observed:\n%s", b.String())
+	}
+}
+
+// Reconfig validates membership changes, keeps rpc.ConfigPath read-only, and moves sessions following the config
+func TestReconfig(t *testing.T) {
+	addrs := freeAddrs(t, 3) // server, an observer that never starts, and an address nothing listens on
+	applied := make(chan rpc.Membership, 10)
+	opts := DefaultServerOptions()
+	opts.OnReconfig = func(membership rpc.Membership) { applied <- membership }
+	srv, err := StartTCPPanServer(addrs[:1], 0, tester.MakePersister(), -1, opts)
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Kill()
+
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	ck := MakeSession(transport, addrs[:1])
+
+	for _, change := range []struct {
+		joining []string
+		leaving []string
+		err     rpc.Err
+	}{
+		{[]string{"observer.1=" + addrs[1]}, nil, rpc.ErrReconfig},                          // leaves out the voter
+		{[]string{"server.0=" + addrs[0], "server.1=" + addrs[1]}, nil, rpc.ErrFixedVoters}, // adds a voter
+		{[]string{"server.0"}, nil, rpc.ErrReconfig},                                        // no address
+		{nil, []string{"server.0"}, rpc.ErrFixedVoters},                                     // removes a voter
+	} {
+		if _, err := ck.Reconfig(change.joining, change.leaving, -1); err != change.err {
+			t.Fatalf("Reconfig(%v, %v) returned %v; expected %v", change.joining, change.leaving, err, change.err)
+		}
+	}
+
+	version, rerr := ck.Reconfig([]string{"server.0=" + addrs[0], "observer.1=" + addrs[1]}, nil, -1)
+	if rerr != rpc.OK {
+		t.Fatalf("Reconfig returned %v", rerr)
+	}
+	expected := "server.0=" + addrs[0] + "\nobserver.1=" + addrs[1] + "\n"
+	data, configVersion, _ := ck.GetData(rpc.ConfigPath, rpc.Watch{})
+	if data != expected || configVersion != version {
+		t.Fatalf("%s is %q at version %d; expected %q at version %d", rpc.ConfigPath, data, configVersion, expected, version)
+	}
+	select {
+	case membership := <-applied:
+		if membership.String() != expected {
+			t.Fatalf("OnReconfig got %q; expected %q", membership.String(), expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnReconfig was not called")
+	}
+
+	if _, err := ck.Reconfig(nil, []string{"observer.1"}, version+1); err != rpc.ErrVersion {
+		t.Fatalf("Reconfig from a stale version returned %v; expected %v", err, rpc.ErrVersion)
+	}
+	if err := ck.SetData(rpc.ConfigPath, "server.0=elsewhere\n", version); err != rpc.ErrReadOnly {
+		t.Fatalf("SetData on %s returned %v; expected %v", rpc.ConfigPath, err, rpc.ErrReadOnly)
+	}
+	if _, err := ck.Create(rpc.ConfigPath+"/x", "", rpc.Flag{}); err != rpc.ErrReadOnly {
+		t.Fatalf("Create under %s returned %v; expected %v", rpc.ConfigPath, err, rpc.ErrReadOnly)
+	}
+	if err := ck.Delete(rpc.ConfigPath, version); err != rpc.ErrReadOnly {
+		t.Fatalf("Delete of %s returned %v; expected %v", rpc.ConfigPath, err, rpc.ErrReadOnly)
+	}
+
+	// The session starts on the dead address, then switches to the membership, and follows it as it changes
+	follower := MakeSessionWithOptions(transport, []string{addrs[2], addrs[0]}, SessionOptions{FollowConfig: true}).(*Session)
+	waitServers := func(expected []string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			follower.mu.Lock()
+			servers := fmt.Sprint(follower.servers)
+			follower.mu.Unlock()
+			if servers == fmt.Sprint(expected) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Session has servers %s; expected %v", servers, expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitServers(addrs[:2])
+	if _, err := ck.Reconfig(nil, []string{"observer.1"}, version); err != rpc.OK {
+		t.Fatalf("Reconfig removing the observer returned %v", err)
+	}
+	waitServers(addrs[:1])
+}
+
+// Followers turn requests away with a hint naming the leader
+func TestLeaderHint(t *testing.T) {
+	ts := MakeTest(t, "Leader Hint", 1, 3, true, false, false, false, -1, false)
+	defer ts.Cleanup()
+	tck := ts.MakeSession().(*panapi.TestSession)
+	ck := tck.IPNSession.(*Session)
+	ck.Create("/a", "data", rpc.Flag{})
+
+	// Followers learn who leads once they apply the Create
+	names := ts.Group(Gid).SrvNames()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		leader, hints := -1, []string{}
+		for i, name := range names {
+			args := rpc.GetDataArgs{SessionId: ck.id, Path: "/a"}
+			reply := rpc.GetDataReply{}
+			if !tck.Clnt.Call(name, "PanServer.GetData", &args, &reply) {
+				ts.t.Fatalf("Server %d did not reply", i)
+			}
+			if reply.Err == rpc.ErrWrongLeader {
+				hints = append(hints, reply.Leader)
+			} else {
+				leader = i
+			}
+		}
+		if leader != -1 && len(hints) == len(names)-1 && hints[0] == names[leader] && hints[1] == names[leader] {
+			return
+		}
+		if time.Now().After(deadline) {
+			ts.t.Fatalf("Leader is %d, but followers hinted %v", leader, hints)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Answers every call from the server at leader, and turns the rest away with a hint naming it
+type hintingTransport struct {
+	leader string
+
+	mu       sync.Mutex
+	setDatas map[string]int // SetData calls made to each server
+}
+
+func (tr *hintingTransport) Call(server string, method string, args any, reply any) bool {
+	if method == "PanServer.SetData" {
+		tr.mu.Lock()
+		tr.setDatas[server]++
+		tr.mu.Unlock()
+	}
+	r := reflect.ValueOf(reply).Elem()
+	if server == tr.leader {
+		r.FieldByName("Err").SetString(rpc.OK)
+	} else {
+		r.FieldByName("Err").SetString(rpc.ErrWrongLeader)
+		r.FieldByName("Leader").SetString(tr.leader)
+	}
+	return true
+}
+
+// A session follows a leader hint to the server with that address, wherever it is in the session's server list
+func TestLeaderHintAddress(t *testing.T) {
+	tr := &hintingTransport{leader: "server-0", setDatas: make(map[string]int)}
+	ck := MakeSession(tr, []string{"server-2", "server-1", "server-0"})
+	if err := ck.SetData("/a", "data", 1); err != rpc.OK {
+		t.Fatalf("SetData returned %v", err)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.setDatas["server-0"] != 1 || len(tr.setDatas) != 1 {
+		t.Fatalf("Session sent SetData to %v after StartSession was hinted to server-0", tr.setDatas)
+	}
+}
+
+// Retry delays double from the minimum up to the maximum, and are jittered
+func TestBackoff(t *testing.T) {
+	ck := &Session{minBackoff: 10 * time.Millisecond, maxBackoff: 80 * time.Millisecond}
+	for attempt, max := range []time.Duration{10, 20, 40, 80, 80, 80} {
+		max *= time.Millisecond
+		for range 100 {
+			if delay := ck.backoff(attempt); delay < max/2 || delay > max {
+				t.Fatalf("Retry %d waits %v; expected between %v and %v", attempt, delay, max/2, max)
+			}
+		}
+	}
+	if delay := ck.backoff(100); delay < 40*time.Millisecond || delay > 80*time.Millisecond {
+		t.Fatalf("Retry 100 waits %v; expected at most the maximum backoff", delay)
+	}
+}
+
+// Calls stop retrying once their context is done
+func TestContextTimeout(t *testing.T) {
+	addrs := freeAddrs(t, 2) // server, and an address nothing listens on
+	srv, err := StartTCPPanServer(addrs[:1], 0, tester.MakePersister(), -1, DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Kill()
+	transport := MakeTCPTransport()
+	defer transport.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := MakeSessionCtx(ctx, transport, addrs[1:], SessionOptions{}); err != rpc.ErrTimeout {
+		t.Fatalf("Starting a session with no servers returned %v; expected %v", err, rpc.ErrTimeout)
+	}
+
+	ck := MakeSession(transport, addrs[:1]).(*Session)
+	ck.Create("/a", "data", rpc.Flag{})
+	_, version, _ := ck.GetData("/a", rpc.Watch{})
+
+	// Nothing changes /a, so the watch never fires
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	reply := rpc.GetDataReply{}
+	ck.clnt.Call(addrs[0], "PanServer.GetData", &rpc.GetDataArgs{SessionId: ck.id, Path: "/a", Watch: rpc.Watch{ShouldWatch: true}}, &reply)
+	if err := ck.WatchWaitCtx(ctx, reply.WatchId, func(rpc.WatchArgs) { t.Errorf("Watch on /a fired") }); err != rpc.ErrTimeout {
+		t.Fatalf("Waiting on a watch that never fires returned %v; expected %v", err, rpc.ErrTimeout)
+	}
+
+	// Once the server is gone, calls time out or are canceled instead of retrying forever
+	srv.Kill()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := ck.SetDataCtx(ctx, "/a", "new data", version); err != rpc.ErrTimeout {
+		t.Fatalf("SetData with the server down returned %v; expected %v", err, rpc.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("SetData took %v to time out after 200ms", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, _, err := ck.GetDataCtx(ctx, "/a", rpc.Watch{}); err != rpc.ErrCanceled {
+		t.Fatalf("GetData with the server down returned %v; expected %v", err, rpc.ErrCanceled)
+	}
+}
+
+// Asynchronous calls take effect and complete in order, and a retried batch is applied once
+func TestAsync(t *testing.T) {
+	const (
+		NCREATES = 300
+	)
+	addrs := freeAddrs(t, 1)
+	srv, err := StartTCPPanServer(addrs, 0, tester.MakePersister(), -1, DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Kill()
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	ck := MakeSession(transport, addrs).(*Session)
+
+	var mu sync.Mutex
+	order := []int{}
+	futures := make([]*panapi.Future[rpc.Ppath], NCREATES)
+	for i := range futures {
+		futures[i] = ck.CreateAsync("/bulk/n-", "", rpc.Flag{Sequential: true})
+		futures[i].Then(func(rpc.Ppath, rpc.Err) {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, i)
+		})
+	}
+	for i, f := range futures {
+		name, err := f.Wait()
+		if expected := rpc.Ppath("/bulk/n-" + rpc.SeqSuffix(i)); err != rpc.OK || name != expected {
+			t.Fatalf("Create %d made %s with %v; expected %s", i, name, err, expected)
+		}
+	}
+	mu.Lock()
+	if !slices.IsSorted(order) || len(order) != NCREATES {
+		t.Fatalf("Callbacks ran in order %v", order)
+	}
+	mu.Unlock()
+
+	// A read queued after a write sees it
+	ck.SetDataAsync("/bulk", "loaded", 1)
+	result, err2 := ck.GetDataAsync("/bulk", rpc.Watch{}).Wait()
+	if ok, msg := compareGetData("/bulk", "loaded", 2, result.Data, result.Version); err2 != rpc.OK || !ok {
+		t.Fatalf("%s (%v)", msg, err2)
+	}
+
+	// The server answers a retried batch from the replies to the first try
+	args := rpc.BatchArgs{SessionId: ck.id, BatchId: 1 << 40, Requests: []any{rpc.CreateArgs{SessionId: ck.id, Path: "/bulk/n-", Flags: rpc.Flag{Sequential: true}}}}
+	first, retried := rpc.BatchReply{}, rpc.BatchReply{}
+	srv.PanServer().Batch(&args, &first)
+	// Even after a restart
+	srv.PanServer().Restore(srv.PanServer().Snapshot())
+	srv.PanServer().Batch(&args, &retried)
+	if !reflect.DeepEqual(first, retried) {
+		t.Fatalf("Retried batch got %v; expected %v", retried, first)
+	}
+	children, _ := ck.GetChildren("/bulk", rpc.Watch{})
+	if len(children) != NCREATES+1 {
+		t.Fatalf("/bulk has %d children after the retried batch; expected %d", len(children), NCREATES+1)
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Check that applied ops and client retries are logged as JSON with their server and session attached, and that
+// retries made before the session exists leave the session off
+func TestStructuredLogs(t *testing.T) {
+	out := &lockedBuffer{}
+	SetLogOutput(out)
+	if err := SetLogLevels("error,CMIT=debug,CLNT=debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		SetLogLevels("")
+		SetLogOutput(os.Stderr)
+	}()
+
+	addrs := freeAddrs(t, 2) // server, and an address nothing listens on
+	srv, err := StartTCPPanServer(addrs[:1], 0, tester.MakePersister(), -1, DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Kill()
+
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	ck := MakeSession(transport, []string{addrs[1], addrs[0]})
+	ck.Create("/a", "data", rpc.Flag{})
+	SetLogLevels("error")
+
+	applied, retried := false, false
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line is not JSON: %q", line)
+		}
+		if entry["topic"] == "CMIT" && entry["op"] == "Create" {
+			applied = entry["server"] == 0.0 && entry["path"] == "/a" && entry["session"] != nil
+		}
+		if entry["topic"] == "CLNT" && entry["msg"] == "retrying" && entry["op"] == "StartSession" {
+			_, hasSession := entry["session"]
+			retried = entry["server"] == addrs[1] && !hasSession
+		}
+	}
+	if !applied || !retried {
+		t.Fatalf("Missing the applied Create with server and session, or the StartSession retry with server and no session:\n%s", out.String())
+	}
+}
+
+// Check the audit records of a session's changes, that the log rotates, and that reopening it skips old zxids
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := MakeAuditLog(path, 400, 10)
+	if err != nil {
+		t.Fatalf("Could not open audit log: %v", err)
+	}
+
+	addrs := freeAddrs(t, 1)
+	opts := DefaultServerOptions()
+	opts.AuditLog = auditLog
+	srv, err := StartTCPPanServer(addrs, 0, tester.MakePersister(), -1, opts)
+	if err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+
+	transport := MakeTCPTransport()
+	defer transport.Close()
+	ck := MakeSessionWithOptions(transport, addrs, SessionOptions{Identity: "alice"})
+	ck.Create("/a", "data", rpc.Flag{})
+	auditLog.mu.Lock()
+	synced := !auditLog.dirty
+	auditLog.mu.Unlock()
+	if !synced {
+		t.Fatalf("Create replied before its audit record was synced")
+	}
+	ck.SetData("/a", "new data", 1)
+	ck.SetData("/a", "stale", 1)
+	ck.Delete("/a", 2)
+	ck.Create("/e", "", rpc.Flag{Ephemeral: true})
+	ck.Create("/e/p", "", rpc.Flag{})
+	ck.EndSession()
+	srv.Kill()
+	auditLog.Close()
+
+	// Read the rotated files oldest first, then the current one
+	var records []AuditRecord
+	for i := 10; i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record AuditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("Bad audit record %q: %v", line, err)
+			}
+			records = append(records, record)
+		}
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("Audit log was not rotated: %v", err)
+	}
+
+	expected := []AuditRecord{
+		{Op: auditStartSession, OldVersion: NoVersion, NewVersion: NoVersion, Err: rpc.OK},
+		{Op: auditCreate, Path: "/a", OldVersion: NoVersion, NewVersion: 1, Err: rpc.OK},
+		{Op: auditSetData, Path: "/a", OldVersion: 1, NewVersion: 2, Err: rpc.OK},
+		{Op: auditSetData, Path: "/a", OldVersion: 2, NewVersion: 2, Err: rpc.ErrVersion},
+		{Op: auditDelete, Path: "/a", OldVersion: 2, NewVersion: NoVersion, Err: rpc.OK},
+		{Op: auditCreate, Path: "/e", OldVersion: NoVersion, NewVersion: 1, Err: rpc.OK},
+		{Op: auditCreate, Path: "/e/p", OldVersion: NoVersion, NewVersion: 1, Err: rpc.OK},
+		{Op: auditEndSession, OldVersion: NoVersion, NewVersion: NoVersion, Err: rpc.OK},
+		{Op: auditDeleteSubtree, Path: "/e/p", OldVersion: 1, NewVersion: NoVersion, Err: rpc.OK},
+		{Op: auditDeleteEphemeral, Path: "/e", OldVersion: 1, NewVersion: NoVersion, Err: rpc.OK},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Got %d audit records; expected %d: %+v", len(records), len(expected), records)
+	}
+	for i, record := range records {
+		if record.Identity != "alice" || (i > 0 && record.Zxid < records[i-1].Zxid) {
+			t.Fatalf("Audit record %d has identity %q and zxid %d after %d", i, record.Identity, record.Zxid, records[max(i-1, 0)].Zxid)
+		}
+		record.Zxid, record.Time, record.Session, record.Identity = 0, time.Time{}, 0, ""
+		if record != expected[i] {
+			t.Fatalf("Audit record %d is %+v; expected %+v", i, record, expected[i])
+		}
+	}
+
+	// Replaying an already audited request after a restart must not write it again
+	auditLog, err = MakeAuditLog(path, 400, 10)
+	if err != nil {
+		t.Fatalf("Could not reopen audit log: %v", err)
+	}
+	before, _ := os.ReadFile(path)
+	auditLog.Write(records[len(records)-1].Zxid, []AuditRecord{records[len(records)-1]})
+	auditLog.Close()
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatalf("Reopened audit log wrote an old zxid again")
+	}
+}
+
 func (ts *Test) GenericTest() {
 	const (
 		NITER  = 3
@@ -611,7 +1685,7 @@ func TestWatchSequential(t *testing.T) {
 
 	ck := ts.MakeSession()
 	ch_path := make(chan rpc.Ppath)
-	ck.Exists("/a/b-30", rpc.Watch{ShouldWatch: true, Callback: func(_ rpc.WatchArgs) {
+	ck.Exists(rpc.Ppath("/a/b-"+rpc.SeqSuffix(30)), rpc.Watch{ShouldWatch: true, Callback: func(_ rpc.WatchArgs) {
 		path, _ := ck.Create("/a/b-", "", rpc.Flag{Sequential: true})
 		ch_path <- path
 	}})
@@ -637,7 +1711,7 @@ func TestWatchSequentialWithServerCrash(t *testing.T) {
 
 	ck := ts.MakeSession()
 	ch_path := make(chan rpc.Ppath)
-	ck.Exists("/a/b-30", rpc.Watch{ShouldWatch: true, Callback: func(_ rpc.WatchArgs) {
+	ck.Exists(rpc.Ppath("/a/b-"+rpc.SeqSuffix(30)), rpc.Watch{ShouldWatch: true, Callback: func(_ rpc.WatchArgs) {
 		path, _ := ck.Create("/a/b-", "", rpc.Flag{Sequential: true})
 		ch_path <- path
 	}})
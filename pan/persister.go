@@ -0,0 +1,256 @@
+package pan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tester "6.5840/tester1"
+)
+
+const (
+	raftStateFile   = "raftstate"
+	snapshotFile    = "snapshot"
+	tempSuffix      = ".tmp-"
+	stateFileMagic  = "PANSTATE"
+	persistInterval = 10 * time.Millisecond
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DiskPersister keeps the Raft state and snapshot of a tester.Persister in files in a data directory.
+//
+// Raft and the RSM only accept a *tester.Persister, which lives in memory, so the DiskPersister loads the files into one
+// at startup and then mirrors its contents back to disk. Mirroring happens every persistInterval, on every Sync,
+// and once more on Close; a TCPPanServer calls Sync before replying to peers and clients, so no reply reports state
+// that is not yet on disk.
+//
+// Every file is written to a temporary file, fsynced, and renamed into place, and carries a checksum that is checked on
+// load. The snapshot file also holds the Raft state saved with it, and every write bumps a generation number, so a crash
+// between writing the snapshot and a later Raft state can't pair a snapshot with Raft state from another generation.
+type DiskPersister struct {
+	mu        sync.Mutex
+	dir       string
+	persister *tester.Persister
+	gen       uint64 // generation of the last file written
+	raftstate []byte // last raft state written to disk
+	snapshot  []byte // last snapshot written to disk
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// Load any state already in dir and start mirroring it to disk.
+// Fails if a state file in dir is corrupt.
+func MakeDiskPersister(dir string) (*DiskPersister, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	dp := &DiskPersister{dir: dir, persister: tester.MakePersister(), done: make(chan struct{}), stopped: make(chan struct{})}
+	if err := dp.load(); err != nil {
+		return nil, err
+	}
+	dp.persister.Save(dp.raftstate, dp.snapshot)
+
+	go dp.run()
+	return dp, nil
+}
+
+// Returns the persister to hand to StartPanServer.
+func (dp *DiskPersister) Persister() *tester.Persister {
+	return dp.persister
+}
+
+// Read the state files, discarding any temporary files left by a crash mid-write.
+func (dp *DiskPersister) load() error {
+	entries, err := os.ReadDir(dp.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), tempSuffix) {
+			os.Remove(filepath.Join(dp.dir, entry.Name()))
+		}
+	}
+
+	raftGen, raftstate, _, err := dp.readFile(raftStateFile)
+	if err != nil {
+		return err
+	}
+	snapGen, snapRaftstate, snapshot, err := dp.readFile(snapshotFile)
+	if err != nil {
+		return err
+	}
+
+	dp.snapshot = snapshot
+	if snapGen > raftGen {
+		// The snapshot was written after the raft state file, so the raft state saved alongside it is the newest
+		dp.gen, dp.raftstate = snapGen, snapRaftstate
+	} else {
+		dp.gen, dp.raftstate = raftGen, raftstate
+	}
+	return nil
+}
+
+// Encode a state file: magic, generation, checksum, then the length-prefixed raft state and snapshot.
+// The checksum covers everything after it.
+func encodeStateFile(gen uint64, raftstate []byte, snapshot []byte) []byte {
+	body := binary.BigEndian.AppendUint64(nil, gen)
+	body = binary.BigEndian.AppendUint64(body, uint64(len(raftstate)))
+	body = append(body, raftstate...)
+	body = binary.BigEndian.AppendUint64(body, uint64(len(snapshot)))
+	body = append(body, snapshot...)
+
+	data := []byte(stateFileMagic)
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(body, crcTable))
+	return append(data, body...)
+}
+
+// Decode a state file produced by encodeStateFile, validating its checksum.
+func decodeStateFile(data []byte) (uint64, []byte, []byte, error) {
+	header := len(stateFileMagic) + 4
+	if len(data) < header || string(data[:len(stateFileMagic)]) != stateFileMagic {
+		return 0, nil, nil, errors.New("not a pan state file")
+	}
+	body := data[header:]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[len(stateFileMagic):header]) {
+		return 0, nil, nil, errors.New("checksum mismatch")
+	}
+
+	// Each section is checked against the remaining length, so a bad length can't index past the body
+	next := func() ([]byte, bool) {
+		if len(body) < 8 || uint64(len(body)-8) < binary.BigEndian.Uint64(body) {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint64(body)
+		section := body[8 : 8+n]
+		body = body[8+n:]
+		return section, true
+	}
+
+	if len(body) < 8 {
+		return 0, nil, nil, errors.New("truncated state file")
+	}
+	gen := binary.BigEndian.Uint64(body)
+	body = body[8:]
+	raftstate, ok1 := next()
+	snapshot, ok2 := next()
+	if !ok1 || !ok2 || len(body) != 0 {
+		return 0, nil, nil, errors.New("truncated state file")
+	}
+	return gen, raftstate, snapshot, nil
+}
+
+// Read and validate a state file, treating a missing file as empty state of generation 0.
+func (dp *DiskPersister) readFile(name string) (uint64, []byte, []byte, error) {
+	data, err := os.ReadFile(filepath.Join(dp.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, nil, nil
+	} else if err != nil {
+		return 0, nil, nil, err
+	}
+
+	gen, raftstate, snapshot, err := decodeStateFile(data)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("%s: %v", filepath.Join(dp.dir, name), err)
+	}
+	return gen, raftstate, snapshot, nil
+}
+
+// Atomically replace a file in the data directory: write a temporary file, fsync it, rename it into place,
+// and fsync the directory so the rename itself is durable.
+func (dp *DiskPersister) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(dp.dir, name+tempSuffix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dp.dir, name)); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(dp.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Read a raft state and snapshot that were saved together.
+// They are read separately, so retry if a new snapshot was saved in between.
+func (dp *DiskPersister) readPersister() ([]byte, []byte) {
+	for {
+		snapshot := dp.persister.ReadSnapshot()
+		raftstate := dp.persister.ReadRaftState()
+		if bytes.Equal(snapshot, dp.persister.ReadSnapshot()) {
+			return raftstate, snapshot
+		}
+	}
+}
+
+// Write the persister's state to disk if it changed since the last sync.
+// Returns once everything the persister held when Sync was called is on disk.
+func (dp *DiskPersister) Sync() error {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+
+	raftstate, snapshot := dp.readPersister()
+
+	if !bytes.Equal(snapshot, dp.snapshot) {
+		if err := dp.writeFile(snapshotFile, encodeStateFile(dp.gen+1, raftstate, snapshot)); err != nil {
+			return err
+		}
+		dp.gen++
+		dp.raftstate, dp.snapshot = raftstate, snapshot
+	} else if !bytes.Equal(raftstate, dp.raftstate) {
+		if err := dp.writeFile(raftStateFile, encodeStateFile(dp.gen+1, raftstate, nil)); err != nil {
+			return err
+		}
+		dp.gen++
+		dp.raftstate = raftstate
+	}
+	return nil
+}
+
+func (dp *DiskPersister) run() {
+	defer close(dp.stopped)
+	for {
+		select {
+		case <-dp.done:
+			return
+		case <-time.After(persistInterval):
+			if err := dp.Sync(); err != nil {
+				panLog(dPersist, slog.LevelError, "failed to persist", "dir", dp.dir, "err", err)
+			}
+		}
+	}
+}
+
+// Stop mirroring and write the final state to disk. Call after the PanServer has been killed.
+func (dp *DiskPersister) Close() error {
+	close(dp.done)
+	<-dp.stopped
+	return dp.Sync()
+}
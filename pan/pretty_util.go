@@ -1,13 +1,23 @@
 package pan
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
-	"strconv"
-	"time"
+	"strings"
+	"sync"
 )
 
+// Pan logs JSON lines through log/slog. Every line carries a topic, and each topic has its own level, so one topic
+// can be traced at debug level while the rest stay quiet. Server lines carry the server id and client lines the
+// session id, so the ops of one session can be followed across every replica in a single stream.
+//
+// Levels come from the PAN_LOG environment variable or SetLogLevels. A bare level sets the default for every topic
+// and TOPIC=level overrides it for one topic: PAN_LOG=warn,CLNT=debug,CMIT=debug.
+
 type logTopic string
 
 const (
@@ -29,36 +39,81 @@ const (
 	dWarn    logTopic = "WARN"
 )
 
-// Retrieve the verbosity level from an environment variable
-func getVerbosity() int {
-	v := os.Getenv("VERB")
-	level := 0
-	if v != "" {
-		var err error
-		level, err = strconv.Atoi(v)
-		if err != nil {
-			log.Fatalf("Invalid verbosity %v", v)
+const logLevelsEnv = "PAN_LOG"
+
+var (
+	logMu           sync.RWMutex
+	logger          = newLogger(os.Stderr)
+	logDefaultLevel = slog.LevelWarn
+	logLevels       = map[logTopic]slog.Level{}
+)
+
+func init() {
+	if spec := os.Getenv(logLevelsEnv); spec != "" {
+		if err := SetLogLevels(spec); err != nil {
+			log.Fatalf("Invalid %s: %v", logLevelsEnv, err)
 		}
 	}
-	return level
 }
 
-var debugStart time.Time
-var debugVerbosity int
+// Levels are filtered per topic before a record reaches the handler, so the handler passes everything.
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
 
-func init() {
-	debugVerbosity = getVerbosity()
-	debugStart = time.Now()
+// Replace the log levels with those in spec, a comma-separated list of levels (debug, info, warn, or error)
+// and TOPIC=level pairs. Topics not named in spec log at the last bare level, or warn if there is none.
+func SetLogLevels(spec string) error {
+	defaultLevel := slog.LevelWarn
+	levels := make(map[logTopic]slog.Level)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		topic, name, isTopic := strings.Cut(item, "=")
+		if !isTopic {
+			name = topic
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("bad level %q", name)
+		}
+
+		if isTopic {
+			levels[logTopic(strings.ToUpper(topic))] = level
+		} else {
+			defaultLevel = level
+		}
+	}
 
-	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
+	logMu.Lock()
+	defer logMu.Unlock()
+	logDefaultLevel = defaultLevel
+	logLevels = levels
+	return nil
 }
 
-func DebugPrint(topic logTopic, format string, a ...interface{}) {
-	if debugVerbosity >= 1 {
-		time := time.Since(debugStart).Microseconds()
-		time /= 100
-		prefix := fmt.Sprintf("%06d %v ", time, string(topic))
-		format = prefix + format
-		log.Printf(format, a...)
+// Send log lines to w instead of stderr.
+func SetLogOutput(w io.Writer) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logger = newLogger(w)
+}
+
+// Log msg on a topic if the topic's level is at or below level. attrs are slog key-value pairs.
+func panLog(topic logTopic, level slog.Level, msg string, attrs ...any) {
+	logMu.RLock()
+	topicLevel, ok := logLevels[topic]
+	if !ok {
+		topicLevel = logDefaultLevel
+	}
+	l := logger
+	logMu.RUnlock()
+
+	if level < topicLevel {
+		return
 	}
+	l.Log(context.Background(), level, msg, append([]any{"topic", string(topic)}, attrs...)...)
 }
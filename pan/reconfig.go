@@ -0,0 +1,149 @@
+package pan
+
+import (
+	"pan/panapi/rpc"
+	"strings"
+	"time"
+)
+
+// The ensemble's membership lives in the znode rpc.ConfigPath, which only Reconfig may change. Clients watch it to
+// learn about new servers, and each TCPPanServer watches its own copy to learn where its Raft peers now live.
+//
+// The Raft library has a fixed set of peers, so Reconfig cannot add or remove voters, and fails with
+// rpc.ErrFixedVoters if asked to. "server.N=address" only tells the ensemble that voter N now listens at a new address,
+// for a replica that was moved with its dataDir intact. It must not be used to stand in an empty replica for a lost
+// one: that replica has forgotten its log and its votes, so it could vote twice in a term and help elect a leader that
+// is missing committed entries. Observers do not take part in Raft, so they can be added and removed freely. Each call
+// is a single change applied atomically at one point in the Raft log, so there is never a moment in which two
+// configurations are both in effect.
+
+// Audit record op for a change to the membership
+const auditReconfig = "reconfig"
+
+// Change the ensemble's membership.
+func (pn *PanServer) Reconfig(args *rpc.ReconfigArgs, reply *rpc.ReconfigReply) {
+	res, ok := pn.submit(*args)
+
+	if !ok {
+		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
+	} else {
+		*reply = *(res.(*rpc.ReconfigReply))
+	}
+}
+
+func (pn *PanServer) applyReconfig(args *rpc.ReconfigArgs, reply *rpc.ReconfigReply, timestamp time.Time) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	oldVersion, newVersion := NoVersion, NoVersion
+	defer func() {
+		pn.audit(auditReconfig, args.SessionId, rpc.ConfigPath, oldVersion, newVersion, reply.Err)
+	}()
+
+	if !pn.checkSession(args.SessionId, timestamp) {
+		reply.Err = rpc.ErrSessionClosed
+		return
+	}
+
+	membership, version := pn.membership()
+	oldVersion, newVersion = version, version
+	if args.FromVersion != -1 && args.FromVersion != version {
+		reply.Err = rpc.ErrVersion
+		return
+	}
+
+	for _, id := range args.Leaving {
+		if strings.HasPrefix(id, "server.") {
+			// Raft's peers are fixed
+			reply.Err = rpc.ErrFixedVoters
+			return
+		}
+		if membership.Leave(id) != nil {
+			reply.Err = rpc.ErrReconfig
+			return
+		}
+	}
+	for _, line := range args.Joining {
+		if membership.Join(line) != nil {
+			reply.Err = rpc.ErrReconfig
+			return
+		}
+	}
+
+	// Every voter, and only the voters, must have an address
+	for index := range membership.Voters {
+		if index >= len(pn.peers) {
+			reply.Err = rpc.ErrFixedVoters
+			return
+		}
+	}
+	if len(membership.Voters) != len(pn.peers) {
+		reply.Err = rpc.ErrReconfig
+		return
+	}
+
+	newVersion = pn.writeConfig(membership.String(), args.SessionId)
+	reply.Version = newVersion
+	reply.Err = rpc.OK
+}
+
+// Returns the current membership and the version of rpc.ConfigPath, or NoVersion if there is none yet. Must hold pn.mu.
+func (pn *PanServer) membership() (rpc.Membership, rpc.Pversion) {
+	path := rpc.ConfigPath
+	zn := pn.rootZNode.lookup(path.ParsePath())
+	if zn == nil {
+		return rpc.MakeMembership(), NoVersion
+	}
+	// Only applyReconfig writes the config, so it always parses
+	membership, _ := rpc.ParseMembership(zn.data)
+	return membership, zn.version
+}
+
+// Store data in rpc.ConfigPath, creating it and its parent if needed, and fire the watches on them.
+// Returns the config's new version. Must hold pn.mu.
+func (pn *PanServer) writeConfig(data string, sessionId int) rpc.Pversion {
+	path := rpc.ConfigPath
+	dirs := path.ParsePath()
+
+	znode, idx := pn.rootZNode.lookupPrefix(dirs)
+	if idx == -1 {
+		znode.data = data
+		znode.version++
+		pn.addFiredWatches(pn.dataWatches.fire(path))
+		return znode.version
+	}
+
+	createdPath := rpc.MakePpath(dirs[:idx])
+	for ; idx < len(dirs); idx++ {
+		pn.addFiredWatches(pn.childWatches.fire(createdPath))
+		znode, _ = znode.addChild(dirs[idx], "", false, "", sessionId)
+		createdPath = createdPath.Add("/" + znode.name)
+		pn.addFiredWatches(pn.createWatches.fire(createdPath))
+	}
+	znode.data = data
+
+	// A client watching the data of a config that doesn't exist yet wants to hear when it does
+	pn.addFiredWatches(pn.dataWatches.fire(path))
+	return znode.version
+}
+
+// Returns whether only Reconfig may change the znode at path.
+func isReadOnly(path rpc.Ppath) bool {
+	return path == rpc.ConfigPath || strings.HasPrefix(string(path), string(rpc.ConfigPath)+"/")
+}
+
+// Tell opts.OnReconfig about the current membership, if there is one.
+func (pn *PanServer) notifyConfig() {
+	if pn.opts.OnReconfig == nil {
+		return
+	}
+
+	pn.mu.Lock()
+	membership, version := pn.membership()
+	pn.mu.Unlock()
+
+	if version != NoVersion {
+		pn.opts.OnReconfig(membership)
+	}
+}
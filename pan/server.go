@@ -1,10 +1,11 @@
 package pan
 
 import (
-	// "fmt"
+	"log/slog"
 	"pan/panapi/rpc"
+	"reflect"
 	"sort"
-	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,21 +27,37 @@ type ZNode struct {
 	version  rpc.Pversion
 	children []*ZNode
 
-	creatorId       int
-	sequenceNums    map[string]int
+	creatorId int
+	ephemeral bool
+
+	// Sequence counter for sequential children, kept on the parent like ZooKeeper's cversion. It is shared by every
+	// name, so siblings with different names can be ordered by sequence number. It is part of the snapshot, so it never
+	// goes backwards after a restore.
+	sequenceNum     int
 	sessionToSeqNum map[Key]int
 }
 
+// Returns the sequence number the next sequential child would get, and false if the counter has run past
+// rpc.MaxSeqNum.
+func (zn *ZNode) nextSeqNum() (int, bool) {
+	return zn.sequenceNum, zn.sequenceNum <= rpc.MaxSeqNum
+}
+
 // Insert a node into a child's znode list at the correct spot.
+// If guid is set, the child is protected and its name carries the guid.
 // Returns the new node object and a bool indicating success/failure of the operation.
 // Failure only occurs if a child with the given name already exists.
-func (zn *ZNode) addChild(name string, data string, sequential bool, creatorId int) (*ZNode, bool) {
-	// If sequential, find the name
+func (zn *ZNode) addChild(name string, data string, sequential bool, guid string, creatorId int) (*ZNode, bool) {
 	childName := name
+	if guid != "" {
+		childName = rpc.ProtectedName(guid, name)
+	}
+
+	// If sequential, find the name
 	if sequential {
-		seqNum := zn.sequenceNums[name]
-		childName += strconv.Itoa(seqNum)
-		zn.sequenceNums[name] = seqNum + 1
+		seqNum := zn.sequenceNum
+		childName += rpc.SeqSuffix(seqNum)
+		zn.sequenceNum = seqNum + 1
 
 		zn.sessionToSeqNum[Key{creatorId, name}] = seqNum
 	}
@@ -51,7 +68,7 @@ func (zn *ZNode) addChild(name string, data string, sequential bool, creatorId i
 		return child, false
 	}
 
-	childZNode := ZNode{name: childName, data: data, version: 1, creatorId: creatorId, sequenceNums: make(map[string]int), sessionToSeqNum: make(map[Key]int)}
+	childZNode := ZNode{name: childName, data: data, version: 1, creatorId: creatorId, sessionToSeqNum: make(map[Key]int)}
 
 	zn.children = append(zn.children, &ZNode{})
 	copy(zn.children[idx+1:], zn.children[idx:])
@@ -80,9 +97,27 @@ func (zn *ZNode) findChild(name string) (*ZNode, int) {
 	}
 }
 
+// Find the protected child created with the given guid, whatever name and sequence suffix it got.
+// Returns nil if there is no such child.
+func (zn *ZNode) findProtectedChild(guid string) *ZNode {
+	prefix := rpc.ProtectedName(guid, "")
+	children := zn.children
+
+	// protected names share the guid prefix, so the match is where the prefix would sort
+	idx := sort.Search(len(children), func(i int) bool {
+		return children[i].name >= prefix
+	})
+
+	if idx < len(children) && strings.HasPrefix(children[idx].name, prefix) {
+		return children[idx]
+	}
+	return nil
+}
+
 // Given a name and a version number, removes the removes a znode child if the version number is up to date.
-// Checks the version number if checkVersion is set, otherwise, deletes unconditionally (used by ephemeral znodes).
-// Returns one of three rpc Error values: ErrNoFile, ErrVersion, or OK.
+// Checks the version number if checkVersion is set, otherwise, deletes regardless of version (used by ephemeral znodes).
+// A child that still has children of its own is never removed.
+// Returns one of four rpc Error values: ErrNoFile, ErrVersion, ErrNotEmpty, or OK.
 func (zn *ZNode) removeChild(name string, version rpc.Pversion, checkVersion bool) rpc.Err {
 	children := zn.children
 	child, idx := zn.findChild(name)
@@ -95,6 +130,10 @@ func (zn *ZNode) removeChild(name string, version rpc.Pversion, checkVersion boo
 		return rpc.ErrVersion
 	}
 
+	if len(child.children) > 0 {
+		return rpc.ErrNotEmpty
+	}
+
 	zn.children = append(children[:idx], children[idx+1:]...)
 	return rpc.OK
 }
@@ -163,6 +202,12 @@ func (watchlist *Watchlist) append(path rpc.Ppath, watch *Watch) {
 	watchlist.watches[path] = append(watchlist.watches[path], watch)
 }
 
+// Register a new watch requested by a client on one of the PanServer's watchlists.
+func (pn *PanServer) addWatch(watchlist *Watchlist, path rpc.Ppath, watch *Watch) {
+	watchlist.append(path, watch)
+	pn.countApplied("pan_watches_registered_total", watchlist.watchType)
+}
+
 // For a watchlist, remove any watches associated with the given sessionId
 func (watchlist *Watchlist) cleanup(sessionId int) {
 	for path, watches := range watchlist.watches {
@@ -207,10 +252,19 @@ func (pn *PanServer) getWatchId() int {
 	return id
 }
 
+// Count an event of applying a request in metric name. Every server applies every request, and applies the log
+// again after a restart, so only the server that submitted the request since it started counts it.
+func (pn *PanServer) countApplied(name string, label string) {
+	if pn.applyCounted {
+		pn.metrics.Inc(name, label)
+	}
+}
+
 // Given a map of fired watches produced by watchlist.fire(), add them to the PanServer's firedWatches map
 func (pn *PanServer) addFiredWatches(fired map[Watch]*rpc.WatchArgs) {
 	for w, wargs := range fired {
 		pn.firedWatches[w] = wargs
+		pn.countApplied("pan_watches_fired_total", wargs.EventType)
 	}
 	pn.watchCond.Broadcast()
 }
@@ -225,10 +279,15 @@ type PanServer struct {
 	mu        sync.Mutex
 	rootZNode *ZNode
 
+	opts ServerOptions
+
 	// Session data
-	sessions       map[int]time.Time // map session ID to timeout
-	sessionCounter int
-	ephemeralNodes map[int][]rpc.Ppath // map session IDs to list of ephemeral znode paths
+	sessions          map[int]time.Time     // map session ID to timeout
+	sessionTimeouts   map[int]time.Duration // map session ID to negotiated session timeout
+	sessionIdentities map[int]string        // map session ID to the identity its client gave, if any
+	sessionCounter    int
+	ephemeralNodes    map[int][]rpc.Ppath // map session IDs to list of ephemeral znode paths
+	batches           map[int]BatchState  // map session ID to the replies to its last batch
 
 	// Watches data
 	nextWatchId   int
@@ -238,85 +297,304 @@ type PanServer struct {
 	childWatches  Watchlist
 	firedWatches  map[Watch]*rpc.WatchArgs
 	watchCond     *sync.Cond
+
+	metrics *Metrics
+
+	// Audit and observer data
+	applyMu      sync.Mutex // held while applying a request, so the zxid always matches the applied state
+	zxid         int64      // number of requests applied, counting the one being applied
+	applyTime    time.Time  // replicated timestamp of the request being applied
+	applyCounted bool       // whether this server submitted the request being applied since it started
+	startMicros  int64      // when this server started, in the units of TimestampedRequest.Timestamp
+	auditRecords []AuditRecord
+	appliedLog   []TimestampedRequest // the most recently applied requests, for observers to catch up from
+	appliedBase  int64                // zxid of the request before appliedLog[0]
+	appliedCond  *sync.Cond
+
+	observer *observer // nil unless this server is an observer
+
+	// Group commit data
+	groupMu sync.Mutex
+	group   []pendingRequest // requests to submit together once the batch window closes
+
+	// Leader hint data
+	leader     int    // the server that submitted the last applied request
+	leaderAddr string // the address clients reach it at
+	leaderTerm int    // the term in which it did
 }
 
 type TimestampedRequest struct {
 	Timestamp int64 // int64 instead of time.Time to appease raft lab encoding
 	Request   any
+	Server    int    // the leader that submitted the request
+	Addr      string // the address clients reach that leader at
+	Term      int    // the Raft term in which it was submitted
+}
+
+// Returns the name of the operation a request performs, such as "Create" for rpc.CreateArgs, for labeling metrics.
+func opName(req any) string {
+	return strings.TrimSuffix(reflect.TypeOf(req).Name(), "Args")
+}
+
+// Log msg on a topic with this server's id attached.
+func (pn *PanServer) log(topic logTopic, level slog.Level, msg string, attrs ...any) {
+	panLog(topic, level, msg, append([]any{"server", pn.me}, attrs...)...)
+}
+
+// Returns the session, path, and result of an applied request as log attributes, for whichever of them the request
+// and reply have.
+func requestAttrs(req any, reply any) []any {
+	attrs := []any{"op", opName(req)}
+	args, result := reflect.ValueOf(req), reflect.ValueOf(reply).Elem()
+	// A new session's id is only in the reply
+	if field := args.FieldByName("SessionId"); field.IsValid() {
+		attrs = append(attrs, "session", field.Int())
+	} else if field := result.FieldByName("SessionId"); field.IsValid() {
+		attrs = append(attrs, "session", field.Int())
+	}
+	if field := args.FieldByName("Path"); field.IsValid() {
+		attrs = append(attrs, "path", field.String())
+	}
+	if field := result.FieldByName("Err"); field.IsValid() {
+		attrs = append(attrs, "err", field.String())
+	}
+	return attrs
+}
+
+// Submit a request to Raft, timestamped with the current time, and wait for it to be applied.
+// Returns the reply from DoOp, or false if this server is not the leader.
+func (pn *PanServer) submit(req any) (any, bool) {
+	if pn.observer != nil {
+		return pn.observe(req)
+	}
+
+	start := time.Now()
+	term, _ := pn.rsm.Raft().GetState()
+	tsReq := TimestampedRequest{Timestamp: start.UnixMicro(), Request: req, Server: pn.me, Addr: pn.opts.Addr, Term: term}
+	var res any
+	var ok bool
+	if pn.opts.BatchWindow > 0 {
+		res, ok = pn.submitGrouped(tsReq)
+	} else {
+		err, reply := pn.rsm.Submit(tsReq)
+		res, ok = reply, err != rpc.ErrWrongLeader
+	}
+	pn.metrics.Observe("pan_rpc_submit_seconds", opName(req), time.Since(start))
+
+	if !ok {
+		pn.metrics.Inc("pan_rpc_wrong_leader_total", opName(req))
+		pn.log(dLeader, slog.LevelDebug, "rejected request as not leader", "op", opName(req))
+		return nil, false
+	}
+	return res, true
+}
+
+// Returns the index among the voters and the address of the server this one believes leads, or false if it doesn't
+// know. The server that submitted the last applied request led in that term, so it still leads if no election has
+// started since; once one has, this server doesn't know who won until it applies a request submitted by the winner.
+func (pn *PanServer) knownLeader() (int, string, bool) {
+	if pn.observer != nil {
+		// Observers have no Raft term to tell whether the last leader still leads
+		return 0, "", false
+	}
+
+	term, _ := pn.rsm.Raft().GetState()
+
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	if pn.zxid == 0 || pn.leaderTerm != term || pn.leader == pn.me {
+		return 0, "", false
+	}
+	return pn.leader, pn.leaderAddr, true
+}
+
+// Returns the address of the server this one believes leads, for a reply with ErrWrongLeader, or rpc.NoLeader.
+func (pn *PanServer) leaderHint() string {
+	if _, addr, ok := pn.knownLeader(); ok {
+		return addr
+	}
+	return rpc.NoLeader
 }
 
 func (pn *PanServer) DoOp(tsReq any) any {
 	switch tsReq.(type) {
 	case TimestampedRequest:
-		tsReq := tsReq.(TimestampedRequest)
-		timestamp := time.UnixMicro(tsReq.Timestamp)
-		req := tsReq.Request
-		switch req.(type) {
-		case rpc.StartSessionArgs:
-			req := req.(rpc.StartSessionArgs)
-			reply := rpc.StartSessionReply{}
-			pn.applyStartSession(&req, &reply, timestamp)
-			return &reply
-		case rpc.EndSessionArgs:
-			req := req.(rpc.EndSessionArgs)
-			reply := rpc.EndSessionReply{}
-			pn.applyEndSession(&req, &reply)
-			return &reply
-		case rpc.KeepAliveArgs:
-			req := req.(rpc.KeepAliveArgs)
-			reply := rpc.KeepAliveReply{}
-			pn.applyKeepAlive(&req, &reply, timestamp)
-			return &reply
-		case rpc.CreateArgs:
-			req := req.(rpc.CreateArgs)
-			reply := rpc.CreateReply{}
-			pn.applyCreate(&req, &reply, timestamp)
-			return &reply
-		case rpc.ExistsArgs:
-			req := req.(rpc.ExistsArgs)
-			reply := rpc.ExistsReply{}
-			pn.applyExists(&req, &reply, timestamp)
-			return &reply
-		case rpc.GetDataArgs:
-			req := req.(rpc.GetDataArgs)
-			reply := rpc.GetDataReply{}
-			pn.applyGetData(&req, &reply, timestamp)
-			return &reply
-		case rpc.SetDataArgs:
-			req := req.(rpc.SetDataArgs)
-			reply := rpc.SetDataReply{}
-			pn.applySetData(&req, &reply, timestamp)
-			return &reply
-		case rpc.GetChildrenArgs:
-			req := req.(rpc.GetChildrenArgs)
-			reply := rpc.GetChildrenReply{}
-			pn.applyGetChildren(&req, &reply, timestamp)
-			return &reply
-		case rpc.DeleteArgs:
-			req := req.(rpc.DeleteArgs)
-			reply := rpc.DeleteReply{}
-			pn.applyDelete(&req, &reply, timestamp)
-			return &reply
-		case rpc.GetHighestSeqArgs:
-			req := req.(rpc.GetHighestSeqArgs)
-			reply := rpc.GetHighestSeqReply{}
-			pn.applyGetHighestSequence(&req, &reply, timestamp)
-			return &reply
+		return pn.doRequest(tsReq.(TimestampedRequest))
+	case TimestampedBatch:
+		batch := tsReq.(TimestampedBatch)
+		replies := make([]any, len(batch.Requests))
+		for i, tsReq := range batch.Requests {
+			replies[i] = pn.doRequest(tsReq)
 		}
+		return replies
 	}
 
 	return ""
 }
 
-func (pn *PanServer) Restore([]byte) {}
+// Apply one committed request as the next zxid, and return the reply.
+func (pn *PanServer) doRequest(tsReq TimestampedRequest) any {
+	timestamp := time.UnixMicro(tsReq.Timestamp)
+	req := tsReq.Request
+
+	start := time.Now()
+	defer func() {
+		if pn.applyCounted {
+			pn.metrics.Observe("pan_rpc_apply_seconds", opName(req), time.Since(start))
+		}
+	}()
+
+	pn.applyMu.Lock()
+	defer pn.applyMu.Unlock()
+
+	pn.mu.Lock()
+	pn.zxid++
+	pn.applyTime = timestamp
+	pn.applyCounted = pn.observer == nil && tsReq.Server == pn.me && tsReq.Timestamp >= pn.startMicros
+	pn.leader, pn.leaderAddr, pn.leaderTerm = tsReq.Server, tsReq.Addr, tsReq.Term
+	pn.mu.Unlock()
+
+	reply := pn.apply(req, timestamp)
+	pn.flushAudit()
+	pn.recordApplied(tsReq)
+	if reply == nil {
+		return ""
+	}
+	pn.log(dCommit, slog.LevelDebug, "applied", append(requestAttrs(req, reply), "zxid", pn.zxid, "timestamp", tsReq.Timestamp)...)
+	return reply
+}
+
+// Apply a committed request at its replicated timestamp, and return the reply.
+func (pn *PanServer) apply(req any, timestamp time.Time) any {
+	switch req.(type) {
+	case rpc.StartSessionArgs:
+		req := req.(rpc.StartSessionArgs)
+		reply := rpc.StartSessionReply{}
+		pn.applyStartSession(&req, &reply, timestamp)
+		return &reply
+	case rpc.EndSessionArgs:
+		req := req.(rpc.EndSessionArgs)
+		reply := rpc.EndSessionReply{}
+		pn.applyEndSession(&req, &reply)
+		return &reply
+	case rpc.KeepAliveArgs:
+		req := req.(rpc.KeepAliveArgs)
+		reply := rpc.KeepAliveReply{}
+		pn.applyKeepAlive(&req, &reply, timestamp)
+		return &reply
+	case rpc.CreateArgs:
+		req := req.(rpc.CreateArgs)
+		reply := rpc.CreateReply{}
+		pn.applyCreate(&req, &reply, timestamp)
+		return &reply
+	case rpc.ExistsArgs:
+		req := req.(rpc.ExistsArgs)
+		reply := rpc.ExistsReply{}
+		pn.applyExists(&req, &reply, timestamp)
+		return &reply
+	case rpc.GetDataArgs:
+		req := req.(rpc.GetDataArgs)
+		reply := rpc.GetDataReply{}
+		pn.applyGetData(&req, &reply, timestamp)
+		return &reply
+	case rpc.SetDataArgs:
+		req := req.(rpc.SetDataArgs)
+		reply := rpc.SetDataReply{}
+		pn.applySetData(&req, &reply, timestamp)
+		return &reply
+	case rpc.GetChildrenArgs:
+		req := req.(rpc.GetChildrenArgs)
+		reply := rpc.GetChildrenReply{}
+		pn.applyGetChildren(&req, &reply, timestamp)
+		return &reply
+	case rpc.DeleteArgs:
+		req := req.(rpc.DeleteArgs)
+		reply := rpc.DeleteReply{}
+		pn.applyDelete(&req, &reply, timestamp)
+		return &reply
+	case rpc.GetHighestSeqArgs:
+		req := req.(rpc.GetHighestSeqArgs)
+		reply := rpc.GetHighestSeqReply{}
+		pn.applyGetHighestSequence(&req, &reply, timestamp)
+		return &reply
+	case rpc.ReconfigArgs:
+		req := req.(rpc.ReconfigArgs)
+		reply := rpc.ReconfigReply{}
+		pn.applyReconfig(&req, &reply, timestamp)
+		if reply.Err == rpc.OK {
+			pn.notifyConfig()
+		}
+		return &reply
+	case rpc.BatchArgs:
+		req := req.(rpc.BatchArgs)
+		reply := rpc.BatchReply{}
+		pn.applyBatch(&req, &reply, timestamp)
+		return &reply
+	}
 
-func (pn *PanServer) Snapshot() []byte {
-	return make([]byte, 0)
+	return nil
+}
+
+const DefaultSessionTimeout = 5 * time.Second
+
+// How long a WatchWait call waits for its watch to fire before it returns rpc.ErrWatchPending
+const watchPollTimeout = 5 * time.Second
+
+// Options for a PanServer that are not part of the tester's StartServer interface
+type ServerOptions struct {
+	// The address clients reach this server at, which other servers hint at when this one leads. Defaults to the
+	// server's name in the tester.
+	Addr string
+
+	// Bounds on the session timeout a client may negotiate
+	MinSessionTimeout time.Duration
+	MaxSessionTimeout time.Duration
+
+	// Address on which a TCPPanServer serves admin commands over raw TCP. Empty to disable.
+	AdminAddr string
+
+	// Address on which a TCPPanServer serves metrics over HTTP at /metrics, in the Prometheus text format.
+	// Empty to disable.
+	MetricsAddr string
+
+	// Where the PanServer records its metrics. If nil, the PanServer makes its own.
+	Metrics *Metrics
+
+	// Where the PanServer records every applied mutation. Nil to disable auditing.
+	AuditLog *AuditLog
+
+	// Called with the new membership after each successful Reconfig, and after restoring a snapshot that has one.
+	// Must not call into the PanServer.
+	OnReconfig func(rpc.Membership)
+
+	// How long to hold a request so that other requests arriving meanwhile share its Raft entry. Zero submits each
+	// request on its own.
+	BatchWindow time.Duration
+
+	// Called by a TCPPanServer before it replies to a Raft peer or a client, so that no reply reports state
+	// that a crash could lose. Nil if state is only kept in memory.
+	Flush func() error
+}
+
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{MinSessionTimeout: DefaultSessionTimeout, MaxSessionTimeout: DefaultSessionTimeout}
+}
+
+// Clamp a requested session timeout to the configured bounds.
+// Done before submitting to Raft, so every replica applies the same timeout even if their options differ.
+func (pn *PanServer) negotiateTimeout(requested time.Duration) time.Duration {
+	if requested == 0 {
+		requested = DefaultSessionTimeout
+	}
+	return min(max(requested, pn.opts.MinSessionTimeout), pn.opts.MaxSessionTimeout)
 }
 
 // Sets a new session timeout, given that we last heard from the client at the given timestamp.
-func newSessionTimeout(timestamp time.Time) time.Time {
-	timeout := 5 * time.Second
+func (pn *PanServer) newSessionTimeout(sessionId int, timestamp time.Time) time.Time {
+	timeout, ok := pn.sessionTimeouts[sessionId]
+	if !ok {
+		timeout = DefaultSessionTimeout
+	}
 	return timestamp.Add(timeout)
 }
 
@@ -327,23 +605,32 @@ func (pn *PanServer) checkSession(sessionId int, timestamp time.Time) bool {
 
 	for session, timeout := range pn.sessions {
 		if session != sessionId && timestamp.After(timeout) {
+			pn.audit(auditExpireSession, session, "", NoVersion, NoVersion, rpc.OK)
 			pn.cleanupSession(session)
+			pn.countApplied("pan_sessions_expired_total", "")
+			pn.log(dInfo, slog.LevelInfo, "session expired", "session", session)
 		}
 	}
 
 	if !ok || timestamp.After(timeout) {
+		if ok {
+			pn.audit(auditExpireSession, sessionId, "", NoVersion, NoVersion, rpc.OK)
+			pn.countApplied("pan_sessions_expired_total", "")
+			pn.log(dInfo, slog.LevelInfo, "session expired", "session", sessionId)
+		}
 		pn.cleanupSession(sessionId)
 		return false
 	}
 
-	pn.sessions[sessionId] = newSessionTimeout(timestamp)
+	pn.sessions[sessionId] = pn.newSessionTimeout(sessionId, timestamp)
 	return true
 }
 
 // Cleans up a session that has ended, removing it from session list
 // and deleting ephemeral nodes.
 func (pn *PanServer) cleanupSession(sessionId int) {
-	ephemeralNodes := pn.ephemeralNodes[sessionId]
+	// Copy the list, since removing each znode also drops it from pn.ephemeralNodes
+	ephemeralNodes := append([]rpc.Ppath{}, pn.ephemeralNodes[sessionId]...)
 	for _, path := range ephemeralNodes {
 		path := path.ParsePath()
 
@@ -351,12 +638,7 @@ func (pn *PanServer) cleanupSession(sessionId int) {
 		parentNode := pn.rootZNode.lookup(parentPath)
 
 		if parentNode != nil {
-			parentNode.removeChild(path[len(path)-1], 0, false)
-
-			// Fire child watches on the parent
-			pn.addFiredWatches(pn.childWatches.fire(rpc.MakePpath(parentPath)))
-			// Fire delete watches on the child
-			pn.addFiredWatches(pn.deleteWatches.fire(rpc.MakePpath(path)))
+			pn.removeSubtree(parentNode, path)
 		}
 	}
 
@@ -364,16 +646,77 @@ func (pn *PanServer) cleanupSession(sessionId int) {
 	pn.cleanWatchlists(sessionId)
 
 	delete(pn.sessions, sessionId)
+	delete(pn.sessionTimeouts, sessionId)
+	delete(pn.sessionIdentities, sessionId)
 	delete(pn.ephemeralNodes, sessionId)
+	delete(pn.batches, sessionId)
+}
+
+// Removes an empty znode at path from parentNode, checking the version number if checkVersion is set.
+// On success, fires child watches on the parent and delete watches on the znode,
+// and drops the znode from its session's ephemeral bookkeeping.
+// Returns the rpc Error value produced by removeChild.
+func (pn *PanServer) removeZNode(parentNode *ZNode, path []string, version rpc.Pversion, checkVersion bool) rpc.Err {
+	child, _ := parentNode.findChild(path[len(path)-1])
+
+	err := parentNode.removeChild(path[len(path)-1], version, checkVersion)
+	if err != rpc.OK {
+		return err
+	}
+
+	znodePath := rpc.MakePpath(path)
+	if child.ephemeral {
+		pn.forgetEphemeral(child.creatorId, znodePath)
+	}
+
+	// Fire child watches on the parent
+	pn.addFiredWatches(pn.childWatches.fire(rpc.MakePpath(path[:len(path)-1])))
+	// Fire delete watches on the child
+	pn.addFiredWatches(pn.deleteWatches.fire(znodePath))
+
+	return rpc.OK
+}
+
+// Removes the znode at path from parentNode together with everything below it.
+// Descendants are removed bottom-up through removeZNode, so every removed znode fires its watches
+// and leaves the ephemeral bookkeeping, no matter which session owns it.
+func (pn *PanServer) removeSubtree(parentNode *ZNode, path []string) {
+	child, _ := parentNode.findChild(path[len(path)-1])
+	if child == nil {
+		return
+	}
+
+	for len(child.children) > 0 {
+		childPath := append(append([]string{}, path...), child.children[0].name)
+		pn.removeSubtree(child, childPath)
+	}
+
+	op := auditDeleteSubtree
+	if child.ephemeral {
+		op = auditDeleteEphemeral
+	}
+	err := pn.removeZNode(parentNode, path, 0, false)
+	pn.audit(op, child.creatorId, rpc.MakePpath(path), child.version, NoVersion, err)
+}
+
+// Removes an ephemeral znode path from the list of ephemeral znodes owned by a session.
+func (pn *PanServer) forgetEphemeral(sessionId int, path rpc.Ppath) {
+	paths := pn.ephemeralNodes[sessionId]
+	for i, ephemeralPath := range paths {
+		if ephemeralPath == path {
+			pn.ephemeralNodes[sessionId] = append(paths[:i], paths[i+1:]...)
+			return
+		}
+	}
 }
 
 // Returns the highest sequence number of a node with a given path owned by the current session.
 func (pn *PanServer) GetHighestSequence(args *rpc.GetHighestSeqArgs, reply *rpc.GetHighestSeqReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.GetHighestSeqReply))
 	}
@@ -412,11 +755,14 @@ func (pn *PanServer) applyGetHighestSequence(args *rpc.GetHighestSeqArgs, reply
 
 // Start a session for a given client. Returns a session ID.
 func (pn *PanServer) StartSession(args *rpc.StartSessionArgs, reply *rpc.StartSessionReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	negotiated := *args
+	negotiated.Timeout = pn.negotiateTimeout(args.Timeout)
+
+	res, ok := pn.submit(negotiated)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.StartSessionReply))
 	}
@@ -428,19 +774,27 @@ func (pn *PanServer) applyStartSession(args *rpc.StartSessionArgs, reply *rpc.St
 
 	sessionId := pn.sessionCounter
 	pn.sessionCounter++
-	pn.sessions[sessionId] = newSessionTimeout(timestamp)
+	pn.sessionTimeouts[sessionId] = args.Timeout
+	if args.Identity != "" {
+		pn.sessionIdentities[sessionId] = args.Identity
+	}
+	pn.sessions[sessionId] = pn.newSessionTimeout(sessionId, timestamp)
+
+	pn.countApplied("pan_sessions_created_total", "")
+	pn.audit(auditStartSession, sessionId, "", NoVersion, NoVersion, rpc.OK)
 
 	reply.Err = rpc.OK
 	reply.SessionId = sessionId
+	reply.Timeout = args.Timeout
 }
 
 // Create a znode.
 func (pn *PanServer) Create(args *rpc.CreateArgs, reply *rpc.CreateReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.CreateReply))
 	}
@@ -450,19 +804,54 @@ func (pn *PanServer) applyCreate(args *rpc.CreateArgs, reply *rpc.CreateReply, t
 	pn.mu.Lock()
 	defer pn.mu.Unlock()
 
+	// Successful creates are audited per znode as they are added
+	defer func() {
+		if reply.Err != rpc.OK {
+			pn.audit(auditCreate, args.SessionId, args.Path, NoVersion, NoVersion, reply.Err)
+		}
+	}()
+
 	if !pn.checkSession(args.SessionId, timestamp) {
 		reply.Err = rpc.ErrSessionClosed
 		return
 	}
 
+	if isReadOnly(args.Path) {
+		reply.Err = rpc.ErrReadOnly
+		return
+	}
+
 	path := args.Path.ParsePath()
 
-	znode, idx := pn.rootZNode.lookupPrefix(path)
+	if args.Guid != "" {
+		// A retried protected create may already have been applied under a sequence number
+		// the client never saw, so match on the guid rather than the full name
+		if parent := pn.rootZNode.lookup(path[:len(path)-1]); parent != nil {
+			if child := parent.findProtectedChild(args.Guid); child != nil {
+				reply.ZNodeName = rpc.MakePpath(append(append([]string{}, path[:len(path)-1]...), child.name))
+				reply.CreatedBy = child.creatorId
+				reply.Err = rpc.ErrOnCreate
+				return
+			}
+		}
+	}
+
+	lookupPath := path
+	if args.Guid != "" {
+		// Look up protected znodes by the name they will actually get
+		lookupPath = append(append([]string{}, path[:len(path)-1]...), rpc.ProtectedName(args.Guid, path[len(path)-1]))
+	}
+
+	znode, idx := pn.rootZNode.lookupPrefix(lookupPath)
 	createdPath := args.Path
 
 	if idx == -1 {
+		reply.ZNodeName = args.Path
 		reply.CreatedBy = znode.creatorId
 		reply.Err = rpc.ErrOnCreate
+	} else if _, ok := znode.nextSeqNum(); idx == len(path)-1 && args.Flags.Sequential && !ok {
+		// The parent already exists and has handed out every sequence number
+		reply.Err = rpc.ErrSeqOverflow
 	} else {
 		createdPath = rpc.MakePpath(path[:idx])
 
@@ -472,12 +861,14 @@ func (pn *PanServer) applyCreate(args *rpc.CreateArgs, reply *rpc.CreateReply, t
 
 			// ignore the success/failure flag from addChild because already existing child should have been caught by lookupPrefix
 			if idx == len(path)-1 {
-				znode, _ = znode.addChild(path[idx], args.Data, args.Flags.Sequential, args.SessionId)
+				znode, _ = znode.addChild(path[idx], args.Data, args.Flags.Sequential, args.Guid, args.SessionId)
+				znode.ephemeral = args.Flags.Ephemeral
 			} else {
-				znode, _ = znode.addChild(path[idx], "", false, args.SessionId)
+				znode, _ = znode.addChild(path[idx], "", false, "", args.SessionId)
 			}
 
 			createdPath = createdPath.Add("/" + znode.name)
+			pn.audit(auditCreate, args.SessionId, createdPath, NoVersion, znode.version, rpc.OK)
 
 			// fire the create watches with the updated path name, since we just created this node
 			pn.addFiredWatches(pn.createWatches.fire(createdPath))
@@ -495,11 +886,11 @@ func (pn *PanServer) applyCreate(args *rpc.CreateArgs, reply *rpc.CreateReply, t
 
 // Check if a given znode exists.
 func (pn *PanServer) Exists(args *rpc.ExistsArgs, reply *rpc.ExistsReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.ExistsReply))
 	}
@@ -514,6 +905,11 @@ func (pn *PanServer) applyExists(args *rpc.ExistsArgs, reply *rpc.ExistsReply, t
 		return
 	}
 
+	pn.exists(args, reply, pn.getWatchId)
+}
+
+// Check whether a znode exists, registering a watch with an id from nextWatchId if asked. Must hold pn.mu.
+func (pn *PanServer) exists(args *rpc.ExistsArgs, reply *rpc.ExistsReply, nextWatchId func() int) {
 	path := args.Path.ParsePath()
 	zn := pn.rootZNode.lookup(path)
 
@@ -523,25 +919,25 @@ func (pn *PanServer) applyExists(args *rpc.ExistsArgs, reply *rpc.ExistsReply, t
 
 	// add a watch if the flag is set
 	if args.Watch.ShouldWatch {
-		watchId := pn.getWatchId()
+		watchId := nextWatchId()
 		reply.WatchId = watchId
 
 		// TODO is this right
 		if reply.Result {
-			pn.deleteWatches.append(args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
+			pn.addWatch(&pn.deleteWatches, args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
 		} else {
-			pn.createWatches.append(args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
+			pn.addWatch(&pn.createWatches, args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
 		}
 	}
 }
 
 // Get the data for a given znode.
 func (pn *PanServer) GetData(args *rpc.GetDataArgs, reply *rpc.GetDataReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.GetDataReply))
 	}
@@ -556,6 +952,11 @@ func (pn *PanServer) applyGetData(args *rpc.GetDataArgs, reply *rpc.GetDataReply
 		return
 	}
 
+	pn.getData(args, reply, pn.getWatchId)
+}
+
+// Read a znode, registering a watch with an id from nextWatchId if asked. Must hold pn.mu.
+func (pn *PanServer) getData(args *rpc.GetDataArgs, reply *rpc.GetDataReply, nextWatchId func() int) {
 	path := args.Path.ParsePath()
 	zn := pn.rootZNode.lookup(path)
 
@@ -569,19 +970,19 @@ func (pn *PanServer) applyGetData(args *rpc.GetDataArgs, reply *rpc.GetDataReply
 
 	// add a watch if the flag is set
 	if args.Watch.ShouldWatch {
-		watchId := pn.getWatchId()
+		watchId := nextWatchId()
 		reply.WatchId = watchId
-		pn.dataWatches.append(args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
+		pn.addWatch(&pn.dataWatches, args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
 	}
 }
 
 // Set the data for a given znode.
 func (pn *PanServer) SetData(args *rpc.SetDataArgs, reply *rpc.SetDataReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.SetDataReply))
 	}
@@ -591,13 +992,27 @@ func (pn *PanServer) applySetData(args *rpc.SetDataArgs, reply *rpc.SetDataReply
 	pn.mu.Lock()
 	defer pn.mu.Unlock()
 
+	oldVersion, newVersion := NoVersion, NoVersion
+	defer func() {
+		pn.audit(auditSetData, args.SessionId, args.Path, oldVersion, newVersion, reply.Err)
+	}()
+
 	if !pn.checkSession(args.SessionId, timestamp) {
 		reply.Err = rpc.ErrSessionClosed
 		return
 	}
 
+	if isReadOnly(args.Path) {
+		reply.Err = rpc.ErrReadOnly
+		return
+	}
+
 	path := args.Path.ParsePath()
 	zn := pn.rootZNode.lookup(path)
+	if zn != nil {
+		oldVersion = zn.version
+		defer func() { newVersion = zn.version }()
+	}
 
 	if zn != nil {
 		if zn.version == args.Version {
@@ -618,11 +1033,11 @@ func (pn *PanServer) applySetData(args *rpc.SetDataArgs, reply *rpc.SetDataReply
 
 // Get the children for a given znode.
 func (pn *PanServer) GetChildren(args *rpc.GetChildrenArgs, reply *rpc.GetChildrenReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.GetChildrenReply))
 	}
@@ -637,6 +1052,11 @@ func (pn *PanServer) applyGetChildren(args *rpc.GetChildrenArgs, reply *rpc.GetC
 		return
 	}
 
+	pn.getChildren(args, reply, pn.getWatchId)
+}
+
+// List a znode's children, registering a watch with an id from nextWatchId if asked. Must hold pn.mu.
+func (pn *PanServer) getChildren(args *rpc.GetChildrenArgs, reply *rpc.GetChildrenReply, nextWatchId func() int) {
 	path := args.Path.ParsePath()
 	zn := pn.rootZNode.lookup(path)
 
@@ -651,9 +1071,9 @@ func (pn *PanServer) applyGetChildren(args *rpc.GetChildrenArgs, reply *rpc.GetC
 
 		// add a watch if the flag is set
 		if args.Watch.ShouldWatch {
-			watchId := pn.getWatchId()
+			watchId := nextWatchId()
 			reply.WatchId = watchId
-			pn.childWatches.append(args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
+			pn.addWatch(&pn.childWatches, args.Path, &Watch{watchId: watchId, sessionId: args.SessionId})
 		}
 	} else {
 		reply.Err = rpc.ErrNoFile
@@ -662,11 +1082,11 @@ func (pn *PanServer) applyGetChildren(args *rpc.GetChildrenArgs, reply *rpc.GetC
 
 // Delete a given znode.
 func (pn *PanServer) Delete(args *rpc.DeleteArgs, reply *rpc.DeleteReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.DeleteReply))
 	}
@@ -676,11 +1096,21 @@ func (pn *PanServer) applyDelete(args *rpc.DeleteArgs, reply *rpc.DeleteReply, t
 	pn.mu.Lock()
 	defer pn.mu.Unlock()
 
+	oldVersion, newVersion := NoVersion, NoVersion
+	defer func() {
+		pn.audit(auditDelete, args.SessionId, args.Path, oldVersion, newVersion, reply.Err)
+	}()
+
 	if !pn.checkSession(args.SessionId, timestamp) {
 		reply.Err = rpc.ErrSessionClosed
 		return
 	}
 
+	if isReadOnly(args.Path) {
+		reply.Err = rpc.ErrReadOnly
+		return
+	}
+
 	path := args.Path.ParsePath()
 	// Don't allow deletion of root node
 	if len(path) <= 1 {
@@ -695,22 +1125,23 @@ func (pn *PanServer) applyDelete(args *rpc.DeleteArgs, reply *rpc.DeleteReply, t
 		return
 	}
 
-	reply.Err = parentNode.removeChild(path[len(path)-1], args.Version, true)
-
-	// Fire child watches on the parent
-	pn.addFiredWatches(pn.childWatches.fire(rpc.MakePpath(parentPath)))
-
-	// Fire delete watches on the child
-	pn.addFiredWatches(pn.deleteWatches.fire(args.Path))
+	if child, _ := parentNode.findChild(path[len(path)-1]); child != nil {
+		oldVersion = child.version
+		newVersion = child.version
+	}
+	reply.Err = pn.removeZNode(parentNode, path, args.Version, true)
+	if reply.Err == rpc.OK {
+		newVersion = NoVersion
+	}
 }
 
 // Reset the timeout for a given session.
 func (pn *PanServer) KeepAlive(args *rpc.KeepAliveArgs, reply *rpc.KeepAliveReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.KeepAliveReply))
 	}
@@ -727,11 +1158,11 @@ func (pn *PanServer) applyKeepAlive(args *rpc.KeepAliveArgs, reply *rpc.KeepAliv
 
 // End the session with a given sessionId.
 func (pn *PanServer) EndSession(args *rpc.EndSessionArgs, reply *rpc.EndSessionReply) {
-	tsReq := TimestampedRequest{Timestamp: time.Now().UnixMicro(), Request: *args}
-	err, res := pn.rsm.Submit(tsReq)
+	res, ok := pn.submit(*args)
 
-	if err == rpc.ErrWrongLeader {
+	if !ok {
 		reply.Err = rpc.ErrWrongLeader
+		reply.Leader = pn.leaderHint()
 	} else {
 		*reply = *(res.(*rpc.EndSessionReply))
 	}
@@ -741,6 +1172,10 @@ func (pn *PanServer) applyEndSession(args *rpc.EndSessionArgs, reply *rpc.EndSes
 	pn.mu.Lock()
 	defer pn.mu.Unlock()
 
+	if _, ok := pn.sessions[args.SessionId]; ok {
+		pn.countApplied("pan_sessions_closed_total", "")
+		pn.audit(auditEndSession, args.SessionId, "", NoVersion, NoVersion, rpc.OK)
+	}
 	pn.cleanupSession(args.SessionId)
 	reply.Err = rpc.OK
 }
@@ -749,6 +1184,16 @@ func (pn *PanServer) applyEndSession(args *rpc.EndSessionArgs, reply *rpc.EndSes
 func (pn *PanServer) WatchWait(args *rpc.WatchWaitArgs, reply *rpc.WatchWaitReply) {
 	goalWatch := Watch{sessionId: args.SessionId, watchId: args.WatchId}
 
+	// Long poll: give up after watchPollTimeout, well before a transport would time the call out, and let the session
+	// wait again
+	deadline := time.Now().Add(watchPollTimeout)
+	timer := time.AfterFunc(watchPollTimeout, func() {
+		pn.mu.Lock()
+		defer pn.mu.Unlock()
+		pn.watchCond.Broadcast()
+	})
+	defer timer.Stop()
+
 	for !pn.killed() {
 		pn.mu.Lock()
 
@@ -761,12 +1206,31 @@ func (pn *PanServer) WatchWait(args *rpc.WatchWaitArgs, reply *rpc.WatchWaitRepl
 			pn.mu.Unlock()
 			return
 		}
+		if !time.Now().Before(deadline) {
+			reply.Err = rpc.ErrWatchPending
+			pn.mu.Unlock()
+			return
+		}
 		pn.watchCond.Wait()
 
 		pn.mu.Unlock()
 	}
 }
 
+// Returns the metrics this server records.
+func (pn *PanServer) Metrics() *Metrics {
+	return pn.metrics
+}
+
+// Returns the number of znodes, including the root.
+func (pn *PanServer) znodeCount() float64 {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	count, _ := pn.rootZNode.count("")
+	return float64(count)
+}
+
 // Kill this server.
 func (pn *PanServer) Kill() {
 	atomic.StoreInt32(&pn.dead, 1)
@@ -790,18 +1254,55 @@ func registerLabgobArgs() {
 	labgob.Register(rpc.DeleteArgs{})
 	labgob.Register(rpc.GetHighestSeqArgs{})
 	labgob.Register(rpc.WatchWaitArgs{})
+	labgob.Register(rpc.ReconfigArgs{})
+	labgob.Register(rpc.BatchArgs{})
 	labgob.Register(TimestampedRequest{})
+	labgob.Register(TimestampedBatch{})
+	labgob.Register(rpc.StartSessionReply{})
+	labgob.Register(rpc.EndSessionReply{})
+	labgob.Register(rpc.KeepAliveReply{})
+	labgob.Register(rpc.CreateReply{})
+	labgob.Register(rpc.SetDataReply{})
+	labgob.Register(rpc.DeleteReply{})
+	labgob.Register(rpc.GetHighestSeqReply{})
+	labgob.Register(rpc.ReconfigReply{})
+	labgob.Register(rpc.BatchReply{})
+	labgob.Register(rpc.ExistsReply{})
+	labgob.Register(rpc.GetDataReply{})
+	labgob.Register(rpc.GetChildrenReply{})
 }
 
 // Must return quickly
 func StartPanServer(servers []*labrpc.ClientEnd, gid tester.Tgid, me int, persister *tester.Persister, maxraftstate int) []tester.IService {
+	return StartPanServerWithOptions(servers, gid, me, persister, maxraftstate, DefaultServerOptions())
+}
+
+// Like StartPanServer, but with options outside the tester's interface. Must return quickly.
+func StartPanServerWithOptions(servers []*labrpc.ClientEnd, gid tester.Tgid, me int, persister *tester.Persister, maxraftstate int, opts ServerOptions) []tester.IService {
+	if opts.Addr == "" {
+		opts.Addr = tester.ServerName(gid, me)
+	}
+	pn := makePanServer(servers, me, opts)
+	pn.rsm = rsm.MakeRSM(servers, me, persister, maxraftstate, pn)
+
+	return []tester.IService{pn, pn.rsm.Raft()}
+}
+
+// Make a PanServer with an empty tree, before it is attached to Raft or to the voters it observes.
+func makePanServer(servers []*labrpc.ClientEnd, me int, opts ServerOptions) *PanServer {
 	registerLabgobArgs()
 
-	pn := &PanServer{me: me, peers: servers, rootZNode: &ZNode{name: "", sequenceNums: make(map[string]int), sessionToSeqNum: make(map[Key]int)}, sessions: make(map[int]time.Time), ephemeralNodes: make(map[int][]rpc.Ppath)}
+	pn := &PanServer{me: me, peers: servers, opts: opts, rootZNode: &ZNode{name: "", sessionToSeqNum: make(map[Key]int)}, sessions: make(map[int]time.Time), sessionTimeouts: make(map[int]time.Duration), sessionIdentities: make(map[int]string), ephemeralNodes: make(map[int][]rpc.Ppath), batches: make(map[int]BatchState)}
+
+	pn.startMicros = time.Now().UnixMicro()
+	pn.metrics = opts.Metrics
+	if pn.metrics == nil {
+		pn.metrics = MakeMetrics()
+	}
+	pn.metrics.SetGaugeFunc("pan_znode_count", pn.znodeCount)
 
 	pn.initializeWatchlists()
 	pn.watchCond = sync.NewCond(&pn.mu)
-	pn.rsm = rsm.MakeRSM(servers, me, persister, maxraftstate, pn)
-
-	return []tester.IService{pn, pn.rsm.Raft()}
+	pn.appliedCond = sync.NewCond(&pn.mu)
+	return pn
 }
@@ -0,0 +1,251 @@
+package pan
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"pan/panapi/rpc"
+	"sort"
+	"time"
+
+	"6.5840/labgob"
+)
+
+// Exported mirrors of the PanServer's replicated state, so that labgob can encode it
+
+type SessionSeqNum struct {
+	SessionId      int
+	SequencePrefix string
+	SeqNum         int
+}
+
+type ZNodeState struct {
+	Name      string
+	Data      string
+	Version   rpc.Pversion
+	Children  []ZNodeState
+	CreatorId int
+	Ephemeral bool
+
+	SequenceNum    int
+	SessionSeqNums []SessionSeqNum
+}
+
+type WatchState struct {
+	Path      rpc.Ppath
+	SessionId int
+	WatchId   int
+}
+
+type FiredWatchState struct {
+	SessionId int
+	WatchId   int
+	Event     rpc.WatchArgs
+}
+
+type PanState struct {
+	Root              ZNodeState
+	Sessions          map[int]int64 // session timeouts in unix microseconds
+	SessionTimeouts   map[int]time.Duration
+	SessionIdentities map[int]string
+	SessionCounter    int
+	EphemeralNodes    map[int][]rpc.Ppath
+	Batches           map[int]BatchState
+	Zxid              int64
+
+	NextWatchId   int
+	DataWatches   []WatchState
+	CreateWatches []WatchState
+	DeleteWatches []WatchState
+	ChildWatches  []WatchState
+	FiredWatches  []FiredWatchState
+}
+
+// Convert a znode and its subtree into its exported form
+func (zn *ZNode) toState() ZNodeState {
+	state := ZNodeState{
+		Name:        zn.name,
+		Data:        zn.data,
+		Version:     zn.version,
+		Children:    make([]ZNodeState, len(zn.children)),
+		CreatorId:   zn.creatorId,
+		Ephemeral:   zn.ephemeral,
+		SequenceNum: zn.sequenceNum,
+	}
+	for i, child := range zn.children {
+		state.Children[i] = child.toState()
+	}
+	for key, seqNum := range zn.sessionToSeqNum {
+		state.SessionSeqNums = append(state.SessionSeqNums, SessionSeqNum{SessionId: key.sessionId, SequencePrefix: key.sequencePrefix, SeqNum: seqNum})
+	}
+	return state
+}
+
+// Rebuild a znode and its subtree from its exported form
+func (state *ZNodeState) toZNode() *ZNode {
+	zn := &ZNode{
+		name:            state.Name,
+		data:            state.Data,
+		version:         state.Version,
+		children:        make([]*ZNode, len(state.Children)),
+		creatorId:       state.CreatorId,
+		ephemeral:       state.Ephemeral,
+		sequenceNum:     state.SequenceNum,
+		sessionToSeqNum: make(map[Key]int),
+	}
+	for i := range state.Children {
+		zn.children[i] = state.Children[i].toZNode()
+	}
+	for _, s := range state.SessionSeqNums {
+		zn.sessionToSeqNum[Key{s.SessionId, s.SequencePrefix}] = s.SeqNum
+	}
+	return zn
+}
+
+// Flatten a watchlist into a list of watches, sorted so that snapshots are deterministic.
+// If local is set, returns only the watches registered by an observer's local reads, and otherwise only the others.
+func (watchlist *Watchlist) toState(local bool) []WatchState {
+	states := []WatchState{}
+	for path, watches := range watchlist.watches {
+		for _, watch := range watches {
+			if (watch.watchId < 0) == local {
+				states = append(states, WatchState{Path: path, SessionId: watch.sessionId, WatchId: watch.watchId})
+			}
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].WatchId < states[j].WatchId
+	})
+	return states
+}
+
+// Refill a watchlist from a list of watches
+func (watchlist *Watchlist) restore(states []WatchState) {
+	for _, state := range states {
+		watchlist.append(state.Path, &Watch{sessionId: state.SessionId, watchId: state.WatchId})
+	}
+}
+
+// Encode the full replicated state: the znode tree (including sequence counters), sessions, and watches.
+func (pn *PanServer) Snapshot() []byte {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	state := PanState{
+		Root:              pn.rootZNode.toState(),
+		Sessions:          make(map[int]int64),
+		SessionTimeouts:   pn.sessionTimeouts,
+		SessionIdentities: pn.sessionIdentities,
+		SessionCounter:    pn.sessionCounter,
+		EphemeralNodes:    pn.ephemeralNodes,
+		Batches:           pn.batches,
+		Zxid:              pn.zxid,
+		NextWatchId:       pn.nextWatchId,
+		DataWatches:       pn.dataWatches.toState(false),
+		CreateWatches:     pn.createWatches.toState(false),
+		DeleteWatches:     pn.deleteWatches.toState(false),
+		ChildWatches:      pn.childWatches.toState(false),
+	}
+	for sessionId, timeout := range pn.sessions {
+		state.Sessions[sessionId] = timeout.UnixMicro()
+	}
+	for watch, event := range pn.firedWatches {
+		if watch.watchId < 0 {
+			continue
+		}
+		state.FiredWatches = append(state.FiredWatches, FiredWatchState{SessionId: watch.sessionId, WatchId: watch.watchId, Event: *event})
+	}
+
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	if err := e.Encode(state); err != nil {
+		log.Fatalf("PanServer %d failed to encode snapshot: %v", pn.me, err)
+	}
+	pn.metrics.Set("pan_snapshot_size_bytes", "", float64(w.Len()))
+	pn.log(dSnap, slog.LevelDebug, "took snapshot", "bytes", w.Len())
+	return w.Bytes()
+}
+
+// Replace the replicated state with the one encoded in a snapshot produced by Snapshot.
+func (pn *PanServer) Restore(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	var state PanState
+	d := labgob.NewDecoder(bytes.NewBuffer(data))
+	if err := d.Decode(&state); err != nil {
+		log.Fatalf("PanServer %d failed to decode snapshot: %v", pn.me, err)
+	}
+
+	pn.log(dSnap, slog.LevelInfo, "restoring snapshot", "bytes", len(data))
+
+	// Runs once the locks below are released
+	defer pn.notifyConfig()
+
+	pn.applyMu.Lock()
+	defer pn.applyMu.Unlock()
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	// Watches from an observer's local reads are not in the snapshot, so carry them over
+	localWatches := [][]WatchState{pn.dataWatches.toState(true), pn.createWatches.toState(true), pn.deleteWatches.toState(true), pn.childWatches.toState(true)}
+	localFired := make(map[Watch]*rpc.WatchArgs)
+	for watch, event := range pn.firedWatches {
+		if watch.watchId < 0 {
+			localFired[watch] = event
+		}
+	}
+
+	pn.rootZNode = state.Root.toZNode()
+
+	pn.sessions = make(map[int]time.Time)
+	for sessionId, timeout := range state.Sessions {
+		pn.sessions[sessionId] = time.UnixMicro(timeout)
+	}
+	pn.sessionTimeouts = state.SessionTimeouts
+	if pn.sessionTimeouts == nil {
+		pn.sessionTimeouts = make(map[int]time.Duration)
+	}
+	pn.sessionIdentities = state.SessionIdentities
+	if pn.sessionIdentities == nil {
+		pn.sessionIdentities = make(map[int]string)
+	}
+	pn.sessionCounter = state.SessionCounter
+	pn.zxid = state.Zxid
+	pn.appliedLog, pn.appliedBase = nil, state.Zxid
+	pn.ephemeralNodes = state.EphemeralNodes
+	if pn.ephemeralNodes == nil {
+		pn.ephemeralNodes = make(map[int][]rpc.Ppath)
+	}
+	pn.batches = state.Batches
+	if pn.batches == nil {
+		pn.batches = make(map[int]BatchState)
+	}
+
+	pn.initializeWatchlists()
+	pn.nextWatchId = state.NextWatchId
+	pn.dataWatches.restore(state.DataWatches)
+	pn.createWatches.restore(state.CreateWatches)
+	pn.deleteWatches.restore(state.DeleteWatches)
+	pn.childWatches.restore(state.ChildWatches)
+	for _, fired := range state.FiredWatches {
+		event := fired.Event
+		pn.firedWatches[Watch{sessionId: fired.SessionId, watchId: fired.WatchId}] = &event
+	}
+
+	for i, watchlist := range pn.watchlists() {
+		for _, watch := range localWatches[i] {
+			if _, live := pn.sessions[watch.SessionId]; live {
+				watchlist.append(watch.Path, &Watch{sessionId: watch.SessionId, watchId: watch.WatchId})
+			}
+		}
+	}
+	for watch, event := range localFired {
+		if _, live := pn.sessions[watch.sessionId]; live {
+			pn.firedWatches[watch] = event
+		}
+	}
+	pn.watchCond.Broadcast()
+	pn.appliedCond.Broadcast()
+}
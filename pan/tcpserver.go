@@ -0,0 +1,473 @@
+package pan
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	netrpc "net/rpc"
+	"pan/panapi/rpc"
+	"strconv"
+	"sync"
+	"time"
+
+	"6.5840/labrpc"
+	raft "6.5840/raft1"
+	tester "6.5840/tester1"
+)
+
+// A PanServer whose clients and Raft peers reach it over TCP instead of the labrpc simulator.
+//
+// Raft and the RSM only know how to talk through labrpc ClientEnds, so each TCPPanServer runs a private labrpc network.
+// Outgoing Raft RPCs are delivered on that network to a Raft proxy per peer, which forwards them over TCP;
+// incoming Raft RPCs arrive over TCP and are handed to the local Raft through the same network.
+type TCPPanServer struct {
+	pn        *PanServer
+	opts      ServerOptions
+	raft      tester.IService
+	network   *labrpc.Network
+	listener  net.Listener
+	admin     net.Listener // nil unless opts.AdminAddr is set
+	metrics   *http.Server // nil unless opts.MetricsAddr is set
+	transport *TCPTransport
+	peers     []*raftPeer // nil at index me, and for an observer
+	voters    []*tcpVoter // nil unless this is an observer
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool // accepted connections still being served
+	killed bool
+}
+
+const adminTimeout = 5 * time.Second
+
+// Start replica me of the ensemble whose replicas listen on addrs, and serve it on addrs[me].
+// Must return quickly, like StartPanServer.
+func StartTCPPanServer(addrs []string, me int, persister *tester.Persister, maxraftstate int, opts ServerOptions) (*TCPPanServer, error) {
+	listener, err := net.Listen("tcp", addrs[me])
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &TCPPanServer{opts: opts, network: labrpc.MakeNetwork(), listener: listener, transport: MakeTCPTransport(), peers: make([]*raftPeer, len(addrs)), conns: make(map[net.Conn]bool)}
+
+	ends := make([]*labrpc.ClientEnd, len(addrs))
+	for i, addr := range addrs {
+		name := "peer-" + strconv.Itoa(i)
+		ends[i] = ts.network.MakeEnd(name)
+		if i == me {
+			continue
+		}
+
+		peer := &raftPeer{network: ts.network, name: name, addr: addr, transport: ts.transport}
+		ts.peers[i] = peer
+		peer.serve()
+		ts.network.Connect(name, name)
+		ts.network.Enable(name, true)
+	}
+
+	if opts.Addr == "" {
+		opts.Addr = addrs[me]
+	}
+
+	// Follow voters that Reconfig moves to new addresses
+	onReconfig := opts.OnReconfig
+	opts.OnReconfig = func(membership rpc.Membership) {
+		ts.movePeers(membership)
+		if onReconfig != nil {
+			onReconfig(membership)
+		}
+	}
+
+	services := StartPanServerWithOptions(ends, tester.GRP0, me, persister, maxraftstate, opts)
+	ts.pn = services[0].(*PanServer)
+	ts.raft = services[1]
+
+	// Incoming Raft RPCs reach the local Raft through its own end on the private network
+	local := labrpc.MakeServer()
+	local.AddService(labrpc.MakeService(ts.raft))
+	ts.network.AddServer("local", local)
+	localEnd := ts.network.MakeEnd("local")
+	ts.network.Connect("local", "local")
+	ts.network.Enable("local", true)
+
+	server := netrpc.NewServer()
+	server.RegisterName("Raft", &raftService{localEnd, ts.flush})
+	return ts.start(server)
+}
+
+// Start an observer of the ensemble whose voters listen on voters, and serve it on addr.
+// Like StartPanObserver, the observer keeps no state across restarts. Must return quickly.
+func StartTCPPanObserver(voters []string, addr string, opts ServerOptions) (*TCPPanServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &TCPPanServer{opts: opts, listener: listener, transport: MakeTCPTransport(), voters: make([]*tcpVoter, len(voters)), conns: make(map[net.Conn]bool)}
+
+	ends := make([]voterEnd, len(voters))
+	for i, voter := range voters {
+		ts.voters[i] = &tcpVoter{transport: ts.transport, addr: voter}
+		ends[i] = ts.voters[i]
+	}
+
+	if opts.Addr == "" {
+		opts.Addr = addr
+	}
+
+	// Follow voters that Reconfig moves to new addresses
+	onReconfig := opts.OnReconfig
+	opts.OnReconfig = func(membership rpc.Membership) {
+		ts.movePeers(membership)
+		if onReconfig != nil {
+			onReconfig(membership)
+		}
+	}
+
+	// An observer is numbered after the voters, as in the tester
+	ts.pn = startObserver(make([]*labrpc.ClientEnd, len(voters)), ends, len(voters), opts)
+	return ts.start(netrpc.NewServer())
+}
+
+// Serve the PanServer's RPCs on the listener, along with those already registered on server, and the admin and
+// metrics endpoints that ts.opts asks for. Kills ts if it can't.
+func (ts *TCPPanServer) start(server *netrpc.Server) (*TCPPanServer, error) {
+	opts := ts.opts
+	server.RegisterName("PanServer", &panService{ts.pn, ts.flush})
+	go ts.serve(server)
+
+	if opts.AdminAddr != "" {
+		var err error
+		if ts.admin, err = net.Listen("tcp", opts.AdminAddr); err != nil {
+			ts.Kill()
+			return nil, err
+		}
+		go ts.serveAdmin()
+	}
+
+	if opts.MetricsAddr != "" {
+		metricsListener, err := net.Listen("tcp", opts.MetricsAddr)
+		if err != nil {
+			ts.Kill()
+			return nil, err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", ts.pn.Metrics())
+		ts.metrics = &http.Server{Handler: mux}
+		go ts.metrics.Serve(metricsListener)
+	}
+
+	return ts, nil
+}
+
+// Returns the PanServer served by this TCPPanServer.
+func (ts *TCPPanServer) PanServer() *PanServer {
+	return ts.pn
+}
+
+// Point each remote peer, or each voter an observer follows, at its address in a new membership.
+func (ts *TCPPanServer) movePeers(membership rpc.Membership) {
+	for i, peer := range ts.peers {
+		if addr, ok := membership.Voters[i]; ok && peer != nil {
+			peer.setAddr(addr)
+		}
+	}
+	for i, voter := range ts.voters {
+		if addr, ok := membership.Voters[i]; ok {
+			voter.setAddr(addr)
+		}
+	}
+}
+
+// Make the state this server is about to report durable, if it has a Flush option, along with its audit log.
+func (ts *TCPPanServer) flush() error {
+	if ts.opts.Flush != nil {
+		if err := ts.opts.Flush(); err != nil {
+			return err
+		}
+	}
+	if ts.opts.AuditLog != nil {
+		return ts.opts.AuditLog.Sync()
+	}
+	return nil
+}
+
+// Serve clients and Raft peers on each connection accepted by the listener, until Kill.
+func (ts *TCPPanServer) serve(server *netrpc.Server) {
+	for {
+		conn, err := ts.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		ts.mu.Lock()
+		if ts.killed {
+			ts.mu.Unlock()
+			conn.Close()
+			return
+		}
+		ts.conns[conn] = true
+		ts.mu.Unlock()
+
+		go func() {
+			server.ServeConn(conn)
+			ts.mu.Lock()
+			defer ts.mu.Unlock()
+			delete(ts.conns, conn)
+		}()
+	}
+}
+
+// Serve admin commands over raw TCP, like ZooKeeper's four-letter words:
+// the client sends the command and reads the output until the server closes the connection.
+func (ts *TCPPanServer) serveAdmin() {
+	for {
+		conn, err := ts.admin.Accept()
+		if err != nil {
+			return
+		}
+		go ts.handleAdmin(conn)
+	}
+}
+
+func (ts *TCPPanServer) handleAdmin(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	command := make([]byte, 4)
+	if _, err := io.ReadFull(conn, command); err != nil {
+		return
+	}
+	output, ok := ts.pn.adminCommand(string(command))
+	if !ok {
+		output = fmt.Sprintf("%s is not a valid command\n", command)
+	}
+	io.WriteString(conn, output)
+}
+
+// Stop serving, drop every open connection, and kill the PanServer and its Raft.
+func (ts *TCPPanServer) Kill() {
+	ts.listener.Close()
+	ts.mu.Lock()
+	ts.killed = true
+	for conn := range ts.conns {
+		conn.Close()
+	}
+	ts.mu.Unlock()
+	if ts.admin != nil {
+		ts.admin.Close()
+	}
+	if ts.metrics != nil {
+		ts.metrics.Close()
+	}
+	ts.pn.Kill()
+	if ts.raft != nil {
+		ts.raft.Kill()
+		ts.network.Cleanup()
+	}
+	ts.transport.Close()
+}
+
+// Reaches a voter's PanServer over TCP, for an observer to follow and forward requests to.
+type tcpVoter struct {
+	transport *TCPTransport
+
+	mu   sync.Mutex
+	addr string // changed by Reconfig when the voter moves
+}
+
+func (tv *tcpVoter) setAddr(addr string) {
+	tv.mu.Lock()
+	defer tv.mu.Unlock()
+	tv.addr = addr
+}
+
+func (tv *tcpVoter) Call(method string, args any, reply any) bool {
+	tv.mu.Lock()
+	addr := tv.addr
+	tv.mu.Unlock()
+	return tv.transport.Call(addr, method, args, reply)
+}
+
+// Forwards Raft RPCs for one remote peer from the private labrpc network over TCP.
+type raftPeer struct {
+	network   *labrpc.Network
+	name      string // name of both the labrpc end and server for this peer
+	transport *TCPTransport
+
+	mu   sync.Mutex
+	addr string // changed by Reconfig when the peer moves
+}
+
+// Install a fresh proxy server for this peer on the private network.
+func (rp *raftPeer) serve() {
+	server := labrpc.MakeServer()
+	server.AddService(labrpc.MakeService(&Raft{rp}))
+	rp.network.AddServer(rp.name, server)
+}
+
+func (rp *raftPeer) setAddr(addr string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.addr = addr
+}
+
+func (rp *raftPeer) call(method string, args any, reply any) {
+	rp.mu.Lock()
+	addr := rp.addr
+	rp.mu.Unlock()
+
+	if !rp.transport.Call(addr, "Raft."+method, args, reply) {
+		// A labrpc handler can't report failure, but labrpc fails a call whose server is replaced mid-call.
+		// Swap in a fresh proxy so Raft sees a lost RPC instead of an empty reply.
+		rp.serve()
+	}
+}
+
+// Raft stands in for a remote replica's Raft on the private labrpc network.
+// labrpc routes "Raft.<Method>" calls by receiver type name, so this type must be called Raft,
+// and its methods must match the RPCs implemented by 6.5840/raft1.
+type Raft struct {
+	peer *raftPeer
+}
+
+// The Raft RPCs forwarded between replicas. Both the lab's Raft and the stand-in must implement them,
+// so a change to the RPCs or their argument types in 6.5840/raft1 fails the build instead of every forwarded call.
+type raftRPCs interface {
+	RequestVote(args *raft.RequestVoteArgs, reply *raft.RequestVoteReply)
+	AppendEntries(args *raft.AppendEntriesArgs, reply *raft.AppendEntriesReply)
+	InstallSnapshot(args *raft.InstallSnapshotArgs, reply *raft.InstallSnapshotReply)
+}
+
+var (
+	_ raftRPCs = (*raft.Raft)(nil)
+	_ raftRPCs = (*Raft)(nil)
+)
+
+func (r *Raft) RequestVote(args *raft.RequestVoteArgs, reply *raft.RequestVoteReply) {
+	r.peer.call("RequestVote", args, reply)
+}
+
+func (r *Raft) AppendEntries(args *raft.AppendEntriesArgs, reply *raft.AppendEntriesReply) {
+	r.peer.call("AppendEntries", args, reply)
+}
+
+func (r *Raft) InstallSnapshot(args *raft.InstallSnapshotArgs, reply *raft.InstallSnapshotReply) {
+	r.peer.call("InstallSnapshot", args, reply)
+}
+
+var errRaftUnreachable = errors.New("local raft did not reply")
+
+// net/rpc service handing Raft RPCs from remote peers to the local Raft.
+// Replies only once the votes and log entries they acknowledge are durable.
+type raftService struct {
+	end   *labrpc.ClientEnd
+	flush func() error
+}
+
+func (rs *raftService) call(method string, args any, reply any) error {
+	if !rs.end.Call("Raft."+method, args, reply) {
+		return errRaftUnreachable
+	}
+	return rs.flush()
+}
+
+func (rs *raftService) RequestVote(args *raft.RequestVoteArgs, reply *raft.RequestVoteReply) error {
+	return rs.call("RequestVote", args, reply)
+}
+
+func (rs *raftService) AppendEntries(args *raft.AppendEntriesArgs, reply *raft.AppendEntriesReply) error {
+	return rs.call("AppendEntries", args, reply)
+}
+
+func (rs *raftService) InstallSnapshot(args *raft.InstallSnapshotArgs, reply *raft.InstallSnapshotReply) error {
+	return rs.call("InstallSnapshot", args, reply)
+}
+
+// net/rpc service exposing a PanServer's RPCs to Sessions, and to the observers following it.
+// net/rpc methods must return an error, which the PanServer RPCs don't; the error reports a failed flush instead.
+type panService struct {
+	pn    *PanServer
+	flush func() error
+}
+
+func (ps *panService) StartSession(args *rpc.StartSessionArgs, reply *rpc.StartSessionReply) error {
+	ps.pn.StartSession(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) EndSession(args *rpc.EndSessionArgs, reply *rpc.EndSessionReply) error {
+	ps.pn.EndSession(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) KeepAlive(args *rpc.KeepAliveArgs, reply *rpc.KeepAliveReply) error {
+	ps.pn.KeepAlive(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) Create(args *rpc.CreateArgs, reply *rpc.CreateReply) error {
+	ps.pn.Create(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) Exists(args *rpc.ExistsArgs, reply *rpc.ExistsReply) error {
+	ps.pn.Exists(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) GetData(args *rpc.GetDataArgs, reply *rpc.GetDataReply) error {
+	ps.pn.GetData(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) SetData(args *rpc.SetDataArgs, reply *rpc.SetDataReply) error {
+	ps.pn.SetData(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) GetChildren(args *rpc.GetChildrenArgs, reply *rpc.GetChildrenReply) error {
+	ps.pn.GetChildren(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) Delete(args *rpc.DeleteArgs, reply *rpc.DeleteReply) error {
+	ps.pn.Delete(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) GetHighestSequence(args *rpc.GetHighestSeqArgs, reply *rpc.GetHighestSeqReply) error {
+	ps.pn.GetHighestSequence(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) Reconfig(args *rpc.ReconfigArgs, reply *rpc.ReconfigReply) error {
+	ps.pn.Reconfig(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) Batch(args *rpc.BatchArgs, reply *rpc.BatchReply) error {
+	ps.pn.Batch(args, reply)
+	return ps.flush()
+}
+
+func (ps *panService) Admin(args *rpc.AdminArgs, reply *rpc.AdminReply) error {
+	ps.pn.Admin(args, reply)
+	return nil
+}
+
+func (ps *panService) WatchWait(args *rpc.WatchWaitArgs, reply *rpc.WatchWaitReply) error {
+	ps.pn.WatchWait(args, reply)
+	return nil
+}
+
+func (ps *panService) Follow(args *FollowArgs, reply *FollowReply) error {
+	ps.pn.Follow(args, reply)
+	return nil
+}
+
+func (ps *panService) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	ps.pn.Forward(args, reply)
+	return ps.flush()
+}
@@ -1,7 +1,9 @@
 package pan
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"6.5840/labrpc"
 	"6.5840/tester1"
@@ -14,11 +16,13 @@ type Test struct {
 	part         string // to print which test it is
 	nclients     int
 	nservers     int
+	nobservers   int // the last nobservers of the nservers servers are observers
 	leaderCrash  bool
 	clientCrash  bool
 	partitions   bool
 	maxraftstate int // probably unecessary?
 	randomfiles  bool
+	opts         ServerOptions // options for the voting servers
 }
 
 const Gid = tester.GRP0
@@ -34,6 +38,7 @@ func MakeTest(t *testing.T, part string, nclients int, nservers int, reliable bo
 		partitions:   partitions,
 		maxraftstate: maxraftstate,
 		randomfiles:  randomfiles,
+		opts:         DefaultServerOptions(),
 	}
 	cfg := tester.MakeConfig(t, nservers, reliable, ts.StartPanServer)
 	ts.Test = panapi.MakeTest(t, cfg, randomfiles, ts)
@@ -41,8 +46,46 @@ func MakeTest(t *testing.T, part string, nclients int, nservers int, reliable bo
 	return ts
 }
 
+// Like MakeTest, but nobservers observers are started after the nvoters voting servers.
+func MakeTestObservers(t *testing.T, part string, nclients int, nvoters int, nobservers int, reliable bool, maxraftstate int) *Test {
+	ts := &Test{
+		t:            t,
+		part:         part,
+		nclients:     nclients,
+		nservers:     nvoters + nobservers,
+		nobservers:   nobservers,
+		maxraftstate: maxraftstate,
+		opts:         DefaultServerOptions(),
+	}
+	cfg := tester.MakeConfig(t, ts.nservers, reliable, ts.StartPanServer)
+	ts.Test = panapi.MakeTest(t, cfg, false, ts)
+	ts.Begin(ts.makeTitle())
+	return ts
+}
+
+// Like MakeTest on a reliable network, but the servers are started with opts.
+func MakeTestOptions(t *testing.T, part string, nclients int, nservers int, maxraftstate int, opts ServerOptions) *Test {
+	ts := &Test{
+		t:            t,
+		part:         part,
+		nclients:     nclients,
+		nservers:     nservers,
+		maxraftstate: maxraftstate,
+		opts:         opts,
+	}
+	cfg := tester.MakeConfig(t, nservers, true, ts.StartPanServer)
+	ts.Test = panapi.MakeTest(t, cfg, false, ts)
+	ts.Begin(ts.makeTitle())
+	return ts
+}
+
 func (ts *Test) StartPanServer(servers []*labrpc.ClientEnd, gid tester.Tgid, me int, persister *tester.Persister) []tester.IService {
-	return StartPanServer(servers, gid, me, persister, ts.maxraftstate)
+	// Only the voters are Raft peers
+	nvoters := ts.nservers - ts.nobservers
+	if me >= nvoters {
+		return StartPanObserver(servers[:nvoters], gid, me, persister, DefaultServerOptions())
+	}
+	return StartPanServerWithOptions(servers[:nvoters], gid, me, persister, ts.maxraftstate, ts.opts)
 }
 
 func (ts *Test) MakeSession() panapi.IPNSession {
@@ -58,11 +101,75 @@ func (ts *Test) MakeSessionTo(to []int) panapi.IPNSession {
 	return &panapi.TestSession{ck, clnt}
 }
 
+// Make a session that only talks to the observers.
+func (ts *Test) MakeObserverSession() panapi.IPNSession {
+	clnt := ts.Config.MakeClient()
+	ck := MakeSession(clnt, ts.Group(Gid).SrvNames()[ts.nservers-ts.nobservers:])
+	return &panapi.TestSession{IPNSession: ck, Clnt: clnt}
+}
+
 func (ts *Test) DeleteSession(ck panapi.IPNSession) {
 	tck := ck.(*panapi.TestSession)
 	ts.DeleteClient(tck.Clnt)
 }
 
+// Until stop is closed, repeatedly shut down every server for a second, then restart them all and leave them up for
+// up. Run it in its own goroutine.
+func (ts *Test) CrashAllLoop(stop chan struct{}, up time.Duration) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+			for i := 0; i < ts.nservers; i++ {
+				ts.Group(Gid).ShutdownServer(i)
+			}
+			time.Sleep(time.Second)
+			for i := 0; i < ts.nservers; i++ {
+				ts.Group(Gid).StartServer(i)
+			}
+			ts.Group(Gid).ConnectAll()
+			time.Sleep(up)
+		}
+	}
+}
+
+// Run each client in its own goroutine, and crash every server over and over meanwhile if the test was made with
+// leaderCrash. A client returns "" once it is done, or else what went wrong, which fails the test. Returns once every
+// client is done.
+func (ts *Test) RunClients(clients ...func() string) {
+	ch_err := make(chan string, len(clients))
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client(); err != "" {
+				ch_err <- err
+			}
+		}()
+	}
+
+	ch_crash := make(chan struct{})
+	if ts.leaderCrash {
+		go ts.CrashAllLoop(ch_crash, 2*time.Second)
+	}
+
+	ch_done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch_done)
+	}()
+	select {
+	case err := <-ch_err:
+		ts.t.Fatal(err)
+	case <-ch_done:
+	}
+	if ts.leaderCrash {
+		ch_crash <- struct{}{}
+	}
+}
+
 func (ts *Test) cleanup() {
 	ts.Test.Cleanup()
 }
@@ -86,6 +193,12 @@ func (ts *Test) makeTitle() string {
 	if ts.randomfiles {
 		title = title + "random files, "
 	}
+	if ts.nobservers > 0 {
+		title = title + "observers, "
+	}
+	if ts.opts.BatchWindow > 0 {
+		title = title + "group commit, "
+	}
 	if ts.nclients > 1 {
 		title = title + "many clients"
 	} else {
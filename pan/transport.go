@@ -0,0 +1,96 @@
+package pan
+
+import (
+	"errors"
+	"net"
+	netrpc "net/rpc"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = time.Second
+	callTimeout = 10 * time.Second // longer than any call takes on a live server, including a WatchWait long poll
+)
+
+// TCPTransport is a Transport that reaches servers over TCP with net/rpc.
+// Server names are host:port addresses. Connections are dialed lazily and dropped on any transport error or on a
+// call that takes longer than callTimeout, so a restarted or unreachable server is redialed on the next call.
+type TCPTransport struct {
+	mu      sync.Mutex
+	clients map[string]*netrpc.Client
+}
+
+func MakeTCPTransport() *TCPTransport {
+	return &TCPTransport{clients: make(map[string]*netrpc.Client)}
+}
+
+// Returns a connected client for the given address, dialing it if necessary.
+func (tt *TCPTransport) dial(server string) (*netrpc.Client, error) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if client, ok := tt.clients[server]; ok {
+		return client, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", server, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := netrpc.NewClient(conn)
+	tt.clients[server] = client
+	return client, nil
+}
+
+// Forget a broken client, unless it has already been replaced.
+func (tt *TCPTransport) drop(server string, client *netrpc.Client) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if tt.clients[server] == client {
+		delete(tt.clients, server)
+	}
+	client.Close()
+}
+
+// Call a method on a server. Returns true iff the server received the call and replied within callTimeout.
+func (tt *TCPTransport) Call(server string, method string, args any, reply any) bool {
+	client, err := tt.dial(server)
+	if err != nil {
+		return false
+	}
+
+	// Call into a reply of our own, so that a reply arriving after the timeout can't write to the caller's
+	res := reflect.New(reflect.TypeOf(reply).Elem())
+	timer := time.NewTimer(callTimeout)
+	defer timer.Stop()
+	select {
+	case call := <-client.Go(method, args, res.Interface(), make(chan *netrpc.Call, 1)).Done:
+		if call.Error != nil {
+			var serverErr netrpc.ServerError
+			if !errors.As(call.Error, &serverErr) {
+				tt.drop(server, client)
+			}
+			return false
+		}
+		reflect.ValueOf(reply).Elem().Set(res.Elem())
+		return true
+	case <-timer.C:
+		// The connection is likely dead without either end having noticed
+		tt.drop(server, client)
+		return false
+	}
+}
+
+// Close every open connection.
+func (tt *TCPTransport) Close() {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	for server, client := range tt.clients {
+		client.Close()
+		delete(tt.clients, server)
+	}
+}
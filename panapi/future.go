@@ -0,0 +1,66 @@
+package panapi
+
+import (
+	"sync"
+
+	"pan/panapi/rpc"
+)
+
+// The pending result of an asynchronous call. The futures of one session complete in the order their calls were made.
+type Future[T any] struct {
+	mu        sync.Mutex
+	done      chan struct{}
+	value     T
+	err       rpc.Err
+	callbacks []func(T, rpc.Err)
+}
+
+func MakeFuture[T any]() *Future[T] {
+	return &Future[T]{done: make(chan struct{})}
+}
+
+// Set the result and run the callbacks registered so far. Must be called exactly once.
+func (f *Future[T]) Complete(value T, err rpc.Err) {
+	f.mu.Lock()
+	f.value, f.err = value, err
+	callbacks := f.callbacks
+	f.callbacks = nil
+	close(f.done)
+	f.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(value, err)
+	}
+}
+
+// Block until the call completes, and return its result.
+func (f *Future[T]) Wait() (T, rpc.Err) {
+	<-f.done
+	return f.value, f.err
+}
+
+// Returns a channel that is closed once the call completes.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Call callback with the result once the call completes. Callbacks registered before completion run in order on the
+// goroutine that completes the future, after the callbacks of the same session's earlier calls, so they should not
+// block; a callback registered after completion runs right away.
+func (f *Future[T]) Then(callback func(T, rpc.Err)) {
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		callback(f.value, f.err)
+	default:
+		f.callbacks = append(f.callbacks, callback)
+		f.mu.Unlock()
+	}
+}
+
+// The data and version of a znode, as returned by GetDataAsync
+type DataResult struct {
+	Data    string
+	Version rpc.Pversion
+}
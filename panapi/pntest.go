@@ -1,6 +1,7 @@
 package panapi
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"strconv"
@@ -39,8 +40,37 @@ type IPNSession interface {
 
 	Sync(path rpc.Ppath) rpc.Err
 
+	// Changes the ensemble's membership, stored in rpc.ConfigPath
+	Reconfig(joining []string, leaving []string, fromVersion rpc.Pversion) (rpc.Pversion, rpc.Err)
+
 	// Ends the current client session
 	EndSession()
+
+	// Returns the session timeout the servers negotiated: how long they keep the session alive without hearing from it
+	SessionTimeout() time.Duration
+
+	// Variants of the methods above that stop retrying once ctx is done, and return rpc.ErrTimeout if its deadline
+	// passed or rpc.ErrCanceled if it was canceled. A change made by a call that gave up may or may not have happened.
+	// ctx only bounds the call: a watch that a call sets stays registered after ctx is done, and its callback still
+	// runs when the watch fires, so callbacks must not block on a caller that has given up.
+	CreateCtx(ctx context.Context, path rpc.Ppath, data string, flags rpc.Flag) (rpc.Ppath, rpc.Err)
+	DeleteCtx(ctx context.Context, path rpc.Ppath, version rpc.Pversion) rpc.Err
+	ExistsCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) (bool, rpc.Err)
+	GetDataCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) (string, rpc.Pversion, rpc.Err)
+	SetDataCtx(ctx context.Context, path rpc.Ppath, data string, version rpc.Pversion) rpc.Err
+	GetChildrenCtx(ctx context.Context, path rpc.Ppath, watch rpc.Watch) ([]rpc.Ppath, rpc.Err)
+	SyncCtx(ctx context.Context, path rpc.Ppath) rpc.Err
+	ReconfigCtx(ctx context.Context, joining []string, leaving []string, fromVersion rpc.Pversion) (rpc.Pversion, rpc.Err)
+	EndSessionCtx(ctx context.Context) rpc.Err
+
+	// Variants of the methods above that return at once, with a future for the result. A session's asynchronous
+	// calls take effect, and their futures complete, in the order they were made.
+	CreateAsync(path rpc.Ppath, data string, flags rpc.Flag) *Future[rpc.Ppath]
+	DeleteAsync(path rpc.Ppath, version rpc.Pversion) *Future[struct{}]
+	ExistsAsync(path rpc.Ppath, watch rpc.Watch) *Future[bool]
+	GetDataAsync(path rpc.Ppath, watch rpc.Watch) *Future[DataResult]
+	SetDataAsync(path rpc.Ppath, data string, version rpc.Pversion) *Future[struct{}]
+	GetChildrenAsync(path rpc.Ppath, watch rpc.Watch) *Future[[]rpc.Ppath]
 }
 
 type TestSession struct {
@@ -137,7 +167,7 @@ func (ts *Test) CheckRes(ck IPNSession, res TestType, dir rpc.Ppath) {
 		}
 	}
 	actual, _ := ck.Create(dir + "/f-", "", rpc.Flag{Ephemeral: false, Sequential: true})
-	expected := dir + "/f-" + rpc.Ppath(strconv.Itoa(res.Expected))
+	expected := dir + "/f-" + rpc.Ppath(rpc.SeqSuffix(res.Expected))
 	if actual != expected {
 		ts.t.Fatalf("Created znode %s but expected znode %s instead\n", actual, expected)
 	}
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path of the znode holding the ensemble's membership. Only Reconfig can change it.
+const ConfigPath Ppath = "/pan/config"
+
+// The servers of an ensemble, as stored in ConfigPath: one "server.N=address" line per voter, where N is the voter's
+// Raft peer index, and one "observer.N=address" line per observer.
+type Membership struct {
+	Voters    map[int]string
+	Observers map[int]string
+}
+
+func MakeMembership() Membership {
+	return Membership{Voters: make(map[int]string), Observers: make(map[int]string)}
+}
+
+// Parse the contents of ConfigPath.
+func ParseMembership(data string) (Membership, error) {
+	m := MakeMembership()
+	for _, line := range strings.Split(data, "\n") {
+		if line == "" {
+			continue
+		}
+		if err := m.Join(line); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// Split "role.N" into the map for role and N.
+func (m Membership) member(id string) (map[int]string, int, error) {
+	role, n, found := strings.Cut(id, ".")
+	index, err := strconv.Atoi(n)
+	if !found || err != nil || index < 0 {
+		return nil, 0, fmt.Errorf("bad server id %q", id)
+	}
+	switch role {
+	case "server":
+		return m.Voters, index, nil
+	case "observer":
+		return m.Observers, index, nil
+	}
+	return nil, 0, fmt.Errorf("bad server id %q", id)
+}
+
+// Add or move the server in a "role.N=address" line.
+func (m Membership) Join(line string) error {
+	id, addr, found := strings.Cut(line, "=")
+	if !found || addr == "" {
+		return fmt.Errorf("expected role.N=address, got %q", line)
+	}
+	servers, index, err := m.member(id)
+	if err != nil {
+		return err
+	}
+	servers[index] = addr
+	return nil
+}
+
+// Remove the server with a "role.N" id.
+func (m Membership) Leave(id string) error {
+	servers, index, err := m.member(id)
+	if err != nil {
+		return err
+	}
+	if _, ok := servers[index]; !ok {
+		return fmt.Errorf("no server %s", id)
+	}
+	delete(servers, index)
+	return nil
+}
+
+func sortedIndexes(servers map[int]string) []int {
+	indexes := make([]int, 0, len(servers))
+	for index := range servers {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// Format the membership as stored in ConfigPath, voters first, each in index order.
+func (m Membership) String() string {
+	var b strings.Builder
+	for _, index := range sortedIndexes(m.Voters) {
+		fmt.Fprintf(&b, "server.%d=%s\n", index, m.Voters[index])
+	}
+	for _, index := range sortedIndexes(m.Observers) {
+		fmt.Fprintf(&b, "observer.%d=%s\n", index, m.Observers[index])
+	}
+	return b.String()
+}
+
+// Returns the addresses of every server, voters first, for a Session to connect to.
+func (m Membership) Servers() []string {
+	servers := []string{}
+	for _, index := range sortedIndexes(m.Voters) {
+		servers = append(servers, m.Voters[index])
+	}
+	for _, index := range sortedIndexes(m.Observers) {
+		servers = append(servers, m.Observers[index])
+	}
+	return servers
+}
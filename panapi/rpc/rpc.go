@@ -1,8 +1,11 @@
 package rpc
 
 import (
+	"crypto/rand"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Pversion int
@@ -10,6 +13,8 @@ type Ppath string
 type Flag struct {
 	Ephemeral  bool
 	Sequential bool
+	Protected  bool   // embed a per-call GUID in the name so the creator can find its znode after a lost reply
+	Guid       string // with Protected, the GUID to embed, from NewGuid; empty for a fresh one per call
 }
 
 // Convert a Ppath into a list of strings, split along slashes
@@ -27,6 +32,12 @@ func MakePpath(path []string) Ppath {
 	return Ppath(strings.Join(path, "/"))
 }
 
+// Returns the path of the parent znode
+func (path *Ppath) Parent() Ppath {
+	dirs := path.ParsePath()
+	return MakePpath(dirs[:len(dirs)-1])
+}
+
 func (path *Ppath) Suffix() string {
 	dirs := path.ParsePath()
 	return dirs[len(dirs)-1]
@@ -44,6 +55,33 @@ func (path *Ppath) GetSeqNumber() int {
 	return output
 }
 
+// Sequential znode names end in a zero-padded counter of SeqDigits digits,
+// so that lexical and numeric order of siblings agree
+const (
+	SeqDigits = 10
+	MaxSeqNum = 9999999999
+)
+
+// Protected znodes are named ProtectedPrefix + GUID + "-" + name, like Curator's protection mode
+const ProtectedPrefix = "_c_"
+
+// Returns a random GUID for a protected create
+func NewGuid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Returns the name of a protected znode created with the given GUID
+func ProtectedName(guid string, name string) string {
+	return ProtectedPrefix + guid + "-" + name
+}
+
+// Returns the zero-padded suffix appended to a sequential znode with the given sequence number
+func SeqSuffix(seqNum int) string {
+	return fmt.Sprintf("%0*d", SeqDigits, seqNum)
+}
+
 type Err string
 
 const (
@@ -53,20 +91,39 @@ const (
 	ErrVersion       = "ErrVersion"
 	ErrSessionClosed = "ErrSessionClosed"
 	ErrDeleteRoot    = "ErrDeleteRoot"
+	ErrNotEmpty      = "ErrNotEmpty"
+	ErrSeqOverflow   = "ErrSeqOverflow"
+	ErrReadOnly      = "ErrReadOnly"
+	ErrReconfig      = "ErrReconfig"
+	ErrFixedVoters   = "ErrFixedVoters"  // Reconfig tried to add or remove a voter; only observers can come and go
+	ErrWatchPending  = "ErrWatchPending" // WatchWait returned before the watch fired; wait again
+
+	// Err returned by the admin RPC only
+	ErrUnknownCommand = "ErrUnknownCommand"
 
 	// Err returned by Session only
-	ErrMaybe = "ErrMaybe"
+	ErrMaybe    = "ErrMaybe"
+	ErrTimeout  = "ErrTimeout"  // the call's context passed its deadline; a change it makes may or may not have happened
+	ErrCanceled = "ErrCanceled" // the call's context was canceled; a change it makes may or may not have happened
 
 	// For future kvraft lab
 	ErrWrongLeader = "ErrWrongLeader"
 	ErrWrongGroup  = "ErrWrongGroup"
 )
 
+// Replies to requests that go through Raft carry a Leader hint with ErrWrongLeader: the address clients reach the
+// server the replying server believes leads at, or NoLeader if it doesn't know.
+const NoLeader = ""
+
 type StartSessionArgs struct {
+	Timeout  time.Duration // requested session timeout; zero asks for the server's default
+	Identity string        // who the client says it is, recorded in the audit log; not authenticated
 }
 
 type StartSessionReply struct {
 	SessionId int
+	Timeout   time.Duration // session timeout negotiated by the server
+	Leader    string
 	Err       Err
 }
 
@@ -75,7 +132,8 @@ type EndSessionArgs struct {
 }
 
 type EndSessionReply struct {
-	Err Err
+	Leader string
+	Err    Err
 }
 
 type KeepAliveArgs struct {
@@ -83,7 +141,8 @@ type KeepAliveArgs struct {
 }
 
 type KeepAliveReply struct {
-	Err Err
+	Leader string
+	Err    Err
 }
 
 type CreateArgs struct {
@@ -91,11 +150,13 @@ type CreateArgs struct {
 	Path      Ppath
 	Data      string
 	Flags     Flag
+	Guid      string // set by the Session for protected creates
 }
 
 type CreateReply struct {
 	ZNodeName Ppath
 	CreatedBy int // the session ID of the creator of this znode
+	Leader    string
 	Err       Err
 }
 
@@ -108,6 +169,7 @@ type ExistsArgs struct {
 type ExistsReply struct {
 	Result  bool
 	WatchId int
+	Leader  string
 	Err     Err
 }
 
@@ -121,6 +183,7 @@ type GetDataReply struct {
 	Data    string
 	Version Pversion
 	WatchId int
+	Leader  string
 	Err     Err
 }
 
@@ -132,7 +195,8 @@ type SetDataArgs struct {
 }
 
 type SetDataReply struct {
-	Err Err
+	Leader string
+	Err    Err
 }
 
 type GetChildrenArgs struct {
@@ -144,6 +208,7 @@ type GetChildrenArgs struct {
 type GetChildrenReply struct {
 	Children []Ppath
 	WatchId  int
+	Leader   string
 	Err      Err
 }
 
@@ -154,7 +219,8 @@ type DeleteArgs struct {
 }
 
 type DeleteReply struct {
-	Err Err
+	Leader string
+	Err    Err
 }
 
 type GetHighestSeqArgs struct {
@@ -164,6 +230,7 @@ type GetHighestSeqArgs struct {
 
 type GetHighestSeqReply struct {
 	SeqNum int
+	Leader string
 	Err    Err
 }
 
@@ -176,3 +243,37 @@ type WatchWaitReply struct {
 	WatchEvent WatchArgs
 	Err        Err
 }
+
+type ReconfigArgs struct {
+	SessionId   int
+	Joining     []string // "server.N=address" for voter N moved with its data to a new address, or "observer.N=address" to add or move an observer
+	Leaving     []string // "observer.N" to remove an observer; voters can only be moved, not removed
+	FromVersion Pversion // version of ConfigPath the change is based on, or -1 to apply it to any version
+}
+
+type ReconfigReply struct {
+	Version Pversion // version of ConfigPath after the change
+	Leader  string
+	Err     Err
+}
+
+type BatchArgs struct {
+	SessionId int
+	BatchId   int64 // increases with each batch a session sends; a retried batch keeps its id
+	Requests  []any // CreateArgs, DeleteArgs, ExistsArgs, GetDataArgs, SetDataArgs or GetChildrenArgs, applied in order
+}
+
+type BatchReply struct {
+	Replies []any // the reply to each request, by value
+	Leader  string
+	Err     Err
+}
+
+type AdminArgs struct {
+	Command string // one of the four-letter words ruok, stat, mntr, cons, wchs, wchp, dump
+}
+
+type AdminReply struct {
+	Output string
+	Err    Err
+}